@@ -59,6 +59,7 @@ import {
   ExportFormat,
   ExportResponse,
   HistoryEntry,
+  HistoryListResponse,
   HistoryMetadata,
   Image,
   CIRulesRequest,
@@ -570,8 +571,10 @@ export function App() {
     }
     setHistoryLoading(true);
     try {
-      const data = (await ddClient.extension.vm.service.get('/history')) as HistoryMetadata[];
-      setHistoryEntries(data);
+      const data = (await ddClient.extension.vm.service.get('/history')) as
+        | HistoryListResponse
+        | HistoryMetadata[];
+      setHistoryEntries(Array.isArray(data) ? data : data.entries);
       setHistoryError(undefined);
     } catch (error) {
       setHistoryError(getErrorMessage(error));
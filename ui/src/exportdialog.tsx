@@ -62,6 +62,9 @@ export default function ExportDialog(props: {
               <FormControlLabel value="json" control={<Radio />} label="JSON" />
               <FormControlLabel value="csv" control={<Radio />} label="CSV" />
               <FormControlLabel value="html" control={<Radio />} label="HTML" />
+              <FormControlLabel value="markdown" control={<Radio />} label="Markdown" />
+              <FormControlLabel value="sarif" control={<Radio />} label="SARIF" />
+              <FormControlLabel value="junit" control={<Radio />} label="JUnit XML" />
             </RadioGroup>
           </FormControl>
           {error ? <Alert severity="error">{error}</Alert> : null}
@@ -161,6 +161,26 @@ export interface HistorySummary {
   sizeBytes: number;
   inefficientBytes: number;
   efficiencyScore: number;
+  estimatedPullBytes?: number;
+  gzipSizeBytes?: number;
+  zstdSizeBytes?: number;
+  layerCount?: number;
+}
+
+export interface HistoryBaselineDelta {
+  baselineId: string;
+  baselineImage: string;
+  sizeBytes: number;
+  inefficientBytes: number;
+  efficiencyScore: number;
+  layerCount?: number;
+  estimatedPullBytes?: number;
+}
+
+export interface HistoryLayerRef {
+  digestId?: string;
+  sizeBytes: number;
+  command?: string;
 }
 
 export interface HistoryMetadata {
@@ -171,6 +191,20 @@ export interface HistoryMetadata {
   createdAt: string;
   completedAt: string;
   summary: HistorySummary;
+  pinned?: boolean;
+  notes?: string;
+  labels?: string[];
+  baseline?: boolean;
+  baselineDelta?: HistoryBaselineDelta;
+  storedBytes?: number;
+  logicalBytes?: number;
+  layers?: HistoryLayerRef[];
+}
+
+export interface HistoryListResponse {
+  entries: HistoryMetadata[];
+  total: number;
+  nextCursor?: string;
 }
 
 export interface HistoryEntry {
@@ -207,10 +241,16 @@ export interface CompareLayerDelta {
   sizeBytesDelta: number;
 }
 
-export type ExportFormat = 'json' | 'csv' | 'html';
+export type ExportFormat = 'json' | 'csv' | 'html' | 'markdown' | 'sarif' | 'junit';
+
+export type ExportDetail = 'summary' | 'standard' | 'full';
 
 export interface ExportRequest {
   format: ExportFormat;
+  detail?: ExportDetail;
+  compareTo?: string;
+  rules?: CIRulesRequest;
+  dockerfile?: string;
 }
 
 export interface ExportResponse {
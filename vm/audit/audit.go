@@ -0,0 +1,227 @@
+package audit
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"deep-dive/dive"
+)
+
+type Kind string
+
+const (
+	KindSetuid          Kind = "setuid"
+	KindSetgid          Kind = "setgid"
+	KindWorldWritable   Kind = "world-writable"
+	KindUnexpectedOwner Kind = "unexpected-owner"
+	KindDeviceNode      Kind = "device-node"
+)
+
+type Severity string
+
+const (
+	SeverityHigh   Severity = "high"
+	SeverityMedium Severity = "medium"
+	SeverityLow    Severity = "low"
+)
+
+const maxFindingsPerKind = 200
+
+// Unix permission bits as stored in raw tar headers. Dive may export either
+// these or Go's os.FileMode flags, so both encodings are checked.
+const (
+	unixSetuid = 0o4000
+	unixSetgid = 0o2000
+	unixSticky = 0o1000
+)
+
+const (
+	tarTypeChar  = '3'
+	tarTypeBlock = '4'
+)
+
+// Options configures Run. ExpectedUIDs enables the unexpected-owner check:
+// files owned by any other UID are reported. Without it owners are not
+// checked.
+type Options struct {
+	ExpectedUIDs []int `json:"expectedUids,omitempty"`
+}
+
+// Finding describes a file header attribute worth reviewing. LayerIndex is
+// the layer that introduced it; InFinalImage reports whether the attribute
+// survives to the final filesystem, since files removed by a later layer
+// are still shipped in the lower layer's blob.
+type Finding struct {
+	Kind         Kind     `json:"kind"`
+	Severity     Severity `json:"severity"`
+	Path         string   `json:"path"`
+	Mode         string   `json:"mode"`
+	UID          int      `json:"uid"`
+	GID          int      `json:"gid"`
+	LayerIndex   int      `json:"layerIndex"`
+	LayerDigest  string   `json:"layerDigest,omitempty"`
+	LayerCommand string   `json:"layerCommand,omitempty"`
+	InFinalImage bool     `json:"inFinalImage"`
+}
+
+// Report carries the Options it was produced with, so consumers can tell
+// whether the owner check ran.
+type Report struct {
+	Options   Options      `json:"options"`
+	Findings  []Finding    `json:"findings"`
+	Counts    map[Kind]int `json:"counts"`
+	Truncated bool         `json:"truncated,omitempty"`
+}
+
+func DefaultOptions() Options {
+	return Options{}
+}
+
+// ParseUIDs reads a comma-separated UID list such as "0,1000". An empty
+// value yields no UIDs.
+func ParseUIDs(value string) ([]int, error) {
+	var uids []int
+	if strings.TrimSpace(value) == "" {
+		return uids, nil
+	}
+	for _, field := range strings.Split(value, ",") {
+		uid, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || uid < 0 {
+			return nil, fmt.Errorf("invalid UID: %s", strings.TrimSpace(field))
+		}
+		uids = append(uids, uid)
+	}
+	return uids, nil
+}
+
+// Run inspects the tar header attributes Dive exports for every file in
+// every layer and reports permission settings worth reviewing. A path is
+// reported once per kind, at the first layer whose header carries it.
+func Run(result dive.Result, options Options) Report {
+	expected := make(map[int]bool, len(options.ExpectedUIDs))
+	for _, uid := range options.ExpectedUIDs {
+		expected[uid] = true
+	}
+
+	final := make(map[string]map[Kind]bool)
+	for _, file := range result.Aggregate() {
+		kinds := make(map[Kind]bool)
+		for _, kind := range classify(file.File, expected) {
+			kinds[kind] = true
+		}
+		final[file.Path] = kinds
+	}
+
+	report := Report{
+		Options:  options,
+		Findings: []Finding{},
+		Counts:   make(map[Kind]int),
+	}
+	type findingKey struct {
+		kind Kind
+		path string
+	}
+	seen := make(map[findingKey]bool)
+	for position, layer := range result.Layers {
+		for _, file := range layer.Files {
+			if file.IsWhiteout() {
+				continue
+			}
+			for _, kind := range classify(file, expected) {
+				key := findingKey{kind: kind, path: file.Path}
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				report.Counts[kind]++
+				if report.Counts[kind] > maxFindingsPerKind {
+					report.Truncated = true
+					continue
+				}
+				report.Findings = append(report.Findings, Finding{
+					Kind:         kind,
+					Severity:     severityFor(kind),
+					Path:         file.Path,
+					Mode:         formatMode(file.Mode),
+					UID:          file.UID,
+					GID:          file.GID,
+					LayerIndex:   position,
+					LayerDigest:  layer.DigestID,
+					LayerCommand: layer.Command,
+					InFinalImage: final[file.Path][kind],
+				})
+			}
+		}
+	}
+
+	sort.SliceStable(report.Findings, func(i, j int) bool {
+		left, right := severityRank(report.Findings[i].Severity), severityRank(report.Findings[j].Severity)
+		if left != right {
+			return left < right
+		}
+		return report.Findings[i].Path < report.Findings[j].Path
+	})
+	return report
+}
+
+func classify(file dive.File, expectedUIDs map[int]bool) []Kind {
+	var kinds []Kind
+	mode := file.Mode
+	if mode&uint32(os.ModeSetuid) != 0 || mode&unixSetuid != 0 {
+		kinds = append(kinds, KindSetuid)
+	}
+	if mode&uint32(os.ModeSetgid) != 0 || mode&unixSetgid != 0 {
+		kinds = append(kinds, KindSetgid)
+	}
+	sticky := mode&uint32(os.ModeSticky) != 0 || mode&unixSticky != 0
+	if file.LinkName == "" && mode&0o002 != 0 && !(file.IsDir && sticky) {
+		kinds = append(kinds, KindWorldWritable)
+	}
+	if file.TypeFlag == tarTypeChar || file.TypeFlag == tarTypeBlock || mode&uint32(os.ModeDevice) != 0 {
+		kinds = append(kinds, KindDeviceNode)
+	}
+	if len(expectedUIDs) > 0 && !expectedUIDs[file.UID] {
+		kinds = append(kinds, KindUnexpectedOwner)
+	}
+	return kinds
+}
+
+func severityFor(kind Kind) Severity {
+	switch kind {
+	case KindSetuid, KindDeviceNode:
+		return SeverityHigh
+	case KindSetgid, KindWorldWritable:
+		return SeverityMedium
+	default:
+		return SeverityLow
+	}
+}
+
+func severityRank(severity Severity) int {
+	switch severity {
+	case SeverityHigh:
+		return 0
+	case SeverityMedium:
+		return 1
+	default:
+		return 2
+	}
+}
+
+func formatMode(mode uint32) string {
+	permissions := mode & 0o777
+	var special uint32
+	if mode&uint32(os.ModeSetuid) != 0 || mode&unixSetuid != 0 {
+		special |= 0o4
+	}
+	if mode&uint32(os.ModeSetgid) != 0 || mode&unixSetgid != 0 {
+		special |= 0o2
+	}
+	if mode&uint32(os.ModeSticky) != 0 || mode&unixSticky != 0 {
+		special |= 0o1
+	}
+	return fmt.Sprintf("%o%03o", special, permissions)
+}
@@ -0,0 +1,206 @@
+package breakdown
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"deep-dive/dive"
+)
+
+const (
+	noEcosystem = "(none)"
+	rootBucket  = "/"
+)
+
+type Bucket struct {
+	Name      string  `json:"name"`
+	SizeBytes int64   `json:"sizeBytes"`
+	FileCount int     `json:"fileCount"`
+	Percent   float64 `json:"percent"`
+}
+
+type Breakdown struct {
+	TotalBytes          int64    `json:"totalBytes"`
+	FileCount           int      `json:"fileCount"`
+	Ecosystems          []Bucket `json:"ecosystems"`
+	FileTypes           []Bucket `json:"fileTypes"`
+	TopLevelDirectories []Bucket `json:"topLevelDirectories"`
+}
+
+// ecosystemSegments maps a path segment to the dependency ecosystem it marks.
+var ecosystemSegments = map[string]string{
+	"node_modules":  "node_modules",
+	"site-packages": "site-packages",
+	"dist-packages": "site-packages",
+	"vendor":        "vendor",
+	".m2":           ".m2",
+	".gradle":       ".gradle",
+	"gems":          "gems",
+	".cargo":        ".cargo",
+	".nuget":        ".nuget",
+}
+
+var extensionTypes = map[string]string{
+	".a":     "static-library",
+	".o":     "object-file",
+	".pyc":   "bytecode",
+	".class": "bytecode",
+	".jar":   "archive",
+	".war":   "archive",
+	".whl":   "archive",
+	".zip":   "archive",
+	".tar":   "archive",
+	".gz":    "archive",
+	".tgz":   "archive",
+	".xz":    "archive",
+	".bz2":   "archive",
+	".zst":   "archive",
+	".deb":   "archive",
+	".rpm":   "archive",
+	".apk":   "archive",
+	".js":    "script",
+	".mjs":   "script",
+	".cjs":   "script",
+	".ts":    "script",
+	".py":    "script",
+	".rb":    "script",
+	".pl":    "script",
+	".php":   "script",
+	".sh":    "script",
+	".txt":   "text",
+	".md":    "text",
+	".json":  "text",
+	".yaml":  "text",
+	".yml":   "text",
+	".xml":   "text",
+	".html":  "text",
+	".css":   "text",
+	".conf":  "text",
+	".cfg":   "text",
+	".ini":   "text",
+	".csv":   "text",
+	".map":   "text",
+	".h":     "text",
+	".c":     "text",
+	".go":    "text",
+	".png":   "image",
+	".jpg":   "image",
+	".jpeg":  "image",
+	".gif":   "image",
+	".svg":   "image",
+	".ico":   "image",
+	".webp":  "image",
+	".ttf":   "font",
+	".otf":   "font",
+	".woff":  "font",
+	".woff2": "font",
+	".mo":    "locale-data",
+	".gmo":   "locale-data",
+}
+
+// Classify buckets the bytes of the image's final filesystem by dependency
+// ecosystem, file type and top-level directory. Types are inferred from
+// paths and modes because Dive does not export file contents.
+func Classify(result dive.Result) Breakdown {
+	ecosystems := make(map[string]*Bucket)
+	fileTypes := make(map[string]*Bucket)
+	directories := make(map[string]*Bucket)
+
+	var breakdown Breakdown
+	for _, file := range result.Aggregate() {
+		if file.IsDir {
+			continue
+		}
+		breakdown.TotalBytes += file.SizeBytes
+		breakdown.FileCount++
+		addToBucket(ecosystems, Ecosystem(file.Path), file.SizeBytes)
+		addToBucket(fileTypes, FileType(file.File), file.SizeBytes)
+		addToBucket(directories, TopLevelDirectory(file.Path), file.SizeBytes)
+	}
+
+	breakdown.Ecosystems = finalizeBuckets(ecosystems, breakdown.TotalBytes)
+	breakdown.FileTypes = finalizeBuckets(fileTypes, breakdown.TotalBytes)
+	breakdown.TopLevelDirectories = finalizeBuckets(directories, breakdown.TotalBytes)
+	return breakdown
+}
+
+func Ecosystem(filePath string) string {
+	if strings.Contains(filePath, "/go/pkg/mod/") {
+		return "go-modules"
+	}
+	for _, segment := range strings.Split(strings.TrimPrefix(filePath, "/"), "/") {
+		if ecosystem, ok := ecosystemSegments[segment]; ok {
+			return ecosystem
+		}
+	}
+	return noEcosystem
+}
+
+// FileType guesses a file's type from its path, name and mode only; results
+// carry no file contents or magic bytes, so the format is never verified.
+func FileType(file dive.File) string {
+	if file.LinkName != "" {
+		return "symlink"
+	}
+	if strings.HasPrefix(file.Path, "/usr/share/locale/") || strings.HasPrefix(file.Path, "/usr/lib/locale/") {
+		return "locale-data"
+	}
+	if strings.HasPrefix(file.Path, "/usr/share/doc/") || strings.HasPrefix(file.Path, "/usr/share/man/") || strings.HasPrefix(file.Path, "/usr/share/info/") {
+		return "documentation"
+	}
+
+	name := path.Base(file.Path)
+	if strings.HasSuffix(name, ".so") || strings.Contains(name, ".so.") {
+		return "shared-library"
+	}
+	if fileType, ok := extensionTypes[strings.ToLower(path.Ext(name))]; ok {
+		return fileType
+	}
+	// The exec bit and bin directories also cover scripts, so the format
+	// is left open.
+	if isBinaryDirectory(path.Dir(file.Path)) || file.Mode&0o111 != 0 {
+		return "executable"
+	}
+	return "other"
+}
+
+func isBinaryDirectory(dir string) bool {
+	return strings.HasSuffix(dir, "/bin") || strings.HasSuffix(dir, "/sbin") || strings.HasSuffix(dir, "/libexec")
+}
+
+func TopLevelDirectory(filePath string) string {
+	trimmed := strings.TrimPrefix(filePath, "/")
+	index := strings.Index(trimmed, "/")
+	if index < 0 {
+		return rootBucket
+	}
+	return "/" + trimmed[:index]
+}
+
+func addToBucket(buckets map[string]*Bucket, name string, size int64) {
+	bucket, ok := buckets[name]
+	if !ok {
+		bucket = &Bucket{Name: name}
+		buckets[name] = bucket
+	}
+	bucket.SizeBytes += size
+	bucket.FileCount++
+}
+
+func finalizeBuckets(buckets map[string]*Bucket, total int64) []Bucket {
+	results := make([]Bucket, 0, len(buckets))
+	for _, bucket := range buckets {
+		if total > 0 {
+			bucket.Percent = float64(bucket.SizeBytes) / float64(total) * 100
+		}
+		results = append(results, *bucket)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].SizeBytes != results[j].SizeBytes {
+			return results[i].SizeBytes > results[j].SizeBytes
+		}
+		return results[i].Name < results[j].Name
+	})
+	return results
+}
@@ -0,0 +1,204 @@
+package ci
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"deep-dive/dive"
+)
+
+// Rule names as they appear in .dive-ci files.
+const (
+	RuleLowestEfficiency         = "lowestEfficiency"
+	RuleHighestWastedBytes       = "highestWastedBytes"
+	RuleHighestUserWastedPercent = "highestUserWastedPercent"
+)
+
+// Disabled turns a rule off, as in .dive-ci files.
+const Disabled = "disabled"
+
+const (
+	StatusPassed  = "passed"
+	StatusFailed  = "failed"
+	StatusSkipped = "skipped"
+)
+
+// Metrics are the image measurements the rules are checked against.
+// UserWastedPercent divides the wasted bytes by the size of every layer but
+// the first, the way Dive does.
+type Metrics struct {
+	EfficiencyScore   float64 `json:"efficiencyScore"`
+	WastedBytes       int64   `json:"wastedBytes"`
+	UserSizeBytes     int64   `json:"userSizeBytes"`
+	UserWastedPercent float64 `json:"userWastedPercent"`
+}
+
+// Evaluation is the outcome of one rule. Actual and Threshold are
+// formatted for people; Message explains a failure or skip.
+type Evaluation struct {
+	Rule      string `json:"rule"`
+	Status    string `json:"status"`
+	Actual    string `json:"actual"`
+	Threshold string `json:"threshold,omitempty"`
+	Message   string `json:"message"`
+}
+
+func (e Evaluation) Failed() bool {
+	return e.Status == StatusFailed
+}
+
+// DefaultRules returns the thresholds Dive applies without a .dive-ci file.
+func DefaultRules() RulesRequest {
+	lowestEfficiency := 0.9
+	highestUserWastedPercent := 0.1
+	return RulesRequest{
+		LowestEfficiency:         &lowestEfficiency,
+		HighestWastedBytes:       Disabled,
+		HighestUserWastedPercent: &highestUserWastedPercent,
+	}
+}
+
+func MetricsFor(result dive.Result) Metrics {
+	metrics := Metrics{
+		EfficiencyScore: result.Image.EfficiencyScore,
+		WastedBytes:     result.Image.InefficientBytes,
+	}
+	for position, layer := range result.Layers {
+		if position > 0 {
+			metrics.UserSizeBytes += layer.SizeBytes
+		}
+	}
+	if metrics.UserSizeBytes > 0 {
+		metrics.UserWastedPercent = float64(metrics.WastedBytes) / float64(metrics.UserSizeBytes)
+	}
+	return metrics
+}
+
+// Validate checks the thresholds without evaluating them.
+func (r RulesRequest) Validate() error {
+	if r.LowestEfficiency != nil && (*r.LowestEfficiency < 0 || *r.LowestEfficiency > 1) {
+		return fmt.Errorf("%s must be between 0 and 1", RuleLowestEfficiency)
+	}
+	if r.HighestUserWastedPercent != nil && (*r.HighestUserWastedPercent < 0 || *r.HighestUserWastedPercent > 1) {
+		return fmt.Errorf("%s must be between 0 and 1", RuleHighestUserWastedPercent)
+	}
+	if value := strings.TrimSpace(r.HighestWastedBytes); value != "" && !strings.EqualFold(value, Disabled) {
+		if _, err := ParseBytes(value); err != nil {
+			return fmt.Errorf("%s: %w", RuleHighestWastedBytes, err)
+		}
+	}
+	return nil
+}
+
+// Evaluate checks every rule, in .dive-ci order. Rules left unset or
+// disabled are reported as skipped.
+func Evaluate(rules RulesRequest, metrics Metrics) ([]Evaluation, error) {
+	if err := rules.Validate(); err != nil {
+		return nil, err
+	}
+	evaluations := make([]Evaluation, 0, 3)
+
+	efficiency := Evaluation{Rule: RuleLowestEfficiency, Actual: formatRatio(metrics.EfficiencyScore)}
+	if rules.LowestEfficiency == nil {
+		efficiency.skip()
+	} else {
+		efficiency.Threshold = formatRatio(*rules.LowestEfficiency)
+		efficiency.check(
+			metrics.EfficiencyScore >= *rules.LowestEfficiency,
+			fmt.Sprintf("image efficiency %s is below the lowest allowed %s", efficiency.Actual, efficiency.Threshold),
+		)
+	}
+	evaluations = append(evaluations, efficiency)
+
+	wasted := Evaluation{Rule: RuleHighestWastedBytes, Actual: formatBytes(metrics.WastedBytes)}
+	if value := strings.TrimSpace(rules.HighestWastedBytes); value == "" {
+		wasted.skip()
+	} else if strings.EqualFold(value, Disabled) {
+		wasted.skip()
+		wasted.Message = "rule is disabled"
+	} else {
+		threshold, _ := ParseBytes(value)
+		wasted.Threshold = fmt.Sprintf("%s (%s)", formatBytes(threshold), value)
+		wasted.check(
+			metrics.WastedBytes <= threshold,
+			fmt.Sprintf("wasted space %s exceeds the highest allowed %s", wasted.Actual, wasted.Threshold),
+		)
+	}
+	evaluations = append(evaluations, wasted)
+
+	userWasted := Evaluation{Rule: RuleHighestUserWastedPercent, Actual: formatRatio(metrics.UserWastedPercent)}
+	if rules.HighestUserWastedPercent == nil {
+		userWasted.skip()
+	} else {
+		userWasted.Threshold = formatRatio(*rules.HighestUserWastedPercent)
+		userWasted.check(
+			metrics.UserWastedPercent <= *rules.HighestUserWastedPercent,
+			fmt.Sprintf("wasted space is %s of the layers above the base, more than the highest allowed %s", userWasted.Actual, userWasted.Threshold),
+		)
+	}
+	evaluations = append(evaluations, userWasted)
+	return evaluations, nil
+}
+
+func (e *Evaluation) skip() {
+	e.Status = StatusSkipped
+	e.Message = "rule is not configured"
+}
+
+func (e *Evaluation) check(passed bool, failure string) {
+	if passed {
+		e.Status = StatusPassed
+		e.Message = fmt.Sprintf("%s meets the threshold of %s", e.Actual, e.Threshold)
+		return
+	}
+	e.Status = StatusFailed
+	e.Message = failure
+}
+
+var byteUnits = map[string]float64{
+	"":    1,
+	"b":   1,
+	"k":   1e3,
+	"kb":  1e3,
+	"m":   1e6,
+	"mb":  1e6,
+	"g":   1e9,
+	"gb":  1e9,
+	"t":   1e12,
+	"tb":  1e12,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+}
+
+// ParseBytes reads sizes such as "20MB" or "1.5 GiB". Like Dive, KB, MB and
+// GB are decimal units and KiB, MiB and GiB binary ones.
+func ParseBytes(value string) (int64, error) {
+	text := strings.TrimSpace(value)
+	split := strings.IndexFunc(text, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if split < 0 {
+		split = len(text)
+	}
+	number, err := strconv.ParseFloat(text[:split], 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	multiplier, ok := byteUnits[strings.ToLower(strings.TrimSpace(text[split:]))]
+	if !ok {
+		return 0, fmt.Errorf("invalid size unit in %q", value)
+	}
+	return int64(math.Round(number * multiplier)), nil
+}
+
+func formatRatio(value float64) string {
+	return strconv.FormatFloat(value*100, 'f', 2, 64) + "%"
+}
+
+func formatBytes(value int64) string {
+	return strconv.FormatInt(value, 10) + " bytes"
+}
@@ -0,0 +1,158 @@
+package compare
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"deep-dive/dive"
+	"deep-dive/history"
+)
+
+// cacheVersion is part of every cache key; bump it when Diff changes so old
+// files are ignored and eventually evicted.
+const cacheVersion = "2"
+
+const DefaultMaxCachedDiffs = 256
+
+// Cache keeps computed diffs on disk, keyed by the digests of the two
+// analysis results, so a comparison is only computed once for as long as
+// both results are unchanged.
+type Cache struct {
+	dir        string
+	maxEntries int
+	mu         sync.Mutex
+}
+
+// NewCache stores diffs in dir, keeping at most maxEntries of the most
+// recently written ones. An empty dir disables caching.
+func NewCache(dir string, maxEntries int) *Cache {
+	if maxEntries <= 0 {
+		maxEntries = DefaultMaxCachedDiffs
+	}
+	return &Cache{dir: dir, maxEntries: maxEntries}
+}
+
+// Compare returns the comparison of two entries, reading the diff from the
+// cache when possible. A nil Cache computes every comparison; failing to
+// write the cache is not an error.
+func (c *Cache) Compare(left history.Entry, right history.Entry) (Comparison, error) {
+	leftResult, err := dive.Parse(left.Result)
+	if err != nil {
+		return Comparison{}, fmt.Errorf("left entry: %w", err)
+	}
+	rightResult, err := dive.Parse(right.Result)
+	if err != nil {
+		return Comparison{}, fmt.Errorf("right entry: %w", err)
+	}
+
+	key := cacheKey(left, right)
+	if diff, ok := c.read(key); ok {
+		comparison := assemble(left.Metadata, right.Metadata, leftResult, rightResult, diff)
+		comparison.Cached = true
+		return comparison, nil
+	}
+	diff := DiffResults(leftResult, rightResult)
+	c.write(key, diff)
+	return assemble(left.Metadata, right.Metadata, leftResult, rightResult, diff), nil
+}
+
+func cacheKey(left history.Entry, right history.Entry) string {
+	hash := sha256.Sum256([]byte(strings.Join([]string{cacheVersion, resultDigest(left), resultDigest(right)}, "\n")))
+	return hex.EncodeToString(hash[:])
+}
+
+// resultDigest prefers the digest the store recorded and hashes the result
+// itself for entries stored before results were shared.
+func resultDigest(entry history.Entry) string {
+	if entry.Metadata.ResultDigest != "" {
+		return entry.Metadata.ResultDigest
+	}
+	hash := sha256.Sum256(entry.Result)
+	return "sha256:" + hex.EncodeToString(hash[:])
+}
+
+func (c *Cache) path(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
+
+func (c *Cache) read(key string) (Diff, bool) {
+	if c == nil || c.dir == "" {
+		return Diff{}, false
+	}
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return Diff{}, false
+	}
+	var diff Diff
+	if err := json.Unmarshal(data, &diff); err != nil {
+		return Diff{}, false
+	}
+	return diff, true
+}
+
+func (c *Cache) write(key string, diff Diff) {
+	if c == nil || c.dir == "" {
+		return
+	}
+	data, err := json.Marshal(diff)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return
+	}
+	tempFile, err := os.CreateTemp(c.dir, "diff-*.tmp")
+	if err != nil {
+		return
+	}
+	tempPath := tempFile.Name()
+	_, writeErr := tempFile.Write(data)
+	closeErr := tempFile.Close()
+	if writeErr != nil || closeErr != nil || os.Rename(tempPath, c.path(key)) != nil {
+		os.Remove(tempPath)
+		return
+	}
+	c.evictLocked()
+}
+
+// evictLocked removes the oldest cached diffs beyond maxEntries.
+func (c *Cache) evictLocked() {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	type cached struct {
+		path    string
+		modTime int64
+	}
+	var files []cached
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, cached{path: filepath.Join(c.dir, entry.Name()), modTime: info.ModTime().UnixNano()})
+	}
+	if len(files) <= c.maxEntries {
+		return
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime < files[j].modTime
+	})
+	for _, file := range files[:len(files)-c.maxEntries] {
+		os.Remove(file.path)
+	}
+}
@@ -0,0 +1,186 @@
+package compare
+
+import (
+	"strings"
+	"time"
+
+	"deep-dive/dive"
+	"deep-dive/filediff"
+	"deep-dive/history"
+)
+
+const (
+	MatchedByDigest  = "digest"
+	MatchedByCommand = "command"
+)
+
+type EntryRef struct {
+	ID          string    `json:"id"`
+	Image       string    `json:"image"`
+	CompletedAt time.Time `json:"completedAt"`
+}
+
+type ByteDelta struct {
+	Left  int64 `json:"left"`
+	Right int64 `json:"right"`
+	Delta int64 `json:"delta"`
+}
+
+type ScoreDelta struct {
+	Left  float64 `json:"left"`
+	Right float64 `json:"right"`
+	Delta float64 `json:"delta"`
+}
+
+type CountDelta struct {
+	Left  int `json:"left"`
+	Right int `json:"right"`
+	Delta int `json:"delta"`
+}
+
+// SummaryDelta compares the stored summaries. Deltas are right minus left;
+// EstimatedPullBytes is only set when both entries were measured.
+type SummaryDelta struct {
+	SizeBytes          ByteDelta  `json:"sizeBytes"`
+	InefficientBytes   ByteDelta  `json:"inefficientBytes"`
+	EfficiencyScore    ScoreDelta `json:"efficiencyScore"`
+	LayerCount         CountDelta `json:"layerCount"`
+	EstimatedPullBytes *ByteDelta `json:"estimatedPullBytes,omitempty"`
+}
+
+type LayerRef struct {
+	Index     int    `json:"index"`
+	DigestID  string `json:"digestId,omitempty"`
+	Command   string `json:"command,omitempty"`
+	SizeBytes int64  `json:"sizeBytes"`
+}
+
+type LayerMatch struct {
+	Left           LayerRef `json:"left"`
+	Right          LayerRef `json:"right"`
+	MatchedBy      string   `json:"matchedBy"`
+	SizeBytesDelta int64    `json:"sizeBytesDelta"`
+}
+
+type LayerChanges struct {
+	Matched []LayerMatch `json:"matched"`
+	Added   []LayerRef   `json:"added"`
+	Removed []LayerRef   `json:"removed"`
+}
+
+// Diff is the part of a comparison derived only from the two analysis
+// results, which is what the cache stores.
+type Diff struct {
+	Layers   LayerChanges    `json:"layers"`
+	Files    filediff.Result `json:"files"`
+	Warnings []string        `json:"warnings,omitempty"`
+}
+
+type Comparison struct {
+	Left    EntryRef     `json:"left"`
+	Right   EntryRef     `json:"right"`
+	Summary SummaryDelta `json:"summary"`
+	Diff
+	Cached bool `json:"cached"`
+}
+
+func assemble(left history.Metadata, right history.Metadata, leftResult dive.Result, rightResult dive.Result, diff Diff) Comparison {
+	return Comparison{
+		Left:    EntryRef{ID: left.ID, Image: left.Image, CompletedAt: left.CompletedAt},
+		Right:   EntryRef{ID: right.ID, Image: right.Image, CompletedAt: right.CompletedAt},
+		Summary: Summarize(left.Summary, right.Summary, len(leftResult.Layers), len(rightResult.Layers)),
+		Diff:    diff,
+	}
+}
+
+func Summarize(left history.Summary, right history.Summary, leftLayers int, rightLayers int) SummaryDelta {
+	summary := SummaryDelta{
+		SizeBytes:        ByteDelta{Left: left.SizeBytes, Right: right.SizeBytes, Delta: right.SizeBytes - left.SizeBytes},
+		InefficientBytes: ByteDelta{Left: left.InefficientBytes, Right: right.InefficientBytes, Delta: right.InefficientBytes - left.InefficientBytes},
+		EfficiencyScore:  ScoreDelta{Left: left.EfficiencyScore, Right: right.EfficiencyScore, Delta: right.EfficiencyScore - left.EfficiencyScore},
+		LayerCount:       CountDelta{Left: leftLayers, Right: rightLayers, Delta: rightLayers - leftLayers},
+	}
+	if left.EstimatedPullBytes > 0 && right.EstimatedPullBytes > 0 {
+		summary.EstimatedPullBytes = &ByteDelta{
+			Left:  left.EstimatedPullBytes,
+			Right: right.EstimatedPullBytes,
+			Delta: right.EstimatedPullBytes - left.EstimatedPullBytes,
+		}
+	}
+	return summary
+}
+
+func DiffResults(left dive.Result, right dive.Result) Diff {
+	diff := Diff{
+		Layers: MatchLayers(left.Layers, right.Layers),
+		Files:  filediff.Result{Changes: []filediff.Change{}, Directories: []filediff.Directory{}},
+	}
+	if !left.HasFileData() || !right.HasFileData() {
+		diff.Warnings = append(diff.Warnings, "File changes are unavailable because an analysis result has no per-layer file data.")
+		return diff
+	}
+	diff.Files = filediff.Diff(left.Aggregate(), right.Aggregate())
+	return diff
+}
+
+// MatchLayers pairs layers with the same digest first, then pairs the rest
+// by identical build command, each in image order. Whatever is left over was
+// removed from the left image or added in the right one.
+func MatchLayers(left []dive.Layer, right []dive.Layer) LayerChanges {
+	changes := LayerChanges{
+		Matched: []LayerMatch{},
+		Added:   []LayerRef{},
+		Removed: []LayerRef{},
+	}
+	leftUsed := make([]bool, len(left))
+	rightMatch := make([]int, len(right))
+	matchedBy := make([]string, len(right))
+	for i := range rightMatch {
+		rightMatch[i] = -1
+	}
+
+	pair := func(key func(dive.Layer) string, by string) {
+		available := make(map[string][]int)
+		for i, layer := range left {
+			if k := key(layer); k != "" && !leftUsed[i] {
+				available[k] = append(available[k], i)
+			}
+		}
+		for i, layer := range right {
+			k := key(layer)
+			if rightMatch[i] >= 0 || k == "" || len(available[k]) == 0 {
+				continue
+			}
+			rightMatch[i] = available[k][0]
+			matchedBy[i] = by
+			leftUsed[available[k][0]] = true
+			available[k] = available[k][1:]
+		}
+	}
+	pair(func(layer dive.Layer) string { return layer.DigestID }, MatchedByDigest)
+	pair(func(layer dive.Layer) string { return strings.TrimSpace(layer.Command) }, MatchedByCommand)
+
+	for i, layer := range right {
+		if rightMatch[i] < 0 {
+			changes.Added = append(changes.Added, newLayerRef(layer))
+			continue
+		}
+		leftLayer := left[rightMatch[i]]
+		changes.Matched = append(changes.Matched, LayerMatch{
+			Left:           newLayerRef(leftLayer),
+			Right:          newLayerRef(layer),
+			MatchedBy:      matchedBy[i],
+			SizeBytesDelta: layer.SizeBytes - leftLayer.SizeBytes,
+		})
+	}
+	for i, layer := range left {
+		if !leftUsed[i] {
+			changes.Removed = append(changes.Removed, newLayerRef(layer))
+		}
+	}
+	return changes
+}
+
+func newLayerRef(layer dive.Layer) LayerRef {
+	return LayerRef{Index: layer.Index, DigestID: layer.DigestID, Command: layer.Command, SizeBytes: layer.SizeBytes}
+}
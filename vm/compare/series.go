@@ -0,0 +1,283 @@
+package compare
+
+import (
+	"fmt"
+	"sort"
+
+	"deep-dive/dive"
+	"deep-dive/history"
+)
+
+const (
+	MinSeriesEntries = 2
+	MaxSeriesEntries = 20
+)
+
+// Metric names of the rows in Series.Metrics.
+const (
+	MetricSizeBytes          = "sizeBytes"
+	MetricInefficientBytes   = "inefficientBytes"
+	MetricEfficiencyScore    = "efficiencyScore"
+	MetricLayerCount         = "layerCount"
+	MetricEstimatedPullBytes = "estimatedPullBytes"
+	MetricUniqueBytes        = "uniqueBytes"
+)
+
+// MetricRow holds one metric for every entry, in request order. Best is the
+// index of the smallest value, or the largest for the efficiency score, and
+// -1 when every value is the same or the metric is missing for any entry.
+type MetricRow struct {
+	Metric string    `json:"metric"`
+	Values []float64 `json:"values"`
+	Best   int       `json:"best"`
+}
+
+type SharedLayer struct {
+	DigestID  string   `json:"digestId"`
+	Command   string   `json:"command,omitempty"`
+	SizeBytes int64    `json:"sizeBytes"`
+	EntryIDs  []string `json:"entryIds"`
+}
+
+type UniqueBytes struct {
+	EntryID string `json:"entryId"`
+	// Layers and SizeBytes count the layers no other entry in the series
+	// has. Layers without a digest always count as unique.
+	Layers    int   `json:"layers"`
+	SizeBytes int64 `json:"sizeBytes"`
+}
+
+// CommonFile is a path present in the final filesystem of every entry, with
+// its size in each, in request order. SameSize only compares sizes; results
+// carry no content hashes, so it does not mean the contents match.
+type CommonFile struct {
+	Path      string  `json:"path"`
+	SizeBytes []int64 `json:"sizeBytes"`
+	SameSize  bool    `json:"sameSize"`
+}
+
+type CommonFiles struct {
+	Count int `json:"count"`
+	// SizeBytes is the size of the common files in each entry.
+	SizeBytes []int64      `json:"sizeBytes"`
+	Files     []CommonFile `json:"files"`
+	Truncated bool         `json:"truncated,omitempty"`
+}
+
+type Series struct {
+	Entries []EntryRef  `json:"entries"`
+	Metrics []MetricRow `json:"metrics"`
+	// SharedBytes[i][j] is the size of the layers entries i and j have in
+	// common; the diagonal is each entry's total layer size.
+	SharedBytes  [][]int64     `json:"sharedBytes"`
+	SharedLayers []SharedLayer `json:"sharedLayers"`
+	UniqueBytes  []UniqueBytes `json:"uniqueBytes"`
+	CommonFiles  CommonFiles   `json:"commonFiles"`
+	Warnings     []string      `json:"warnings,omitempty"`
+}
+
+// CompareSeries compares several entries at once. Layers are matched by
+// digest only, since identical commands on different bases build different
+// content. fileLimit caps the listed common files, largest first; zero lists
+// all of them.
+func CompareSeries(entries []history.Entry, fileLimit int) (Series, error) {
+	if len(entries) < MinSeriesEntries || len(entries) > MaxSeriesEntries {
+		return Series{}, fmt.Errorf("compare between %d and %d entries", MinSeriesEntries, MaxSeriesEntries)
+	}
+	results := make([]dive.Result, len(entries))
+	for i, entry := range entries {
+		result, err := dive.Parse(entry.Result)
+		if err != nil {
+			return Series{}, fmt.Errorf("entry %s: %w", entry.Metadata.ID, err)
+		}
+		results[i] = result
+	}
+
+	series := Series{
+		Entries:      make([]EntryRef, len(entries)),
+		SharedBytes:  make([][]int64, len(entries)),
+		SharedLayers: []SharedLayer{},
+		UniqueBytes:  make([]UniqueBytes, len(entries)),
+	}
+	for i, entry := range entries {
+		series.Entries[i] = EntryRef{ID: entry.Metadata.ID, Image: entry.Metadata.Image, CompletedAt: entry.Metadata.CompletedAt}
+		series.SharedBytes[i] = make([]int64, len(entries))
+		series.UniqueBytes[i].EntryID = entry.Metadata.ID
+	}
+
+	// owners lists, per digest, the entries containing it once each.
+	type layerOwners struct {
+		layer   dive.Layer
+		entries []int
+	}
+	owners := make(map[string]*layerOwners)
+	var digests []string
+	for i, result := range results {
+		seen := make(map[string]bool)
+		for _, layer := range result.Layers {
+			if layer.DigestID == "" {
+				series.UniqueBytes[i].Layers++
+				series.UniqueBytes[i].SizeBytes += layer.SizeBytes
+				series.SharedBytes[i][i] += layer.SizeBytes
+				continue
+			}
+			if seen[layer.DigestID] {
+				continue
+			}
+			seen[layer.DigestID] = true
+			series.SharedBytes[i][i] += layer.SizeBytes
+			owner, ok := owners[layer.DigestID]
+			if !ok {
+				owner = &layerOwners{layer: layer}
+				owners[layer.DigestID] = owner
+				digests = append(digests, layer.DigestID)
+			}
+			owner.entries = append(owner.entries, i)
+		}
+	}
+	for _, digest := range digests {
+		owner := owners[digest]
+		if len(owner.entries) == 1 {
+			unique := &series.UniqueBytes[owner.entries[0]]
+			unique.Layers++
+			unique.SizeBytes += owner.layer.SizeBytes
+			continue
+		}
+		shared := SharedLayer{DigestID: digest, Command: owner.layer.Command, SizeBytes: owner.layer.SizeBytes}
+		for _, i := range owner.entries {
+			shared.EntryIDs = append(shared.EntryIDs, entries[i].Metadata.ID)
+			for _, j := range owner.entries {
+				if i != j {
+					series.SharedBytes[i][j] += owner.layer.SizeBytes
+				}
+			}
+		}
+		series.SharedLayers = append(series.SharedLayers, shared)
+	}
+	sort.SliceStable(series.SharedLayers, func(i, j int) bool {
+		if len(series.SharedLayers[i].EntryIDs) != len(series.SharedLayers[j].EntryIDs) {
+			return len(series.SharedLayers[i].EntryIDs) > len(series.SharedLayers[j].EntryIDs)
+		}
+		return series.SharedLayers[i].SizeBytes > series.SharedLayers[j].SizeBytes
+	})
+
+	series.Metrics = seriesMetrics(entries, results, series.UniqueBytes)
+
+	series.CommonFiles = CommonFiles{SizeBytes: make([]int64, len(entries)), Files: []CommonFile{}}
+	for _, result := range results {
+		if !result.HasFileData() {
+			series.Warnings = append(series.Warnings, "Common files are unavailable because an analysis result has no per-layer file data.")
+			return series, nil
+		}
+	}
+	series.CommonFiles = commonFiles(results, fileLimit)
+	return series, nil
+}
+
+func seriesMetrics(entries []history.Entry, results []dive.Result, unique []UniqueBytes) []MetricRow {
+	rows := []struct {
+		metric  string
+		value   func(i int) (float64, bool)
+		highest bool
+	}{
+		{MetricSizeBytes, func(i int) (float64, bool) { return float64(entries[i].Metadata.Summary.SizeBytes), true }, false},
+		{MetricInefficientBytes, func(i int) (float64, bool) { return float64(entries[i].Metadata.Summary.InefficientBytes), true }, false},
+		{MetricEfficiencyScore, func(i int) (float64, bool) { return entries[i].Metadata.Summary.EfficiencyScore, true }, true},
+		{MetricLayerCount, func(i int) (float64, bool) { return float64(len(results[i].Layers)), true }, false},
+		{MetricEstimatedPullBytes, func(i int) (float64, bool) {
+			pull := entries[i].Metadata.Summary.EstimatedPullBytes
+			return float64(pull), pull > 0
+		}, false},
+		{MetricUniqueBytes, func(i int) (float64, bool) { return float64(unique[i].SizeBytes), true }, false},
+	}
+
+	metrics := make([]MetricRow, 0, len(rows))
+	for _, row := range rows {
+		metric := MetricRow{Metric: row.metric, Values: make([]float64, len(entries)), Best: -1}
+		complete := true
+		for i := range entries {
+			value, ok := row.value(i)
+			metric.Values[i] = value
+			complete = complete && ok
+		}
+		if complete {
+			metric.Best = best(metric.Values, row.highest)
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics
+}
+
+func best(values []float64, highest bool) int {
+	index := 0
+	distinct := false
+	for i, value := range values {
+		if value != values[0] {
+			distinct = true
+		}
+		if highest && value > values[index] || !highest && value < values[index] {
+			index = i
+		}
+	}
+	if !distinct {
+		return -1
+	}
+	return index
+}
+
+func commonFiles(results []dive.Result, fileLimit int) CommonFiles {
+	common := CommonFiles{SizeBytes: make([]int64, len(results)), Files: []CommonFile{}}
+	sizes := make(map[string][]int64)
+	present := make(map[string]int)
+	for i, result := range results {
+		for _, file := range result.Aggregate() {
+			if file.IsDir {
+				continue
+			}
+			if i == 0 {
+				sizes[file.Path] = make([]int64, len(results))
+			}
+			values, ok := sizes[file.Path]
+			if !ok {
+				continue
+			}
+			values[i] = file.SizeBytes
+			present[file.Path]++
+		}
+	}
+
+	for path, values := range sizes {
+		if present[path] != len(results) {
+			continue
+		}
+		file := CommonFile{Path: path, SizeBytes: values, SameSize: true}
+		for i, value := range values {
+			common.SizeBytes[i] += value
+			if value != values[0] {
+				file.SameSize = false
+			}
+		}
+		common.Files = append(common.Files, file)
+	}
+	common.Count = len(common.Files)
+	sort.Slice(common.Files, func(i, j int) bool {
+		left, right := maxSize(common.Files[i].SizeBytes), maxSize(common.Files[j].SizeBytes)
+		if left != right {
+			return left > right
+		}
+		return common.Files[i].Path < common.Files[j].Path
+	})
+	if fileLimit > 0 && len(common.Files) > fileLimit {
+		common.Files = common.Files[:fileLimit]
+		common.Truncated = true
+	}
+	return common
+}
+
+func maxSize(values []int64) int64 {
+	var largest int64
+	for _, value := range values {
+		largest = max(largest, value)
+	}
+	return largest
+}
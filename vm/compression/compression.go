@@ -0,0 +1,255 @@
+package compression
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	DefaultGzipLevel = 6
+	DefaultZstdLevel = 3
+)
+
+const (
+	manifestFileName  = "manifest.json"
+	ociLayoutFileName = "oci-layout"
+	dockerAPIHost     = "docker"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+type Options struct {
+	GzipLevel int
+	ZstdLevel int
+}
+
+type LayerSize struct {
+	Index             int    `json:"index"`
+	Blob              string `json:"blob"`
+	StoredCompression string `json:"storedCompression"`
+	StoredBytes       int64  `json:"storedBytes"`
+	UncompressedBytes int64  `json:"uncompressedBytes"`
+	GzipBytes         int64  `json:"gzipBytes"`
+	ZstdBytes         int64  `json:"zstdBytes"`
+}
+
+type Report struct {
+	GzipLevel          int         `json:"gzipLevel"`
+	ZstdLevel          int         `json:"zstdLevel"`
+	UncompressedBytes  int64       `json:"uncompressedBytes"`
+	GzipBytes          int64       `json:"gzipBytes"`
+	ZstdBytes          int64       `json:"zstdBytes"`
+	EstimatedPullBytes int64       `json:"estimatedPullBytes"`
+	Layers             []LayerSize `json:"layers"`
+}
+
+func DefaultOptions() Options {
+	return Options{GzipLevel: DefaultGzipLevel, ZstdLevel: DefaultZstdLevel}
+}
+
+type archiveManifest struct {
+	Layers []string `json:"Layers"`
+}
+
+// MeasureArchive reads a `docker save` style tar stream and measures the
+// layer blobs listed in its manifest uncompressed and recompressed with gzip and zstd. Blobs that are
+// already compressed are decompressed first; their stored size is used as the
+// pull size estimate, otherwise the gzip size is.
+func MeasureArchive(reader io.Reader, options Options) (Report, error) {
+	zstdLevel := zstd.EncoderLevelFromZstd(options.ZstdLevel)
+	measured := make(map[string]LayerSize)
+	var manifests []archiveManifest
+	// layers is set once the manifest has been read.
+	var layers map[string]bool
+
+	archive := tar.NewReader(reader)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Report{}, fmt.Errorf("failed to read image archive: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean(header.Name)
+		if name == manifestFileName {
+			if err := json.NewDecoder(archive).Decode(&manifests); err != nil {
+				return Report{}, fmt.Errorf("failed to parse archive manifest: %w", err)
+			}
+			layers = make(map[string]bool)
+			for _, manifest := range manifests {
+				for _, layerName := range manifest.Layers {
+					layers[path.Clean(layerName)] = true
+				}
+			}
+			continue
+		}
+		if path.Ext(name) == ".json" || name == ociLayoutFileName {
+			continue
+		}
+		// docker save usually writes the manifest last, so blobs seen before
+		// it are only measured if they could be layers.
+		content := bufio.NewReader(archive)
+		if layers != nil && !layers[name] || layers == nil && isJSONBlob(content) {
+			continue
+		}
+		size, err := measureBlob(content, header.Size, options.GzipLevel, zstdLevel)
+		if err != nil {
+			return Report{}, fmt.Errorf("failed to measure %s: %w", name, err)
+		}
+		size.Blob = name
+		measured[name] = size
+	}
+
+	if len(manifests) == 0 {
+		return Report{}, fmt.Errorf("image archive has no %s", manifestFileName)
+	}
+
+	report := Report{
+		GzipLevel: options.GzipLevel,
+		ZstdLevel: options.ZstdLevel,
+		Layers:    make([]LayerSize, 0, len(manifests[0].Layers)),
+	}
+	for index, layerName := range manifests[0].Layers {
+		size, ok := measured[path.Clean(layerName)]
+		if !ok {
+			return Report{}, fmt.Errorf("image archive is missing layer %s", layerName)
+		}
+		size.Index = index
+		report.UncompressedBytes += size.UncompressedBytes
+		report.GzipBytes += size.GzipBytes
+		report.ZstdBytes += size.ZstdBytes
+		if size.StoredCompression == "none" {
+			report.EstimatedPullBytes += size.GzipBytes
+		} else {
+			report.EstimatedPullBytes += size.StoredBytes
+		}
+		report.Layers = append(report.Layers, size)
+	}
+	return report, nil
+}
+
+func measureBlob(reader io.Reader, storedBytes int64, gzipLevel int, zstdLevel zstd.EncoderLevel) (LayerSize, error) {
+	buffered := bufio.NewReader(reader)
+	magic, _ := buffered.Peek(len(zstdMagic))
+
+	size := LayerSize{StoredBytes: storedBytes, StoredCompression: "none"}
+	var content io.Reader = buffered
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		decompressed, err := gzip.NewReader(buffered)
+		if err != nil {
+			return LayerSize{}, err
+		}
+		defer decompressed.Close()
+		content = decompressed
+		size.StoredCompression = "gzip"
+	case bytes.HasPrefix(magic, zstdMagic):
+		decompressed, err := zstd.NewReader(buffered)
+		if err != nil {
+			return LayerSize{}, err
+		}
+		defer decompressed.Close()
+		content = decompressed
+		size.StoredCompression = "zstd"
+	}
+
+	var gzipCount, zstdCount countingWriter
+	gzipWriter, err := gzip.NewWriterLevel(&gzipCount, gzipLevel)
+	if err != nil {
+		return LayerSize{}, err
+	}
+	zstdWriter, err := zstd.NewWriter(&zstdCount, zstd.WithEncoderLevel(zstdLevel))
+	if err != nil {
+		return LayerSize{}, err
+	}
+
+	uncompressed, err := io.Copy(io.MultiWriter(gzipWriter, zstdWriter), content)
+	if err != nil {
+		zstdWriter.Close()
+		return LayerSize{}, err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return LayerSize{}, err
+	}
+	if err := zstdWriter.Close(); err != nil {
+		return LayerSize{}, err
+	}
+
+	size.UncompressedBytes = uncompressed
+	size.GzipBytes = int64(gzipCount)
+	size.ZstdBytes = int64(zstdCount)
+	return size, nil
+}
+
+// isJSONBlob reports whether a blob holds JSON, as image configs, OCI
+// manifests and indexes do, rather than a layer tarball.
+func isJSONBlob(reader *bufio.Reader) bool {
+	peeked, _ := reader.Peek(512)
+	trimmed := bytes.TrimLeft(peeked, " \t\r\n")
+	return len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[')
+}
+
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+func MeasureArchiveFile(archivePath string, options Options) (Report, error) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return Report{}, err
+	}
+	defer file.Close()
+	return MeasureArchive(file, options)
+}
+
+// MeasureDockerImage exports the image through the Docker Engine API on the
+// given socket and measures the resulting archive.
+func MeasureDockerImage(ctx context.Context, socketPath string, image string, options Options) (Report, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+
+	endpoint := fmt.Sprintf("http://%s/images/%s/get", dockerAPIHost, url.PathEscape(image))
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return Report{}, err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return Report{}, fmt.Errorf("failed to export image from Docker: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 4096))
+		return Report{}, fmt.Errorf("docker image export failed with status %d: %s", response.StatusCode, bytes.TrimSpace(message))
+	}
+	return MeasureArchive(response.Body, options)
+}
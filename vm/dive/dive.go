@@ -0,0 +1,281 @@
+package dive
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	opaqueWhiteout = ".wh..wh..opq"
+)
+
+var ErrNoFileData = errors.New("analysis result has no per-layer file data")
+
+type Result struct {
+	Layers []Layer
+	Image  Image
+}
+
+type Image struct {
+	SizeBytes        int64
+	InefficientBytes int64
+	EfficiencyScore  float64
+	FileReference    []FileReference
+}
+
+type FileReference struct {
+	Count     int64  `json:"count"`
+	SizeBytes int64  `json:"sizeBytes"`
+	File      string `json:"file"`
+}
+
+type Layer struct {
+	Index     int
+	ID        string
+	DigestID  string
+	SizeBytes int64
+	Command   string
+	Files     []File
+}
+
+type File struct {
+	Path      string
+	SizeBytes int64
+	IsDir     bool
+	TypeFlag  byte
+	LinkName  string
+	Mode      uint32
+	UID       int
+	GID       int
+}
+
+type resultPayload struct {
+	Layer []layerPayload `json:"layer"`
+	Image struct {
+		SizeBytes        int64           `json:"sizeBytes"`
+		InefficientBytes int64           `json:"inefficientBytes"`
+		EfficiencyScore  float64         `json:"efficiencyScore"`
+		FileReference    []FileReference `json:"fileReference"`
+	} `json:"image"`
+}
+
+type layerPayload struct {
+	Index     int           `json:"index"`
+	ID        string        `json:"id"`
+	DigestID  string        `json:"digestId"`
+	SizeBytes int64         `json:"sizeBytes"`
+	Command   string        `json:"command"`
+	FileList  []filePayload `json:"fileList"`
+}
+
+// filePayload accepts both the field names emitted by Dive's fileList export
+// and the normalized names the UI understands.
+type filePayload struct {
+	Path      string `json:"path"`
+	Name      string `json:"name"`
+	Size      *int64 `json:"size"`
+	SizeBytes *int64 `json:"sizeBytes"`
+	IsDir     bool   `json:"isDir"`
+	FileType  string `json:"fileType"`
+	TypeFlag  byte   `json:"typeFlag"`
+	LinkName  string `json:"linkName"`
+	FileMode  uint32 `json:"fileMode"`
+	UID       int    `json:"uid"`
+	GID       int    `json:"gid"`
+}
+
+func Parse(raw json.RawMessage) (Result, error) {
+	if len(raw) == 0 {
+		return Result{}, fmt.Errorf("analysis result is empty")
+	}
+
+	var payload resultPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		return Result{}, fmt.Errorf("failed to parse analysis result: %w", err)
+	}
+
+	result := Result{
+		Layers: make([]Layer, 0, len(payload.Layer)),
+		Image: Image{
+			SizeBytes:        payload.Image.SizeBytes,
+			InefficientBytes: payload.Image.InefficientBytes,
+			EfficiencyScore:  payload.Image.EfficiencyScore,
+			FileReference:    payload.Image.FileReference,
+		},
+	}
+	for _, layer := range payload.Layer {
+		files := make([]File, 0, len(layer.FileList))
+		for _, file := range layer.FileList {
+			normalized, ok := normalizeFile(file)
+			if !ok {
+				continue
+			}
+			files = append(files, normalized)
+		}
+		result.Layers = append(result.Layers, Layer{
+			Index:     layer.Index,
+			ID:        layer.ID,
+			DigestID:  layer.DigestID,
+			SizeBytes: layer.SizeBytes,
+			Command:   layer.Command,
+			Files:     files,
+		})
+	}
+	return result, nil
+}
+
+// HasFileData reports whether any layer carries a fileList.
+func (r Result) HasFileData() bool {
+	for _, layer := range r.Layers {
+		if len(layer.Files) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeFile(file filePayload) (File, bool) {
+	rawPath := file.Path
+	if rawPath == "" {
+		rawPath = file.Name
+	}
+	cleaned := CleanPath(rawPath)
+	if cleaned == "/" {
+		return File{}, false
+	}
+
+	var size int64
+	switch {
+	case file.Size != nil:
+		size = *file.Size
+	case file.SizeBytes != nil:
+		size = *file.SizeBytes
+	}
+
+	isDir := file.IsDir
+	switch strings.ToLower(strings.TrimSpace(file.FileType)) {
+	case "dir", "directory", "folder":
+		isDir = true
+	}
+
+	return File{
+		Path:      cleaned,
+		SizeBytes: size,
+		IsDir:     isDir,
+		TypeFlag:  file.TypeFlag,
+		LinkName:  file.LinkName,
+		Mode:      file.FileMode,
+		UID:       file.UID,
+		GID:       file.GID,
+	}, true
+}
+
+// CleanPath normalizes a layer path to an absolute, slash-separated form
+// without a trailing slash so it can be used as a stable map key.
+func CleanPath(value string) string {
+	return path.Clean("/" + strings.TrimSpace(value))
+}
+
+// IsWhiteout reports whether the file is an OCI whiteout marker.
+func (f File) IsWhiteout() bool {
+	return strings.HasPrefix(path.Base(f.Path), whiteoutPrefix)
+}
+
+// IsOpaqueWhiteout reports whether the file hides every lower entry in its directory.
+func (f File) IsOpaqueWhiteout() bool {
+	return path.Base(f.Path) == opaqueWhiteout
+}
+
+// WhiteoutTarget returns the path hidden by a whiteout marker. For opaque
+// whiteouts it returns the directory whose lower contents are hidden.
+func (f File) WhiteoutTarget() string {
+	dir := path.Dir(f.Path)
+	if f.IsOpaqueWhiteout() {
+		return dir
+	}
+	return path.Join(dir, strings.TrimPrefix(path.Base(f.Path), whiteoutPrefix))
+}
+
+// IsUnder reports whether candidate equals prefix or lives below it.
+func IsUnder(candidate string, prefix string) bool {
+	if prefix == "/" || candidate == prefix {
+		return true
+	}
+	return strings.HasPrefix(candidate, prefix+"/")
+}
+
+type AggregateFile struct {
+	File
+	LayerIndex int
+}
+
+// Aggregate returns the final filesystem produced by stacking every layer's
+// fileList: later layers win per path, whiteouts remove the lower paths they
+// hide, and a non-directory entry replaces anything below it.
+func (r Result) Aggregate() []AggregateFile {
+	byPath := make(map[string]AggregateFile)
+	for position, layer := range r.Layers {
+		hidden := make(map[string]bool)
+		opaque := make(map[string]bool)
+		for _, file := range layer.Files {
+			if file.IsOpaqueWhiteout() {
+				opaque[file.WhiteoutTarget()] = true
+			} else if file.IsWhiteout() {
+				hidden[file.WhiteoutTarget()] = true
+			}
+		}
+		if len(hidden) > 0 || len(opaque) > 0 {
+			for existing := range byPath {
+				if isHidden(existing, hidden, opaque) {
+					delete(byPath, existing)
+				}
+			}
+		}
+		for _, file := range layer.Files {
+			if file.IsWhiteout() {
+				continue
+			}
+			byPath[file.Path] = AggregateFile{File: file, LayerIndex: position}
+		}
+	}
+
+	files := make([]AggregateFile, 0, len(byPath))
+	for _, file := range byPath {
+		if hasNonDirectoryAncestor(file.Path, byPath) {
+			continue
+		}
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	return files
+}
+
+func hasNonDirectoryAncestor(candidate string, byPath map[string]AggregateFile) bool {
+	for current := path.Dir(candidate); current != "/"; current = path.Dir(current) {
+		if ancestor, ok := byPath[current]; ok && !ancestor.IsDir {
+			return true
+		}
+	}
+	return false
+}
+
+func isHidden(candidate string, hidden map[string]bool, opaque map[string]bool) bool {
+	if hidden[candidate] {
+		return true
+	}
+	for current := path.Dir(candidate); ; current = path.Dir(current) {
+		if hidden[current] || opaque[current] {
+			return true
+		}
+		if current == "/" {
+			return false
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package dockerfile
+
+import (
+	"regexp"
+	"strings"
+
+	"deep-dive/dive"
+)
+
+// Instruction is one logical Dockerfile instruction, with continuation
+// lines joined. Lines are 1-based.
+type Instruction struct {
+	Keyword   string
+	Arguments string
+	StartLine int
+	EndLine   int
+	Text      string
+}
+
+var keywords = map[string]bool{
+	"ADD": true, "ARG": true, "CMD": true, "COPY": true, "ENTRYPOINT": true,
+	"ENV": true, "EXPOSE": true, "FROM": true, "HEALTHCHECK": true, "LABEL": true,
+	"MAINTAINER": true, "ONBUILD": true, "RUN": true, "SHELL": true,
+	"STOPSIGNAL": true, "USER": true, "VOLUME": true, "WORKDIR": true,
+}
+
+// buildArgsPrefix matches the "|2 NAME=value NAME=value" prefix Docker puts
+// before RUN commands that see build arguments.
+var buildArgsPrefix = regexp.MustCompile(`^\|\d+(\s+\S+=\S*)*\s+`)
+
+// Parse splits a Dockerfile into instructions, skipping comments and blank
+// lines. Heredocs are not recognized.
+func Parse(content string) []Instruction {
+	var instructions []Instruction
+	var current *Instruction
+	var parts []string
+	for number, line := range strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if current == nil {
+			current = &Instruction{StartLine: number + 1}
+			parts = nil
+		}
+		current.EndLine = number + 1
+		continued := strings.HasSuffix(trimmed, "\\")
+		parts = append(parts, strings.TrimSpace(strings.TrimSuffix(trimmed, "\\")))
+		if continued {
+			continue
+		}
+		current.Text = strings.Join(strings.Fields(strings.Join(parts, " ")), " ")
+		keyword, arguments, _ := strings.Cut(current.Text, " ")
+		current.Keyword = strings.ToUpper(keyword)
+		current.Arguments = strings.TrimSpace(arguments)
+		if keywords[current.Keyword] {
+			instructions = append(instructions, *current)
+		}
+		current = nil
+	}
+	return instructions
+}
+
+// Locate maps layer positions to the instruction that built them. Layers
+// are matched newest first against the final stage, walking back through
+// its instructions, so base image layers and earlier stages stay unmatched.
+func Locate(instructions []Instruction, layers []dive.Layer) map[int]Instruction {
+	stage := 0
+	for i, instruction := range instructions {
+		if instruction.Keyword == "FROM" {
+			stage = i + 1
+		}
+	}
+	located := make(map[int]Instruction)
+	next := len(instructions) - 1
+	for position := len(layers) - 1; position >= 0 && next >= stage; position-- {
+		keyword, arguments := Normalize(layers[position].Command)
+		if keyword == "" {
+			continue
+		}
+		for candidate := next; candidate >= stage; candidate-- {
+			if matches(instructions[candidate], keyword, arguments) {
+				located[position] = instructions[candidate]
+				next = candidate - 1
+				break
+			}
+		}
+	}
+	return located
+}
+
+// Normalize turns a layer command from the image history into an
+// instruction keyword and arguments. Commands without a recognizable
+// keyword are shell commands, so RUN is assumed.
+func Normalize(command string) (string, string) {
+	text := strings.Join(strings.Fields(command), " ")
+	text = strings.TrimSuffix(text, " # buildkit")
+	if text == "" {
+		return "", ""
+	}
+	keyword, rest, _ := strings.Cut(text, " ")
+	if strings.ToUpper(keyword) == "RUN" {
+		text = rest
+	}
+	text = buildArgsPrefix.ReplaceAllString(text, "")
+	text = strings.TrimPrefix(text, "/bin/sh -c ")
+	if nop, ok := strings.CutPrefix(text, "#(nop) "); ok {
+		text = strings.TrimSpace(nop)
+	} else if strings.ToUpper(keyword) == "RUN" {
+		return "RUN", text
+	}
+	keyword, rest, _ = strings.Cut(text, " ")
+	if keywords[strings.ToUpper(keyword)] {
+		return strings.ToUpper(keyword), strings.TrimSpace(rest)
+	}
+	return "RUN", text
+}
+
+func matches(instruction Instruction, keyword string, arguments string) bool {
+	if instruction.Keyword != keyword {
+		return false
+	}
+	switch keyword {
+	case "RUN":
+		return stripRunFlags(instruction.Arguments) == arguments
+	case "COPY", "ADD":
+		// The history records content hashes instead of sources, so only
+		// the destination can be compared.
+		return destination(instruction.Arguments) == destination(arguments)
+	default:
+		return instruction.Arguments == arguments
+	}
+}
+
+// stripRunFlags drops BuildKit flags such as --mount, which the history
+// omits.
+func stripRunFlags(arguments string) string {
+	fields := strings.Fields(arguments)
+	for len(fields) > 0 && strings.HasPrefix(fields[0], "--") {
+		fields = fields[1:]
+	}
+	return strings.Join(fields, " ")
+}
+
+func destination(arguments string) string {
+	fields := strings.Fields(arguments)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(strings.Trim(fields[len(fields)-1], `"[],`), "/")
+}
@@ -0,0 +1,286 @@
+package exports
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"strconv"
+
+	"deep-dive/compare"
+	"deep-dive/filediff"
+)
+
+func FileDiffFilename(leftID string, rightID string, format Format) string {
+	return fmt.Sprintf("dive-diff-%s-%s.%s", leftID, rightID, format)
+}
+
+// FileDiffCSV writes directory roll-ups followed by file changes, each
+// largest change first. Directory rows carry change counts; file rows the
+// kind of change.
+func FileDiffCSV(comparison compare.Comparison) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	header := []string{"kind", "path", "change", "leftSizeBytes", "rightSizeBytes", "deltaBytes", "added", "removed", "grown", "shrunk"}
+	if err := writer.Write(header); err != nil {
+		return nil, err
+	}
+	for _, directory := range comparison.Files.Directories {
+		record := []string{
+			"directory",
+			directory.Path,
+			"",
+			strconv.FormatInt(directory.LeftSizeBytes, 10),
+			strconv.FormatInt(directory.RightSizeBytes, 10),
+			strconv.FormatInt(directory.DeltaBytes, 10),
+			strconv.Itoa(directory.Added),
+			strconv.Itoa(directory.Removed),
+			strconv.Itoa(directory.Grown),
+			strconv.Itoa(directory.Shrunk),
+		}
+		if err := writer.Write(record); err != nil {
+			return nil, err
+		}
+	}
+	for _, change := range comparison.Files.Changes {
+		record := []string{
+			"file",
+			change.Path,
+			change.Change,
+			strconv.FormatInt(change.LeftSizeBytes, 10),
+			strconv.FormatInt(change.RightSizeBytes, 10),
+			strconv.FormatInt(change.DeltaBytes, 10),
+			"", "", "", "",
+		}
+		if err := writer.Write(record); err != nil {
+			return nil, err
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func FileDiffHTML(comparison compare.Comparison) ([]byte, error) {
+	type htmlData struct {
+		Left        compare.EntryRef
+		Right       compare.EntryRef
+		LeftTime    string
+		RightTime   string
+		Totals      filediff.Totals
+		Directories []filediff.Directory
+		Changes     []filediff.Change
+		Truncated   bool
+		Warnings    []string
+	}
+	data := htmlData{
+		Left:        comparison.Left,
+		Right:       comparison.Right,
+		LeftTime:    comparison.Left.CompletedAt.Format(timeLayout),
+		RightTime:   comparison.Right.CompletedAt.Format(timeLayout),
+		Totals:      comparison.Files.Totals,
+		Directories: comparison.Files.Directories,
+		Changes:     comparison.Files.Changes,
+		Truncated:   comparison.Files.Truncated,
+		Warnings:    comparison.Warnings,
+	}
+
+	const templateBody = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8" />
+  <title>Dive File Diff</title>
+  <style>
+    body { font-family: Arial, sans-serif; margin: 24px; color: #1f2933; }
+    h1 { font-size: 22px; margin-bottom: 4px; }
+    .meta { color: #52606d; margin-bottom: 16px; }
+    table { border-collapse: collapse; width: 100%; margin-top: 12px; }
+    th, td { text-align: left; padding: 8px; border-bottom: 1px solid #e4e7eb; }
+    th { background: #f5f7fa; }
+    .added, .grown { color: #b42318; }
+    .removed, .shrunk { color: #027a48; }
+  </style>
+</head>
+<body>
+  <h1>Dive File Diff</h1>
+  <div class="meta">Left: {{ .Left.Image }} ({{ .Left.ID }}) • Completed: {{ .LeftTime }}</div>
+  <div class="meta">Right: {{ .Right.Image }} ({{ .Right.ID }}) • Completed: {{ .RightTime }}</div>
+  {{ range .Warnings }}<div class="meta">{{ . }}</div>{{ end }}
+  {{ if .Truncated }}<div class="meta">Only the largest changes are listed; the totals cover all of them.</div>{{ end }}
+  <table>
+    <tr><th>Change</th><th>Files</th><th>Bytes</th></tr>
+    <tr><td>Added</td><td>{{ .Totals.Added }}</td><td>{{ .Totals.AddedBytes }}</td></tr>
+    <tr><td>Removed</td><td>{{ .Totals.Removed }}</td><td>{{ .Totals.RemovedBytes }}</td></tr>
+    <tr><td>Grown</td><td>{{ .Totals.Grown }}</td><td>{{ .Totals.GrownBytes }}</td></tr>
+    <tr><td>Shrunk</td><td>{{ .Totals.Shrunk }}</td><td>{{ .Totals.ShrunkBytes }}</td></tr>
+    <tr><td><strong>Net change</strong></td><td></td><td><strong>{{ .Totals.DeltaBytes }}</strong></td></tr>
+  </table>
+  {{ if .Directories }}
+  <h2>Directories</h2>
+  <table>
+    <tr><th>Directory</th><th>Left (bytes)</th><th>Right (bytes)</th><th>Delta (bytes)</th><th>Added</th><th>Removed</th><th>Grown</th><th>Shrunk</th></tr>
+    {{ range .Directories }}
+    <tr><td>{{ .Path }}</td><td>{{ .LeftSizeBytes }}</td><td>{{ .RightSizeBytes }}</td><td>{{ .DeltaBytes }}</td><td>{{ .Added }}</td><td>{{ .Removed }}</td><td>{{ .Grown }}</td><td>{{ .Shrunk }}</td></tr>
+    {{ end }}
+  </table>
+  {{ end }}
+  {{ if .Changes }}
+  <h2>Files</h2>
+  <table>
+    <tr><th>Path</th><th>Change</th><th>Left (bytes)</th><th>Right (bytes)</th><th>Delta (bytes)</th></tr>
+    {{ range .Changes }}
+    <tr><td>{{ .Path }}</td><td class="{{ .Change }}">{{ .Change }}</td><td>{{ .LeftSizeBytes }}</td><td>{{ .RightSizeBytes }}</td><td>{{ .DeltaBytes }}</td></tr>
+    {{ end }}
+  </table>
+  {{ end }}
+</body>
+</html>`
+
+	tmpl, err := template.New("diff").Parse(templateBody)
+	if err != nil {
+		return nil, err
+	}
+
+	var buffer bytes.Buffer
+	if err := tmpl.Execute(&buffer, data); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// SeriesHTML renders an N-way comparison as a standalone report, with the
+// best value of each metric highlighted.
+func SeriesHTML(series compare.Series) ([]byte, error) {
+	type cell struct {
+		Value string
+		Best  bool
+	}
+	type row struct {
+		Label string
+		Cells []cell
+	}
+	type htmlData struct {
+		Entries      []compare.EntryRef
+		Metrics      []row
+		SharedBytes  []row
+		SharedLayers []compare.SharedLayer
+		UniqueBytes  []compare.UniqueBytes
+		CommonFiles  compare.CommonFiles
+		Warnings     []string
+	}
+
+	labels := map[string]string{
+		compare.MetricSizeBytes:          "Total size (bytes)",
+		compare.MetricInefficientBytes:   "Wasted bytes",
+		compare.MetricEfficiencyScore:    "Efficiency score",
+		compare.MetricLayerCount:         "Layers",
+		compare.MetricEstimatedPullBytes: "Estimated pull size (bytes)",
+		compare.MetricUniqueBytes:        "Unique layer bytes",
+	}
+	data := htmlData{
+		Entries:      series.Entries,
+		SharedLayers: series.SharedLayers,
+		UniqueBytes:  series.UniqueBytes,
+		CommonFiles:  series.CommonFiles,
+		Warnings:     series.Warnings,
+	}
+	for _, metric := range series.Metrics {
+		label, ok := labels[metric.Metric]
+		if !ok {
+			label = metric.Metric
+		}
+		current := row{Label: label}
+		for i, value := range metric.Values {
+			formatted := strconv.FormatInt(int64(value), 10)
+			if metric.Metric == compare.MetricEfficiencyScore {
+				formatted = fmt.Sprintf("%.4f", value)
+			}
+			current.Cells = append(current.Cells, cell{Value: formatted, Best: i == metric.Best})
+		}
+		data.Metrics = append(data.Metrics, current)
+	}
+	for i, values := range series.SharedBytes {
+		current := row{Label: series.Entries[i].Image}
+		for _, value := range values {
+			current.Cells = append(current.Cells, cell{Value: strconv.FormatInt(value, 10)})
+		}
+		data.SharedBytes = append(data.SharedBytes, current)
+	}
+
+	const templateBody = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8" />
+  <title>Dive Image Comparison</title>
+  <style>
+    body { font-family: Arial, sans-serif; margin: 24px; color: #1f2933; }
+    h1 { font-size: 22px; margin-bottom: 4px; }
+    .meta { color: #52606d; margin-bottom: 16px; }
+    table { border-collapse: collapse; width: 100%; margin-top: 12px; }
+    th, td { text-align: left; padding: 8px; border-bottom: 1px solid #e4e7eb; }
+    th { background: #f5f7fa; }
+    .best { background: #ecfdf3; font-weight: bold; }
+  </style>
+</head>
+<body>
+  <h1>Dive Image Comparison</h1>
+  <div class="meta">{{ len .Entries }} images compared</div>
+  {{ range .Warnings }}<div class="meta">{{ . }}</div>{{ end }}
+  <h2>Metrics</h2>
+  <table>
+    <tr><th>Metric</th>{{ range .Entries }}<th>{{ .Image }}<br /><small>{{ .ID }}</small></th>{{ end }}</tr>
+    {{ range .Metrics }}
+    <tr><td>{{ .Label }}</td>{{ range .Cells }}<td{{ if .Best }} class="best"{{ end }}>{{ .Value }}</td>{{ end }}</tr>
+    {{ end }}
+  </table>
+  <h2>Shared layer bytes</h2>
+  <table>
+    <tr><th></th>{{ range .Entries }}<th>{{ .Image }}</th>{{ end }}</tr>
+    {{ range .SharedBytes }}
+    <tr><td>{{ .Label }}</td>{{ range .Cells }}<td>{{ .Value }}</td>{{ end }}</tr>
+    {{ end }}
+  </table>
+  <h2>Unique bytes</h2>
+  <table>
+    <tr><th>Entry</th><th>Unique layers</th><th>Unique bytes</th></tr>
+    {{ range .UniqueBytes }}
+    <tr><td>{{ .EntryID }}</td><td>{{ .Layers }}</td><td>{{ .SizeBytes }}</td></tr>
+    {{ end }}
+  </table>
+  {{ if .SharedLayers }}
+  <h2>Shared layers</h2>
+  <table>
+    <tr><th>Digest</th><th>Command</th><th>Size (bytes)</th><th>Entries</th></tr>
+    {{ range .SharedLayers }}
+    <tr><td>{{ .DigestID }}</td><td>{{ .Command }}</td><td>{{ .SizeBytes }}</td><td>{{ range .EntryIDs }}{{ . }}<br />{{ end }}</td></tr>
+    {{ end }}
+  </table>
+  {{ end }}
+  {{ with .CommonFiles }}
+  <h2>Common files</h2>
+  <div class="meta">{{ .Count }} files are present in every image{{ if .Truncated }}; only the largest are listed{{ end }}.</div>
+  {{ if .Files }}
+  <table>
+    <tr><th>Path</th>{{ range $.Entries }}<th>{{ .Image }} (bytes)</th>{{ end }}<th>Same size</th></tr>
+    {{ range .Files }}
+    <tr><td>{{ .Path }}</td>{{ range .SizeBytes }}<td>{{ . }}</td>{{ end }}<td>{{ if .SameSize }}yes{{ else }}no{{ end }}</td></tr>
+    {{ end }}
+  </table>
+  {{ end }}
+  {{ end }}
+</body>
+</html>`
+
+	tmpl, err := template.New("series").Parse(templateBody)
+	if err != nil {
+		return nil, err
+	}
+
+	var buffer bytes.Buffer
+	if err := tmpl.Execute(&buffer, data); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
@@ -7,17 +7,27 @@ import (
 	"fmt"
 	"html/template"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"deep-dive/audit"
+	"deep-dive/breakdown"
+	"deep-dive/compression"
+	"deep-dive/dive"
 	"deep-dive/history"
+	"deep-dive/recommendations"
 )
 
 type Format string
 
 const (
-	FormatJSON Format = "json"
-	FormatCSV  Format = "csv"
-	FormatHTML Format = "html"
+	FormatJSON     Format = "json"
+	FormatCSV      Format = "csv"
+	FormatHTML     Format = "html"
+	FormatMarkdown Format = "markdown"
+	FormatSARIF    Format = "sarif"
+	FormatJUnit    Format = "junit"
 )
 
 type ExportedFile struct {
@@ -35,13 +45,49 @@ func ParseFormat(value string) (Format, error) {
 		return FormatCSV, nil
 	case string(FormatHTML):
 		return FormatHTML, nil
+	case string(FormatMarkdown), "md":
+		return FormatMarkdown, nil
+	case string(FormatSARIF):
+		return FormatSARIF, nil
+	case string(FormatJUnit):
+		return FormatJUnit, nil
 	default:
 		return "", fmt.Errorf("unsupported export format: %s", value)
 	}
 }
 
 func Filename(id string, format Format) string {
-	return fmt.Sprintf("dive-export-%s.%s", id, format)
+	extension := string(format)
+	switch format {
+	case FormatMarkdown:
+		extension = "md"
+	case FormatJUnit:
+		extension = "junit.xml"
+	}
+	return fmt.Sprintf("dive-export-%s.%s", id, extension)
+}
+
+// ComparisonFilename names a markdown export of id that includes a delta
+// against targetID, so it is stored next to the plain export rather than
+// over it.
+func ComparisonFilename(id string, targetID string) string {
+	return fmt.Sprintf("dive-export-%s-vs-%s.md", id, targetID)
+}
+
+// RenameFilename returns the name an export of oldID would have for newID.
+// Names that are not export filenames of oldID are returned unchanged.
+func RenameFilename(filename string, oldID string, newID string) string {
+	for _, format := range []Format{FormatJSON, FormatCSV, FormatHTML, FormatMarkdown, FormatSARIF, FormatJUnit} {
+		if filename == Filename(oldID, format) {
+			return Filename(newID, format)
+		}
+	}
+	if targetID, ok := strings.CutPrefix(filename, fmt.Sprintf("dive-export-%s-vs-", oldID)); ok {
+		if targetID, ok := strings.CutSuffix(targetID, ".md"); ok && targetID != "" {
+			return ComparisonFilename(newID, targetID)
+		}
+	}
+	return filename
 }
 
 func ContentType(format Format) string {
@@ -50,12 +96,22 @@ func ContentType(format Format) string {
 		return "text/csv"
 	case FormatHTML:
 		return "text/html"
+	case FormatMarkdown:
+		return "text/markdown"
+	case FormatSARIF:
+		return "application/sarif+json"
+	case FormatJUnit:
+		return "application/xml"
 	default:
 		return "application/json"
 	}
 }
 
 func Generate(format Format, entry history.Entry) (ExportedFile, error) {
+	return GenerateWithOptions(format, entry, Options{})
+}
+
+func GenerateWithOptions(format Format, entry history.Entry, options Options) (ExportedFile, error) {
 	switch format {
 	case FormatJSON:
 		return ExportedFile{
@@ -86,6 +142,43 @@ func Generate(format Format, entry history.Entry) (ExportedFile, error) {
 			ContentType: ContentType(format),
 			Data:        data,
 		}, nil
+	case FormatMarkdown:
+		data, err := generateMarkdown(entry, options)
+		if err != nil {
+			return ExportedFile{}, err
+		}
+		filename := Filename(entry.Metadata.ID, format)
+		if options.Comparison != nil {
+			filename = ComparisonFilename(entry.Metadata.ID, options.Comparison.Left.ID)
+		}
+		return ExportedFile{
+			Format:      format,
+			Filename:    filename,
+			ContentType: ContentType(format),
+			Data:        data,
+		}, nil
+	case FormatSARIF:
+		data, err := generateSARIF(entry, options)
+		if err != nil {
+			return ExportedFile{}, err
+		}
+		return ExportedFile{
+			Format:      format,
+			Filename:    Filename(entry.Metadata.ID, format),
+			ContentType: ContentType(format),
+			Data:        data,
+		}, nil
+	case FormatJUnit:
+		data, err := generateJUnit(entry, options)
+		if err != nil {
+			return ExportedFile{}, err
+		}
+		return ExportedFile{
+			Format:      format,
+			Filename:    Filename(entry.Metadata.ID, format),
+			ContentType: ContentType(format),
+			Data:        data,
+		}, nil
 	default:
 		return ExportedFile{}, fmt.Errorf("unsupported export format: %s", format)
 	}
@@ -127,12 +220,85 @@ func generateCSV(entry history.Entry) ([]byte, error) {
 	if err := writer.Write([]string{"summary", "efficiency_score", "", "", fmt.Sprintf("%.4f", payload.Image.EfficiencyScore)}); err != nil {
 		return nil, err
 	}
+	if metadata := entry.Metadata; metadata.Pinned || metadata.Notes != "" || len(metadata.Labels) > 0 {
+		records := [][]string{
+			{"annotation", "pinned", "", "", strconv.FormatBool(metadata.Pinned)},
+			{"annotation", "labels", "", fmt.Sprintf("%d", len(metadata.Labels)), strings.Join(metadata.Labels, ";")},
+			{"annotation", "notes", "", "", metadata.Notes},
+		}
+		for _, record := range records {
+			if err := writer.Write(record); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if delta := entry.Metadata.BaselineDelta; delta != nil {
+		records := [][]string{
+			{"baseline_delta", "baseline", "", "", fmt.Sprintf("%s (%s)", delta.BaselineImage, delta.BaselineID)},
+			{"baseline_delta", "total_size_bytes", fmt.Sprintf("%d", delta.SizeBytes), "", ""},
+			{"baseline_delta", "wasted_bytes", fmt.Sprintf("%d", delta.InefficientBytes), "", ""},
+			{"baseline_delta", "efficiency_score", "", "", fmt.Sprintf("%.4f", delta.EfficiencyScore)},
+		}
+		if delta.LayerCount != nil {
+			records = append(records, []string{"baseline_delta", "layer_count", "", fmt.Sprintf("%d", *delta.LayerCount), ""})
+		}
+		if delta.EstimatedPullBytes != nil {
+			records = append(records, []string{"baseline_delta", "estimated_pull_bytes", fmt.Sprintf("%d", *delta.EstimatedPullBytes), "", ""})
+		}
+		for _, record := range records {
+			if err := writer.Write(record); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if report := entry.Compression; report != nil {
+		records := [][]string{
+			{"summary", "estimated_pull_bytes", fmt.Sprintf("%d", report.EstimatedPullBytes), "", ""},
+			{"summary", "gzip_size_bytes", fmt.Sprintf("%d", report.GzipBytes), "", fmt.Sprintf("level=%d", report.GzipLevel)},
+			{"summary", "zstd_size_bytes", fmt.Sprintf("%d", report.ZstdBytes), "", fmt.Sprintf("level=%d", report.ZstdLevel)},
+		}
+		for _, layer := range report.Layers {
+			value := fmt.Sprintf("stored=%d(%s) gzip=%d zstd=%d", layer.StoredBytes, layer.StoredCompression, layer.GzipBytes, layer.ZstdBytes)
+			records = append(records, []string{"layer_compression", fmt.Sprintf("layer %d", layer.Index), fmt.Sprintf("%d", layer.UncompressedBytes), "", value})
+		}
+		for _, record := range records {
+			if err := writer.Write(record); err != nil {
+				return nil, err
+			}
+		}
+	}
 	for _, file := range topFiles {
 		record := []string{"file", file.File, fmt.Sprintf("%d", file.SizeBytes), fmt.Sprintf("%d", file.Count), ""}
 		if err := writer.Write(record); err != nil {
 			return nil, err
 		}
 	}
+	if contents, ok := entryBreakdown(entry); ok {
+		sections := []struct {
+			category string
+			buckets  []breakdown.Bucket
+		}{
+			{"ecosystem", contents.Ecosystems},
+			{"file_type", contents.FileTypes},
+			{"directory", contents.TopLevelDirectories},
+		}
+		for _, section := range sections {
+			for _, bucket := range section.buckets {
+				record := []string{section.category, bucket.Name, fmt.Sprintf("%d", bucket.SizeBytes), fmt.Sprintf("%d", bucket.FileCount), fmt.Sprintf("%.2f", bucket.Percent)}
+				if err := writer.Write(record); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if report, ok := entryAudit(entry); ok {
+		for _, finding := range report.Findings {
+			value := fmt.Sprintf("%s/%s mode=%s uid=%d gid=%d layer=%d final=%t", finding.Kind, finding.Severity, finding.Mode, finding.UID, finding.GID, finding.LayerIndex, finding.InFinalImage)
+			if err := writer.Write([]string{"finding", finding.Path, "", "", value}); err != nil {
+				return nil, err
+			}
+		}
+	}
 	writer.Flush()
 	if err := writer.Error(); err != nil {
 		return nil, err
@@ -146,22 +312,59 @@ func generateHTML(entry history.Entry) ([]byte, error) {
 		return nil, fmt.Errorf("failed to parse analysis result: %w", err)
 	}
 
+	result, err := dive.Parse(entry.Result)
+	if err != nil {
+		return nil, err
+	}
+
 	type htmlData struct {
-		ImageName   string
-		CompletedAt string
-		SizeBytes   int64
-		WastedBytes int64
-		Efficiency  float64
-		TopFiles    []diveFileReference
+		ImageName       string
+		CompletedAt     string
+		Pinned          bool
+		Labels          []string
+		Notes           string
+		Baseline        bool
+		BaselineDelta   *history.BaselineDelta
+		BaselineRows    [][2]string
+		SizeBytes       int64
+		WastedBytes     int64
+		Efficiency      float64
+		TopFiles        []diveFileReference
+		Recommendations []recommendations.Recommendation
+		Findings        []audit.Finding
+		Compression     *compression.Report
 	}
 
 	data := htmlData{
-		ImageName:   entry.Metadata.Image,
-		CompletedAt: entry.Metadata.CompletedAt.Format(timeLayout),
-		SizeBytes:   payload.Image.SizeBytes,
-		WastedBytes: payload.Image.InefficientBytes,
-		Efficiency:  payload.Image.EfficiencyScore,
-		TopFiles:    topFileReferences(payload.Image.FileReference, 10),
+		ImageName:       entry.Metadata.Image,
+		CompletedAt:     entry.Metadata.CompletedAt.Format(timeLayout),
+		Pinned:          entry.Metadata.Pinned,
+		Labels:          entry.Metadata.Labels,
+		Notes:           entry.Metadata.Notes,
+		Baseline:        entry.Metadata.Baseline,
+		BaselineDelta:   entry.Metadata.BaselineDelta,
+		SizeBytes:       payload.Image.SizeBytes,
+		WastedBytes:     payload.Image.InefficientBytes,
+		Efficiency:      payload.Image.EfficiencyScore,
+		TopFiles:        topFileReferences(payload.Image.FileReference, 10),
+		Recommendations: recommendations.Generate(result),
+		Compression:     entry.Compression,
+	}
+	if report, ok := entryAudit(entry); ok {
+		data.Findings = report.Findings
+	}
+	if delta := entry.Metadata.BaselineDelta; delta != nil {
+		data.BaselineRows = [][2]string{
+			{"Total size (bytes)", fmt.Sprintf("%+d", delta.SizeBytes)},
+			{"Wasted bytes", fmt.Sprintf("%+d", delta.InefficientBytes)},
+			{"Efficiency score", fmt.Sprintf("%+.4f", delta.EfficiencyScore)},
+		}
+		if delta.LayerCount != nil {
+			data.BaselineRows = append(data.BaselineRows, [2]string{"Layers", fmt.Sprintf("%+d", *delta.LayerCount)})
+		}
+		if delta.EstimatedPullBytes != nil {
+			data.BaselineRows = append(data.BaselineRows, [2]string{"Estimated pull size (bytes)", fmt.Sprintf("%+d", *delta.EstimatedPullBytes)})
+		}
 	}
 
 	const templateBody = `<!DOCTYPE html>
@@ -176,17 +379,36 @@ func generateHTML(entry history.Entry) ([]byte, error) {
     table { border-collapse: collapse; width: 100%; margin-top: 12px; }
     th, td { text-align: left; padding: 8px; border-bottom: 1px solid #e4e7eb; }
     th { background: #f5f7fa; }
+    .label { display: inline-block; background: #e4e7eb; border-radius: 4px; padding: 2px 6px; margin-right: 4px; font-size: 12px; }
+    .notes { white-space: pre-wrap; background: #f5f7fa; padding: 8px; border-radius: 4px; }
   </style>
 </head>
 <body>
   <h1>Dive Analysis Summary</h1>
-  <div class="meta">Image: {{ .ImageName }} • Completed: {{ .CompletedAt }}</div>
+  <div class="meta">Image: {{ .ImageName }} • Completed: {{ .CompletedAt }}{{ if .Pinned }} • Pinned{{ end }}{{ if .Baseline }} • Baseline{{ end }}</div>
+  {{ if .Labels }}<div class="meta">{{ range .Labels }}<span class="label">{{ . }}</span>{{ end }}</div>{{ end }}
+  {{ if .Notes }}<div class="notes">{{ .Notes }}</div>{{ end }}
   <table>
     <tr><th>Metric</th><th>Value</th></tr>
     <tr><td>Total size (bytes)</td><td>{{ .SizeBytes }}</td></tr>
     <tr><td>Wasted bytes</td><td>{{ .WastedBytes }}</td></tr>
     <tr><td>Efficiency score</td><td>{{ printf "%.4f" .Efficiency }}</td></tr>
+    {{ with .Compression }}
+    <tr><td>Estimated pull size (bytes)</td><td>{{ .EstimatedPullBytes }}</td></tr>
+    <tr><td>gzip size (bytes, level {{ .GzipLevel }})</td><td>{{ .GzipBytes }}</td></tr>
+    <tr><td>zstd size (bytes, level {{ .ZstdLevel }})</td><td>{{ .ZstdBytes }}</td></tr>
+    {{ end }}
   </table>
+  {{ with .BaselineDelta }}
+  <h2>Compared with baseline</h2>
+  <div class="meta">Baseline: {{ .BaselineImage }} ({{ .BaselineID }})</div>
+  <table>
+    <tr><th>Metric</th><th>Change</th></tr>
+    {{ range $.BaselineRows }}
+    <tr><td>{{ index . 0 }}</td><td>{{ index . 1 }}</td></tr>
+    {{ end }}
+  </table>
+  {{ end }}
   <h2>Largest files</h2>
   <table>
     <tr><th>File</th><th>Size (bytes)</th><th>Count</th></tr>
@@ -194,6 +416,37 @@ func generateHTML(entry history.Entry) ([]byte, error) {
     <tr><td>{{ .File }}</td><td>{{ .SizeBytes }}</td><td>{{ .Count }}</td></tr>
     {{ end }}
   </table>
+  {{ with .Compression }}
+  <h2>Compressed layer sizes</h2>
+  <table>
+    <tr><th>Layer</th><th>Uncompressed (bytes)</th><th>Stored (bytes)</th><th>gzip (bytes)</th><th>zstd (bytes)</th></tr>
+    {{ range .Layers }}
+    <tr><td>{{ .Index }}</td><td>{{ .UncompressedBytes }}</td><td>{{ .StoredBytes }} ({{ .StoredCompression }})</td><td>{{ .GzipBytes }}</td><td>{{ .ZstdBytes }}</td></tr>
+    {{ end }}
+  </table>
+  {{ end }}
+  {{ if .Recommendations }}
+  <h2>Recommendations</h2>
+  <table>
+    <tr><th>Suggestion</th><th>Estimated savings (bytes)</th><th>Evidence</th></tr>
+    {{ range .Recommendations }}
+    <tr>
+      <td><strong>{{ .Title }}</strong><br />{{ .Description }}</td>
+      <td>{{ .EstimatedSavingsBytes }}{{ if .Heuristic }} (heuristic){{ end }}</td>
+      <td>{{ range .Evidence }}{{ .Path }} ({{ .SizeBytes }})<br />{{ end }}</td>
+    </tr>
+    {{ end }}
+  </table>
+  {{ end }}
+  {{ if .Findings }}
+  <h2>Permission findings</h2>
+  <table>
+    <tr><th>Path</th><th>Finding</th><th>Severity</th><th>Mode</th><th>Owner</th><th>Layer</th></tr>
+    {{ range .Findings }}
+    <tr><td>{{ .Path }}</td><td>{{ .Kind }}</td><td>{{ .Severity }}</td><td>{{ .Mode }}</td><td>{{ .UID }}:{{ .GID }}</td><td>{{ .LayerIndex }}{{ if not .InFinalImage }} (removed later){{ end }}</td></tr>
+    {{ end }}
+  </table>
+  {{ end }}
 </body>
 </html>`
 
@@ -211,6 +464,63 @@ func generateHTML(entry history.Entry) ([]byte, error) {
 
 const timeLayout = "2006-01-02 15:04:05 MST"
 
+// TrendCSV writes one row per trend point, oldest first.
+func TrendCSV(trend history.Trend) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	header := []string{"time", "entryId", "image", "entryCount", "sizeBytes", "inefficientBytes", "efficiencyScore", "layerCount", "estimatedPullBytes", "gzipSizeBytes", "zstdSizeBytes"}
+	if err := writer.Write(header); err != nil {
+		return nil, err
+	}
+	for _, point := range trend.Points {
+		record := []string{
+			point.Time.UTC().Format(time.RFC3339),
+			point.EntryID,
+			point.Image,
+			strconv.Itoa(point.EntryCount),
+			strconv.FormatInt(point.Summary.SizeBytes, 10),
+			strconv.FormatInt(point.Summary.InefficientBytes, 10),
+			fmt.Sprintf("%.4f", point.Summary.EfficiencyScore),
+			strconv.Itoa(point.Summary.LayerCount),
+			strconv.FormatInt(point.Summary.EstimatedPullBytes, 10),
+			strconv.FormatInt(point.Summary.GzipSizeBytes, 10),
+			strconv.FormatInt(point.Summary.ZstdSizeBytes, 10),
+		}
+		if err := writer.Write(record); err != nil {
+			return nil, err
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func entryAudit(entry history.Entry) (audit.Report, bool) {
+	if entry.Audit != nil {
+		return *entry.Audit, true
+	}
+	result, err := dive.Parse(entry.Result)
+	if err != nil || !result.HasFileData() {
+		return audit.Report{}, false
+	}
+	return audit.Run(result, audit.DefaultOptions()), true
+}
+
+// entryBreakdown returns the stored content breakdown, classifying the result
+// on the fly for entries saved before breakdowns were recorded.
+func entryBreakdown(entry history.Entry) (breakdown.Breakdown, bool) {
+	if entry.Breakdown != nil {
+		return *entry.Breakdown, true
+	}
+	result, err := dive.Parse(entry.Result)
+	if err != nil || !result.HasFileData() {
+		return breakdown.Breakdown{}, false
+	}
+	return breakdown.Classify(result), true
+}
+
 func topFileReferences(files []diveFileReference, limit int) []diveFileReference {
 	ordered := make([]diveFileReference, len(files))
 	copy(ordered, files)
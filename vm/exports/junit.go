@@ -0,0 +1,134 @@
+package exports
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"time"
+
+	"deep-dive/ci"
+	"deep-dive/dive"
+	"deep-dive/history"
+)
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name       string          `xml:"name,attr"`
+	Tests      int             `xml:"tests,attr"`
+	Failures   int             `xml:"failures,attr"`
+	Errors     int             `xml:"errors,attr"`
+	Skipped    int             `xml:"skipped,attr"`
+	Timestamp  string          `xml:"timestamp,attr"`
+	Time       string          `xml:"time,attr"`
+	Properties []junitProperty `xml:"properties>property"`
+	TestCases  []junitTestCase `xml:"testcase"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+// generateJUnit evaluates the CI rules against the entry the way dive --ci
+// does and reports one test case per rule. Without options.Rules, Dive's
+// default thresholds apply. Unset or disabled rules are skipped.
+func generateJUnit(entry history.Entry, options Options) ([]byte, error) {
+	result, err := dive.Parse(entry.Result)
+	if err != nil {
+		return nil, err
+	}
+	rules := ci.DefaultRules()
+	if options.Rules != nil {
+		rules = *options.Rules
+	}
+	metrics := ci.MetricsFor(result)
+	evaluations, err := ci.Evaluate(rules, metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	suite := junitTestSuite{
+		Name:      "dive-ci " + entry.Metadata.Image,
+		Timestamp: entry.Metadata.CompletedAt.UTC().Format(time.RFC3339),
+		Time:      "0",
+		Properties: []junitProperty{
+			{Name: "image", Value: entry.Metadata.Image},
+			{Name: "entryId", Value: entry.Metadata.ID},
+			{Name: "efficiencyScore", Value: strconv.FormatFloat(metrics.EfficiencyScore, 'f', -1, 64)},
+			{Name: "wastedBytes", Value: strconv.FormatInt(metrics.WastedBytes, 10)},
+			{Name: "userSizeBytes", Value: strconv.FormatInt(metrics.UserSizeBytes, 10)},
+			{Name: "userWastedPercent", Value: strconv.FormatFloat(metrics.UserWastedPercent, 'f', -1, 64)},
+		},
+	}
+	if entry.Metadata.ImageID != "" {
+		suite.Properties = append(suite.Properties, junitProperty{Name: "imageId", Value: entry.Metadata.ImageID})
+	}
+	for _, evaluation := range evaluations {
+		testCase := junitTestCase{
+			Name:      evaluation.Rule,
+			ClassName: "dive-ci." + history.Repository(entry.Metadata.Image),
+			Time:      "0",
+		}
+		switch evaluation.Status {
+		case ci.StatusFailed:
+			suite.Failures++
+			testCase.Failure = &junitFailure{
+				Message: evaluation.Message,
+				Type:    evaluation.Rule,
+				Text:    fmt.Sprintf("actual: %s\nthreshold: %s\n", evaluation.Actual, evaluation.Threshold),
+			}
+		case ci.StatusSkipped:
+			suite.Skipped++
+			testCase.Skipped = &junitSkipped{Message: evaluation.Message}
+		default:
+			testCase.SystemOut = evaluation.Message
+		}
+		suite.TestCases = append(suite.TestCases, testCase)
+	}
+	suite.Tests = len(suite.TestCases)
+
+	document := junitTestSuites{
+		Name:     "deep-dive",
+		Tests:    suite.Tests,
+		Failures: suite.Failures,
+		Skipped:  suite.Skipped,
+		Suites:   []junitTestSuite{suite},
+	}
+	var buffer bytes.Buffer
+	buffer.WriteString(xml.Header)
+	encoder := xml.NewEncoder(&buffer)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(document); err != nil {
+		return nil, err
+	}
+	buffer.WriteString("\n")
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,217 @@
+package exports
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"deep-dive/ci"
+	"deep-dive/compare"
+	"deep-dive/dive"
+	"deep-dive/history"
+)
+
+type Detail string
+
+// DetailSummary is the summary table alone, DetailStandard adds the largest
+// wasted files and the layer table, and DetailFull lists more of each plus
+// the file changes of a comparison.
+const (
+	DetailSummary  Detail = "summary"
+	DetailStandard Detail = "standard"
+	DetailFull     Detail = "full"
+)
+
+const maxMarkdownCommandLength = 120
+
+// Options carries settings only some formats use. Comparison, when set,
+// compares another entry (left) against the exported one (right). Rules
+// replaces Dive's default CI thresholds and Dockerfile, the Dockerfile the
+// image was built from, lets findings point at its instructions.
+type Options struct {
+	Detail     Detail
+	Comparison *compare.Comparison
+	Rules      *ci.RulesRequest
+	Dockerfile string
+}
+
+func ParseDetail(value string) (Detail, error) {
+	switch detail := Detail(strings.ToLower(strings.TrimSpace(value))); detail {
+	case "":
+		return DetailStandard, nil
+	case DetailSummary, DetailStandard, DetailFull:
+		return detail, nil
+	default:
+		return "", fmt.Errorf("detail must be summary, standard or full")
+	}
+}
+
+func generateMarkdown(entry history.Entry, options Options) ([]byte, error) {
+	var payload diveExportPayload
+	if err := json.Unmarshal(entry.Result, &payload); err != nil {
+		return nil, fmt.Errorf("failed to parse analysis result: %w", err)
+	}
+	result, err := dive.Parse(entry.Result)
+	if err != nil {
+		return nil, err
+	}
+	detail := options.Detail
+	if detail == "" {
+		detail = DetailStandard
+	}
+	fileLimit, layerLimit, changeLimit := 10, 20, 0
+	if detail == DetailFull {
+		fileLimit, layerLimit, changeLimit = 50, 0, 25
+	}
+
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "## Dive analysis: %s\n\n", markdownCode(entry.Metadata.Image))
+	fmt.Fprintf(&buffer, "Completed %s", entry.Metadata.CompletedAt.Format(timeLayout))
+	if len(entry.Metadata.Labels) > 0 {
+		labels := make([]string, len(entry.Metadata.Labels))
+		for i, label := range entry.Metadata.Labels {
+			labels[i] = markdownCode(label)
+		}
+		fmt.Fprintf(&buffer, " • %s", strings.Join(labels, " "))
+	}
+	buffer.WriteString("\n\n")
+
+	buffer.WriteString("| Metric | Value |\n| --- | ---: |\n")
+	fmt.Fprintf(&buffer, "| Total size | %s |\n", formatSize(payload.Image.SizeBytes))
+	fmt.Fprintf(&buffer, "| Wasted space | %s |\n", formatSize(payload.Image.InefficientBytes))
+	fmt.Fprintf(&buffer, "| Efficiency score | %.2f%% |\n", payload.Image.EfficiencyScore*100)
+	fmt.Fprintf(&buffer, "| Layers | %d |\n", len(result.Layers))
+	if report := entry.Compression; report != nil {
+		fmt.Fprintf(&buffer, "| Estimated pull size | %s |\n", formatSize(report.EstimatedPullBytes))
+	}
+	buffer.WriteString("\n")
+
+	if detail != DetailSummary {
+		if files := topFileReferences(payload.Image.FileReference, fileLimit); len(files) > 0 {
+			buffer.WriteString("### Top wasted files\n\n| File | Size | Copies |\n| --- | ---: | ---: |\n")
+			for _, file := range files {
+				fmt.Fprintf(&buffer, "| %s | %s | %d |\n", markdownCode(file.File), formatSize(file.SizeBytes), file.Count)
+			}
+			buffer.WriteString("\n")
+		}
+
+		buffer.WriteString("### Layers\n\n| # | Command | Size |\n| ---: | --- | ---: |\n")
+		for position, layer := range result.Layers {
+			if layerLimit > 0 && position == layerLimit {
+				fmt.Fprintf(&buffer, "\n_%d more layers not shown._\n", len(result.Layers)-layerLimit)
+				break
+			}
+			fmt.Fprintf(&buffer, "| %d | %s | %s |\n", layer.Index, markdownCommand(layer.Command), formatSize(layer.SizeBytes))
+		}
+		buffer.WriteString("\n")
+	}
+
+	if comparison := options.Comparison; comparison != nil {
+		writeMarkdownDelta(&buffer, *comparison, detail, changeLimit)
+	}
+	return append(bytes.TrimRight(buffer.Bytes(), "\n"), '\n'), nil
+}
+
+func writeMarkdownDelta(buffer *bytes.Buffer, comparison compare.Comparison, detail Detail, changeLimit int) {
+	summary := comparison.Summary
+	fmt.Fprintf(buffer, "### Compared with %s\n\n", markdownCode(comparison.Left.Image))
+	fmt.Fprintf(buffer, "Compared entry %s, completed %s.\n\n", markdownCode(comparison.Left.ID), comparison.Left.CompletedAt.Format(timeLayout))
+	buffer.WriteString("| Metric | Other image | This image | Change |\n| --- | ---: | ---: | ---: |\n")
+	fmt.Fprintf(buffer, "| Total size | %s | %s | %s |\n", formatSize(summary.SizeBytes.Left), formatSize(summary.SizeBytes.Right), formatSizeDelta(summary.SizeBytes.Delta))
+	fmt.Fprintf(buffer, "| Wasted space | %s | %s | %s |\n", formatSize(summary.InefficientBytes.Left), formatSize(summary.InefficientBytes.Right), formatSizeDelta(summary.InefficientBytes.Delta))
+	fmt.Fprintf(buffer, "| Efficiency score | %.2f%% | %.2f%% | %+.2f pts |\n", summary.EfficiencyScore.Left*100, summary.EfficiencyScore.Right*100, summary.EfficiencyScore.Delta*100)
+	fmt.Fprintf(buffer, "| Layers | %d | %d | %+d |\n", summary.LayerCount.Left, summary.LayerCount.Right, summary.LayerCount.Delta)
+	if pull := summary.EstimatedPullBytes; pull != nil {
+		fmt.Fprintf(buffer, "| Estimated pull size | %s | %s | %s |\n", formatSize(pull.Left), formatSize(pull.Right), formatSizeDelta(pull.Delta))
+	}
+	buffer.WriteString("\n")
+
+	layers := comparison.Layers
+	fmt.Fprintf(buffer, "Layers: %d matched, %d added, %d removed.\n\n", len(layers.Matched), len(layers.Added), len(layers.Removed))
+	if detail == DetailSummary {
+		return
+	}
+	if len(layers.Added) > 0 || len(layers.Removed) > 0 {
+		buffer.WriteString("| Change | # | Command | Size |\n| --- | ---: | --- | ---: |\n")
+		for _, layer := range layers.Added {
+			fmt.Fprintf(buffer, "| added | %d | %s | %s |\n", layer.Index, markdownCommand(layer.Command), formatSize(layer.SizeBytes))
+		}
+		for _, layer := range layers.Removed {
+			fmt.Fprintf(buffer, "| removed | %d | %s | %s |\n", layer.Index, markdownCommand(layer.Command), formatSize(layer.SizeBytes))
+		}
+		buffer.WriteString("\n")
+	}
+
+	totals := comparison.Files.Totals
+	fmt.Fprintf(
+		buffer,
+		"Files: %d added (%s), %d removed (%s), %d grown (%s), %d shrunk (%s).\n\n",
+		totals.Added, formatSize(totals.AddedBytes),
+		totals.Removed, formatSize(totals.RemovedBytes),
+		totals.Grown, formatSize(totals.GrownBytes),
+		totals.Shrunk, formatSize(totals.ShrunkBytes),
+	)
+	if detail != DetailFull || len(comparison.Files.Changes) == 0 {
+		return
+	}
+	buffer.WriteString("<details>\n<summary>Largest file changes</summary>\n\n| File | Change | Delta |\n| --- | --- | ---: |\n")
+	for i, change := range comparison.Files.Changes {
+		if changeLimit > 0 && i == changeLimit {
+			break
+		}
+		fmt.Fprintf(buffer, "| %s | %s | %s |\n", markdownCode(change.Path), change.Change, formatSizeDelta(change.DeltaBytes))
+	}
+	buffer.WriteString("\n</details>\n")
+}
+
+// formatSize renders bytes in binary units the way the UI does.
+func formatSize(bytes int64) string {
+	if bytes < 0 {
+		return "-" + formatSize(-bytes)
+	}
+	units := []string{"B", "KB", "MB", "GB", "TB", "PB"}
+	value := float64(bytes)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return strconv.FormatInt(bytes, 10) + " B"
+	}
+	return strconv.FormatFloat(value, 'f', 2, 64) + " " + units[unit]
+}
+
+func formatSizeDelta(bytes int64) string {
+	if bytes > 0 {
+		return "+" + formatSize(bytes)
+	}
+	return formatSize(bytes)
+}
+
+// markdownCode wraps text in a code span that survives table cells: pipes
+// are escaped and the fence is longer than any backtick run inside.
+func markdownCode(text string) string {
+	text = strings.ReplaceAll(strings.Join(strings.Fields(text), " "), "|", "\\|")
+	fence := "`"
+	for strings.Contains(text, fence) {
+		fence += "`"
+	}
+	if strings.HasPrefix(text, "`") || strings.HasSuffix(text, "`") {
+		text = " " + text + " "
+	}
+	return fence + text + fence
+}
+
+func markdownCommand(command string) string {
+	command = strings.Join(strings.Fields(command), " ")
+	if command == "" {
+		return ""
+	}
+	if runes := []rune(command); len(runes) > maxMarkdownCommandLength {
+		command = string(runes[:maxMarkdownCommandLength-1]) + "…"
+	}
+	return markdownCode(command)
+}
@@ -0,0 +1,435 @@
+package exports
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"deep-dive/audit"
+	"deep-dive/ci"
+	"deep-dive/dive"
+	"deep-dive/dockerfile"
+	"deep-dive/history"
+	"deep-dive/recommendations"
+)
+
+const (
+	sarifVersion = "2.1.0"
+	sarifSchema  = "https://json.schemastore.org/sarif-2.1.0.json"
+	// sarifFingerprint versions the fingerprint recipe; bump it if the
+	// hashed fields change, or dashboards will reopen every result.
+	sarifFingerprint = "deepDiveFinding/v1"
+	sarifArtifact    = "Dockerfile"
+	sarifToolName    = "deep-dive"
+
+	maxSARIFWastedFiles      = 500
+	maxSARIFRelatedLocations = 10
+)
+
+const (
+	ruleWastedFile           = "wasted-file"
+	ruleCIPrefix             = "ci/"
+	ruleAuditPrefix          = "audit/"
+	ruleRecommendationPrefix = "recommendation/"
+)
+
+const (
+	sarifLevelError   = "error"
+	sarifLevelWarning = "warning"
+	sarifLevelNote    = "note"
+)
+
+type sarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool              sarifTool              `json:"tool"`
+	AutomationDetails sarifAutomationDetails `json:"automationDetails"`
+	Results           []sarifResult          `json:"results"`
+	Properties        map[string]any         `json:"properties,omitempty"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name  string      `json:"name"`
+	Rules []sarifRule `json:"rules"`
+}
+
+type sarifAutomationDetails struct {
+	ID string `json:"id"`
+}
+
+type sarifRule struct {
+	ID                   string             `json:"id"`
+	Name                 string             `json:"name"`
+	ShortDescription     sarifMessage       `json:"shortDescription"`
+	FullDescription      sarifMessage       `json:"fullDescription"`
+	DefaultConfiguration sarifConfiguration `json:"defaultConfiguration"`
+	Properties           map[string]any     `json:"properties,omitempty"`
+}
+
+type sarifConfiguration struct {
+	Level string `json:"level"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID              string            `json:"ruleId"`
+	RuleIndex           int               `json:"ruleIndex"`
+	Level               string            `json:"level"`
+	Message             sarifMessage      `json:"message"`
+	Locations           []sarifLocation   `json:"locations"`
+	RelatedLocations    []sarifLocation   `json:"relatedLocations,omitempty"`
+	PartialFingerprints map[string]string `json:"partialFingerprints"`
+	Properties          map[string]any    `json:"properties,omitempty"`
+}
+
+type sarifLocation struct {
+	ID               *int                   `json:"id,omitempty"`
+	PhysicalLocation sarifPhysicalLocation  `json:"physicalLocation"`
+	LogicalLocations []sarifLogicalLocation `json:"logicalLocations,omitempty"`
+	Message          *sarifMessage          `json:"message,omitempty"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           *sarifRegion          `json:"region,omitempty"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine int          `json:"startLine"`
+	EndLine   int          `json:"endLine"`
+	Snippet   sarifMessage `json:"snippet"`
+}
+
+type sarifLogicalLocation struct {
+	Name               string `json:"name"`
+	FullyQualifiedName string `json:"fullyQualifiedName"`
+	Kind               string `json:"kind"`
+}
+
+// sarifBuilder collects results and the rules they reference, in the order
+// the rules are first used.
+type sarifBuilder struct {
+	repository   string
+	layers       []dive.Layer
+	instructions map[int]dockerfile.Instruction
+	rules        []sarifRule
+	ruleIndex    map[string]int
+	results      []sarifResult
+}
+
+// generateSARIF reports wasted files, failed CI rules, audit findings and
+// recommendations as SARIF 2.1.0 results. Locations name the Dockerfile;
+// when options.Dockerfile is given they point at the instruction that built
+// the layer involved, otherwise the layer is given as a logical location.
+func generateSARIF(entry history.Entry, options Options) ([]byte, error) {
+	result, err := dive.Parse(entry.Result)
+	if err != nil {
+		return nil, err
+	}
+	rules := ci.DefaultRules()
+	if options.Rules != nil {
+		rules = *options.Rules
+	}
+	evaluations, err := ci.Evaluate(rules, ci.MetricsFor(result))
+	if err != nil {
+		return nil, err
+	}
+
+	builder := &sarifBuilder{
+		repository:   history.Repository(entry.Metadata.Image),
+		layers:       result.Layers,
+		instructions: map[int]dockerfile.Instruction{},
+		rules:        []sarifRule{},
+		ruleIndex:    make(map[string]int),
+		results:      []sarifResult{},
+	}
+	if strings.TrimSpace(options.Dockerfile) != "" {
+		builder.instructions = dockerfile.Locate(dockerfile.Parse(options.Dockerfile), result.Layers)
+	}
+
+	for _, evaluation := range evaluations {
+		if !evaluation.Failed() {
+			continue
+		}
+		builder.add(
+			ciRule(evaluation.Rule),
+			"",
+			evaluation.Message+".",
+			nil,
+			map[string]any{"actual": evaluation.Actual, "threshold": evaluation.Threshold},
+		)
+	}
+	builder.addWastedFiles(result)
+	if report, ok := entryAudit(entry); ok {
+		for _, finding := range report.Findings {
+			message := fmt.Sprintf("%s is %s (mode %s, owner %d:%d).", finding.Path, finding.Kind, finding.Mode, finding.UID, finding.GID)
+			if !finding.InFinalImage {
+				message += " A later layer changes or removes it, but this layer still ships it."
+			}
+			builder.add(
+				auditRule(finding.Kind, finding.Severity),
+				finding.Path,
+				message,
+				[]int{finding.LayerIndex},
+				map[string]any{"path": finding.Path, "mode": finding.Mode, "uid": finding.UID, "gid": finding.GID},
+			)
+		}
+	}
+	for _, recommendation := range recommendations.Generate(result) {
+		var layers []int
+		seen := make(map[int]bool)
+		for _, evidence := range recommendation.Evidence {
+			if !seen[evidence.LayerIndex] {
+				seen[evidence.LayerIndex] = true
+				layers = append(layers, evidence.LayerIndex)
+			}
+		}
+		properties := map[string]any{"estimatedSavingsBytes": recommendation.EstimatedSavingsBytes}
+		if recommendation.Heuristic {
+			properties["heuristic"] = true
+		}
+		builder.add(
+			recommendationRule(recommendation),
+			"",
+			recommendation.Description,
+			layers,
+			properties,
+		)
+	}
+
+	properties := map[string]any{
+		"image":       entry.Metadata.Image,
+		"entryId":     entry.Metadata.ID,
+		"completedAt": entry.Metadata.CompletedAt.Format(time.RFC3339),
+	}
+	if entry.Metadata.ImageID != "" {
+		properties["imageId"] = entry.Metadata.ImageID
+	}
+	log := sarifLog{
+		Version: sarifVersion,
+		Schema:  sarifSchema,
+		Runs: []sarifRun{{
+			Tool:              sarifTool{Driver: sarifDriver{Name: sarifToolName, Rules: builder.rules}},
+			AutomationDetails: sarifAutomationDetails{ID: sarifToolName + "/" + builder.repository + "/"},
+			Results:           builder.results,
+			Properties:        properties,
+		}},
+	}
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(log); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// addWastedFiles reports the files Dive counts as wasted, largest first. The
+// result points at the layer that first wrote the file, with the layers
+// that later replaced or removed it as related locations.
+func (b *sarifBuilder) addWastedFiles(result dive.Result) {
+	references := topFileReferences(fileReferences(result.Image.FileReference), maxSARIFWastedFiles)
+	touched := make(map[string][]int, len(references))
+	for _, reference := range references {
+		touched[dive.CleanPath(reference.File)] = nil
+	}
+	for position, layer := range result.Layers {
+		for _, file := range layer.Files {
+			filePath := file.Path
+			if file.IsWhiteout() {
+				filePath = file.WhiteoutTarget()
+			}
+			if positions, ok := touched[filePath]; ok && (len(positions) == 0 || positions[len(positions)-1] != position) {
+				touched[filePath] = append(positions, position)
+			}
+		}
+	}
+
+	for _, reference := range references {
+		if reference.SizeBytes <= 0 {
+			continue
+		}
+		filePath := dive.CleanPath(reference.File)
+		b.add(
+			wastedFileRule(),
+			filePath,
+			fmt.Sprintf("%s is stored %d times across layers, wasting %d bytes.", filePath, reference.Count, reference.SizeBytes),
+			touched[filePath],
+			map[string]any{"path": filePath, "count": reference.Count, "sizeBytes": reference.SizeBytes},
+		)
+	}
+}
+
+// add records a result. The first layer position is the primary location
+// and the rest are related locations; without any, the result points at
+// the Dockerfile as a whole.
+func (b *sarifBuilder) add(rule sarifRule, subject string, message string, layers []int, properties map[string]any) {
+	index, ok := b.ruleIndex[rule.ID]
+	if !ok {
+		index = len(b.rules)
+		b.ruleIndex[rule.ID] = index
+		b.rules = append(b.rules, rule)
+	}
+	result := sarifResult{
+		RuleID:    rule.ID,
+		RuleIndex: index,
+		Level:     rule.DefaultConfiguration.Level,
+		Message:   sarifMessage{Text: message},
+		Locations: []sarifLocation{{PhysicalLocation: sarifPhysicalLocation{ArtifactLocation: sarifArtifactLocation{URI: sarifArtifact}}}},
+		PartialFingerprints: map[string]string{
+			sarifFingerprint: fingerprint(rule.ID, b.repository, subject),
+		},
+		Properties: properties,
+	}
+	var locations []sarifLocation
+	for _, position := range layers {
+		if position >= 0 && position < len(b.layers) {
+			locations = append(locations, b.layerLocation(position))
+		}
+	}
+	if len(locations) > 0 {
+		result.Locations[0] = locations[0]
+	}
+	for _, location := range locations[min(1, len(locations)):] {
+		if len(result.RelatedLocations) == maxSARIFRelatedLocations {
+			break
+		}
+		id := len(result.RelatedLocations) + 1
+		location.ID = &id
+		result.RelatedLocations = append(result.RelatedLocations, location)
+	}
+	b.results = append(b.results, result)
+}
+
+func (b *sarifBuilder) layerLocation(position int) sarifLocation {
+	layer := b.layers[position]
+	name := fmt.Sprintf("layer %d", position)
+	qualified := name
+	if layer.DigestID != "" {
+		qualified = layer.DigestID
+	}
+	location := sarifLocation{
+		PhysicalLocation: sarifPhysicalLocation{ArtifactLocation: sarifArtifactLocation{URI: sarifArtifact}},
+		LogicalLocations: []sarifLogicalLocation{{Name: name, FullyQualifiedName: qualified, Kind: "module"}},
+	}
+	if instruction, ok := b.instructions[position]; ok {
+		location.PhysicalLocation.Region = &sarifRegion{
+			StartLine: instruction.StartLine,
+			EndLine:   instruction.EndLine,
+			Snippet:   sarifMessage{Text: instruction.Text},
+		}
+	}
+	if keyword, arguments := dockerfile.Normalize(layer.Command); keyword != "" {
+		location.Message = &sarifMessage{Text: strings.TrimSpace(keyword + " " + arguments)}
+	}
+	return location
+}
+
+// fingerprint identifies a finding across analyses of the same repository,
+// so a result keeps its identity when the image is rebuilt or retagged.
+func fingerprint(ruleID string, repository string, subject string) string {
+	sum := sha256.Sum256([]byte(ruleID + "\x00" + repository + "\x00" + subject))
+	return hex.EncodeToString(sum[:])
+}
+
+func fileReferences(references []dive.FileReference) []diveFileReference {
+	converted := make([]diveFileReference, len(references))
+	for i, reference := range references {
+		converted[i] = diveFileReference(reference)
+	}
+	return converted
+}
+
+func wastedFileRule() sarifRule {
+	return sarifRule{
+		ID:                   ruleWastedFile,
+		Name:                 "WastedFile",
+		ShortDescription:     sarifMessage{Text: "File stored in more than one layer"},
+		FullDescription:      sarifMessage{Text: "A file was written by one layer and replaced or removed by a later one. Every earlier copy still takes up space in the image. Create, use and delete it within the same instruction, or use a multi-stage build."},
+		DefaultConfiguration: sarifConfiguration{Level: sarifLevelWarning},
+		Properties:           map[string]any{"tags": []string{"efficiency"}},
+	}
+}
+
+func ciRule(rule string) sarifRule {
+	descriptions := map[string][2]string{
+		ci.RuleLowestEfficiency:         {"LowestEfficiency", "Image efficiency is below the CI threshold"},
+		ci.RuleHighestWastedBytes:       {"HighestWastedBytes", "Wasted space exceeds the CI threshold"},
+		ci.RuleHighestUserWastedPercent: {"HighestUserWastedPercent", "Wasted share of the layers above the base exceeds the CI threshold"},
+	}
+	description := descriptions[rule]
+	return sarifRule{
+		ID:                   ruleCIPrefix + rule,
+		Name:                 description[0],
+		ShortDescription:     sarifMessage{Text: description[1]},
+		FullDescription:      sarifMessage{Text: description[1] + ", as configured by the " + rule + " rule of .dive-ci."},
+		DefaultConfiguration: sarifConfiguration{Level: sarifLevelError},
+		Properties:           map[string]any{"tags": []string{"efficiency", "ci"}},
+	}
+}
+
+func auditRule(kind audit.Kind, severity audit.Severity) sarifRule {
+	descriptions := map[audit.Kind][2]string{
+		audit.KindSetuid:          {"SetuidFile", "File runs with its owner's privileges (setuid)"},
+		audit.KindSetgid:          {"SetgidFile", "File runs with its group's privileges (setgid)"},
+		audit.KindWorldWritable:   {"WorldWritableFile", "File or directory is writable by every user"},
+		audit.KindUnexpectedOwner: {"UnexpectedOwner", "File is owned by an unexpected user"},
+		audit.KindDeviceNode:      {"DeviceNode", "Image contains a device node"},
+	}
+	description, ok := descriptions[kind]
+	if !ok {
+		description = [2]string{string(kind), string(kind)}
+	}
+	// security-severity is the CVSS-like score code scanning dashboards
+	// rank security results by.
+	level, securitySeverity := sarifLevelNote, "2.0"
+	switch severity {
+	case audit.SeverityHigh:
+		level, securitySeverity = sarifLevelError, "7.5"
+	case audit.SeverityMedium:
+		level, securitySeverity = sarifLevelWarning, "5.0"
+	}
+	return sarifRule{
+		ID:                   ruleAuditPrefix + string(kind),
+		Name:                 description[0],
+		ShortDescription:     sarifMessage{Text: description[1]},
+		FullDescription:      sarifMessage{Text: description[1] + ". Review whether the image needs it."},
+		DefaultConfiguration: sarifConfiguration{Level: level},
+		Properties:           map[string]any{"tags": []string{"security"}, "security-severity": securitySeverity},
+	}
+}
+
+func recommendationRule(recommendation recommendations.Recommendation) sarifRule {
+	name := ""
+	for _, word := range strings.Split(string(recommendation.Kind), "-") {
+		name += strings.ToUpper(word[:1]) + word[1:]
+	}
+	return sarifRule{
+		ID:                   ruleRecommendationPrefix + string(recommendation.Kind),
+		Name:                 name,
+		ShortDescription:     sarifMessage{Text: recommendation.Title},
+		FullDescription:      sarifMessage{Text: recommendation.Title + "."},
+		DefaultConfiguration: sarifConfiguration{Level: sarifLevelNote},
+		Properties:           map[string]any{"tags": []string{"efficiency"}},
+	}
+}
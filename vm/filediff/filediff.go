@@ -0,0 +1,219 @@
+package filediff
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"deep-dive/dive"
+)
+
+const (
+	Added   = "added"
+	Removed = "removed"
+	Grown   = "grown"
+	Shrunk  = "shrunk"
+)
+
+type Change struct {
+	Path           string `json:"path"`
+	Change         string `json:"change"`
+	LeftSizeBytes  int64  `json:"leftSizeBytes"`
+	RightSizeBytes int64  `json:"rightSizeBytes"`
+	DeltaBytes     int64  `json:"deltaBytes"`
+}
+
+type Totals struct {
+	Added        int   `json:"added"`
+	Removed      int   `json:"removed"`
+	Grown        int   `json:"grown"`
+	Shrunk       int   `json:"shrunk"`
+	AddedBytes   int64 `json:"addedBytes"`
+	RemovedBytes int64 `json:"removedBytes"`
+	GrownBytes   int64 `json:"grownBytes"`
+	ShrunkBytes  int64 `json:"shrunkBytes"`
+	DeltaBytes   int64 `json:"deltaBytes"`
+}
+
+// Directory rolls up the changes below a directory. The sizes cover every
+// file under it in each tree, changed or not; the counts only the changes.
+type Directory struct {
+	Path           string `json:"path"`
+	Depth          int    `json:"depth"`
+	LeftSizeBytes  int64  `json:"leftSizeBytes"`
+	RightSizeBytes int64  `json:"rightSizeBytes"`
+	DeltaBytes     int64  `json:"deltaBytes"`
+	Added          int    `json:"added"`
+	Removed        int    `json:"removed"`
+	Grown          int    `json:"grown"`
+	Shrunk         int    `json:"shrunk"`
+}
+
+// Result lists changed files and the directories containing them, each
+// sorted by absolute DeltaBytes, largest first, then by path. Files of
+// equal size count as unchanged since analysis results carry no content
+// hashes.
+type Result struct {
+	Totals      Totals      `json:"totals"`
+	Changes     []Change    `json:"changes"`
+	Directories []Directory `json:"directories"`
+	Truncated   bool        `json:"truncated,omitempty"`
+}
+
+// Limits trims a Result for display. MaxDepth drops directories deeper than
+// it ("/" is depth 0); zero values keep everything.
+type Limits struct {
+	MaxChanges     int
+	MaxDirectories int
+	MaxDepth       int
+}
+
+// Diff compares two final filesystems as returned by Result.Aggregate.
+// Directory entries themselves are not compared; their contents are.
+func Diff(left []dive.AggregateFile, right []dive.AggregateFile) Result {
+	result := Result{Changes: []Change{}, Directories: []Directory{}}
+	leftSizes := make(map[string]int64, len(left))
+	for _, file := range left {
+		if !file.IsDir {
+			leftSizes[file.Path] = file.SizeBytes
+		}
+	}
+
+	directories := make(map[string]*Directory)
+	ancestors := func(filePath string, visit func(directory *Directory)) {
+		for dir := path.Dir(filePath); ; dir = path.Dir(dir) {
+			directory, ok := directories[dir]
+			if !ok {
+				directory = &Directory{Path: dir, Depth: depth(dir)}
+				directories[dir] = directory
+			}
+			visit(directory)
+			if dir == "/" || dir == "." {
+				return
+			}
+		}
+	}
+
+	seen := make(map[string]bool, len(right))
+	for _, file := range right {
+		if file.IsDir {
+			continue
+		}
+		seen[file.Path] = true
+		size := file.SizeBytes
+		ancestors(file.Path, func(directory *Directory) { directory.RightSizeBytes += size })
+
+		leftSize, ok := leftSizes[file.Path]
+		change := Change{Path: file.Path, LeftSizeBytes: leftSize, RightSizeBytes: size, DeltaBytes: size - leftSize}
+		switch {
+		case !ok:
+			change.Change = Added
+		case size > leftSize:
+			change.Change = Grown
+		case size < leftSize:
+			change.Change = Shrunk
+		default:
+			continue
+		}
+		result.record(change, ancestors)
+	}
+	for _, file := range left {
+		if file.IsDir {
+			continue
+		}
+		size := file.SizeBytes
+		ancestors(file.Path, func(directory *Directory) { directory.LeftSizeBytes += size })
+		if !seen[file.Path] {
+			result.record(Change{Path: file.Path, Change: Removed, LeftSizeBytes: size, DeltaBytes: -size}, ancestors)
+		}
+	}
+
+	for _, directory := range directories {
+		if directory.Added+directory.Removed+directory.Grown+directory.Shrunk > 0 {
+			directory.DeltaBytes = directory.RightSizeBytes - directory.LeftSizeBytes
+			result.Directories = append(result.Directories, *directory)
+		}
+	}
+	sort.Slice(result.Changes, func(i, j int) bool {
+		return byDelta(result.Changes[i].DeltaBytes, result.Changes[j].DeltaBytes, result.Changes[i].Path, result.Changes[j].Path)
+	})
+	sort.Slice(result.Directories, func(i, j int) bool {
+		return byDelta(result.Directories[i].DeltaBytes, result.Directories[j].DeltaBytes, result.Directories[i].Path, result.Directories[j].Path)
+	})
+	return result
+}
+
+func (r *Result) record(change Change, ancestors func(string, func(*Directory))) {
+	totals := &r.Totals
+	totals.DeltaBytes += change.DeltaBytes
+	switch change.Change {
+	case Added:
+		totals.Added++
+		totals.AddedBytes += change.RightSizeBytes
+	case Removed:
+		totals.Removed++
+		totals.RemovedBytes += change.LeftSizeBytes
+	case Grown:
+		totals.Grown++
+		totals.GrownBytes += change.DeltaBytes
+	case Shrunk:
+		totals.Shrunk++
+		totals.ShrunkBytes -= change.DeltaBytes
+	}
+	ancestors(change.Path, func(directory *Directory) {
+		switch change.Change {
+		case Added:
+			directory.Added++
+		case Removed:
+			directory.Removed++
+		case Grown:
+			directory.Grown++
+		case Shrunk:
+			directory.Shrunk++
+		}
+	})
+	r.Changes = append(r.Changes, change)
+}
+
+// Limit applies limits in place. Totals still cover every change.
+func (r *Result) Limit(limits Limits) {
+	if limits.MaxDepth > 0 {
+		kept := r.Directories[:0:0]
+		for _, directory := range r.Directories {
+			if directory.Depth <= limits.MaxDepth {
+				kept = append(kept, directory)
+			}
+		}
+		r.Directories = kept
+	}
+	if limits.MaxChanges > 0 && len(r.Changes) > limits.MaxChanges {
+		r.Changes = r.Changes[:limits.MaxChanges]
+		r.Truncated = true
+	}
+	if limits.MaxDirectories > 0 && len(r.Directories) > limits.MaxDirectories {
+		r.Directories = r.Directories[:limits.MaxDirectories]
+		r.Truncated = true
+	}
+}
+
+func depth(dir string) int {
+	if dir == "/" || dir == "." {
+		return 0
+	}
+	return strings.Count(dir, "/")
+}
+
+// byDelta orders by absolute byte delta, largest first, then by path.
+func byDelta(left int64, right int64, leftPath string, rightPath string) bool {
+	if a, b := abs(left), abs(right); a != b {
+		return a > b
+	}
+	return leftPath < rightPath
+}
+
+func abs(value int64) int64 {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
@@ -0,0 +1,122 @@
+package filediff
+
+import (
+	"reflect"
+	"testing"
+
+	"deep-dive/dive"
+)
+
+func aggregate(files map[string]int64) []dive.AggregateFile {
+	var result []dive.AggregateFile
+	for filePath, size := range files {
+		result = append(result, dive.AggregateFile{File: dive.File{Path: filePath, SizeBytes: size}})
+	}
+	return result
+}
+
+func TestDiff(t *testing.T) {
+	left := aggregate(map[string]int64{
+		"/app/main.js":     100,
+		"/app/vendor.js":   500,
+		"/app/old.js":      40,
+		"/etc/config":      10,
+		"/usr/lib/libc.so": 1000,
+	})
+	left = append(left, dive.AggregateFile{File: dive.File{Path: "/app", IsDir: true}})
+	right := aggregate(map[string]int64{
+		"/app/main.js":     250,
+		"/app/vendor.js":   300,
+		"/app/new.js":      70,
+		"/etc/config":      10,
+		"/usr/lib/libc.so": 1000,
+	})
+
+	result := Diff(left, right)
+
+	wantChanges := []Change{
+		{Path: "/app/vendor.js", Change: Shrunk, LeftSizeBytes: 500, RightSizeBytes: 300, DeltaBytes: -200},
+		{Path: "/app/main.js", Change: Grown, LeftSizeBytes: 100, RightSizeBytes: 250, DeltaBytes: 150},
+		{Path: "/app/new.js", Change: Added, RightSizeBytes: 70, DeltaBytes: 70},
+		{Path: "/app/old.js", Change: Removed, LeftSizeBytes: 40, DeltaBytes: -40},
+	}
+	if !reflect.DeepEqual(result.Changes, wantChanges) {
+		t.Errorf("Changes = %+v, want %+v", result.Changes, wantChanges)
+	}
+
+	wantTotals := Totals{
+		Added: 1, Removed: 1, Grown: 1, Shrunk: 1,
+		AddedBytes: 70, RemovedBytes: 40, GrownBytes: 150, ShrunkBytes: 200,
+		DeltaBytes: -20,
+	}
+	if result.Totals != wantTotals {
+		t.Errorf("Totals = %+v, want %+v", result.Totals, wantTotals)
+	}
+
+	// Unchanged directories such as /etc and /usr/lib are left out, and the
+	// roll-up sizes include the unchanged files below each directory.
+	wantDirectories := []Directory{
+		{Path: "/", Depth: 0, LeftSizeBytes: 1650, RightSizeBytes: 1630, DeltaBytes: -20, Added: 1, Removed: 1, Grown: 1, Shrunk: 1},
+		{Path: "/app", Depth: 1, LeftSizeBytes: 640, RightSizeBytes: 620, DeltaBytes: -20, Added: 1, Removed: 1, Grown: 1, Shrunk: 1},
+	}
+	if !reflect.DeepEqual(result.Directories, wantDirectories) {
+		t.Errorf("Directories = %+v, want %+v", result.Directories, wantDirectories)
+	}
+}
+
+func TestLimit(t *testing.T) {
+	left := aggregate(map[string]int64{"/a/b/c/file": 10})
+	right := aggregate(map[string]int64{"/a/b/c/file": 30, "/a/other": 5})
+
+	tests := []struct {
+		name            string
+		limits          Limits
+		wantChanges     []string
+		wantDirectories []string
+		wantTruncated   bool
+	}{
+		{
+			name:            "no limits",
+			wantChanges:     []string{"/a/b/c/file", "/a/other"},
+			wantDirectories: []string{"/", "/a", "/a/b", "/a/b/c"},
+		},
+		{
+			name:            "depth",
+			limits:          Limits{MaxDepth: 1},
+			wantChanges:     []string{"/a/b/c/file", "/a/other"},
+			wantDirectories: []string{"/", "/a"},
+		},
+		{
+			name:            "counts",
+			limits:          Limits{MaxChanges: 1, MaxDirectories: 2},
+			wantChanges:     []string{"/a/b/c/file"},
+			wantDirectories: []string{"/", "/a"},
+			wantTruncated:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := Diff(left, right)
+			result.Limit(test.limits)
+			var changes, directories []string
+			for _, change := range result.Changes {
+				changes = append(changes, change.Path)
+			}
+			for _, directory := range result.Directories {
+				directories = append(directories, directory.Path)
+			}
+			if !reflect.DeepEqual(changes, test.wantChanges) {
+				t.Errorf("changes = %v, want %v", changes, test.wantChanges)
+			}
+			if !reflect.DeepEqual(directories, test.wantDirectories) {
+				t.Errorf("directories = %v, want %v", directories, test.wantDirectories)
+			}
+			if result.Truncated != test.wantTruncated {
+				t.Errorf("Truncated = %t, want %t", result.Truncated, test.wantTruncated)
+			}
+			if result.Totals.Added != 1 || result.Totals.Grown != 1 {
+				t.Errorf("Totals = %+v, want every change counted", result.Totals)
+			}
+		})
+	}
+}
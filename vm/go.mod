@@ -3,8 +3,10 @@ module deep-dive
 go 1.26.0
 
 require (
+	github.com/klauspost/compress v1.18.0
 	github.com/labstack/echo v3.3.10+incompatible
 	github.com/sirupsen/logrus v1.9.4
+	go.etcd.io/bbolt v1.4.3
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -0,0 +1,95 @@
+package history
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	maxNotesLength = 4000
+	maxLabels      = 32
+	maxLabelLength = 64
+)
+
+// MetadataPatch holds the user-editable Metadata fields. Nil fields are left
+// unchanged, so a request only needs to send what it modifies.
+type MetadataPatch struct {
+	Notes  *string   `json:"notes"`
+	Labels *[]string `json:"labels"`
+	Pinned *bool     `json:"pinned"`
+}
+
+func (p MetadataPatch) IsEmpty() bool {
+	return p.Notes == nil && p.Labels == nil && p.Pinned == nil
+}
+
+// Apply validates the patch and writes it to metadata.
+func (p MetadataPatch) Apply(metadata *Metadata) error {
+	var labels []string
+	if p.Labels != nil {
+		var err error
+		if labels, err = NormalizeLabels(*p.Labels); err != nil {
+			return err
+		}
+	}
+	if p.Notes != nil {
+		notes := strings.TrimSpace(*p.Notes)
+		if utf8.RuneCountInString(notes) > maxNotesLength {
+			return fmt.Errorf("notes must be at most %d characters", maxNotesLength)
+		}
+		metadata.Notes = notes
+	}
+	if p.Labels != nil {
+		metadata.Labels = labels
+	}
+	if p.Pinned != nil {
+		metadata.Pinned = *p.Pinned
+	}
+	return nil
+}
+
+// NormalizeLabels trims, de-duplicates and sorts labels so the same set is
+// always stored the same way. Labels keep their case but compare without it.
+func NormalizeLabels(labels []string) ([]string, error) {
+	seen := make(map[string]bool, len(labels))
+	normalized := make([]string, 0, len(labels))
+	for _, label := range labels {
+		label = strings.TrimSpace(label)
+		if label == "" {
+			continue
+		}
+		if utf8.RuneCountInString(label) > maxLabelLength {
+			return nil, fmt.Errorf("label %q is longer than %d characters", label, maxLabelLength)
+		}
+		if strings.ContainsAny(label, ",\n\r\t") {
+			return nil, fmt.Errorf("label %q may not contain commas or control characters", label)
+		}
+		key := strings.ToLower(label)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		normalized = append(normalized, label)
+	}
+	if len(normalized) > maxLabels {
+		return nil, fmt.Errorf("at most %d labels are allowed", maxLabels)
+	}
+	sort.Slice(normalized, func(i, j int) bool {
+		return strings.ToLower(normalized[i]) < strings.ToLower(normalized[j])
+	})
+	if len(normalized) == 0 {
+		return nil, nil
+	}
+	return normalized, nil
+}
+
+func (m Metadata) HasLabel(label string) bool {
+	for _, candidate := range m.Labels {
+		if strings.EqualFold(candidate, label) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package history
+
+import (
+	"errors"
+	"sort"
+)
+
+// BaselineDelta records how an entry differed from its repository's baseline
+// when it was saved. Positive values mean the entry is larger or scores
+// higher than the baseline. Deltas that need data the baseline predates are
+// omitted.
+type BaselineDelta struct {
+	BaselineID         string  `json:"baselineId"`
+	BaselineImage      string  `json:"baselineImage"`
+	SizeBytes          int64   `json:"sizeBytes"`
+	InefficientBytes   int64   `json:"inefficientBytes"`
+	EfficiencyScore    float64 `json:"efficiencyScore"`
+	LayerCount         *int    `json:"layerCount,omitempty"`
+	EstimatedPullBytes *int64  `json:"estimatedPullBytes,omitempty"`
+}
+
+func NewBaselineDelta(entry Summary, baseline Metadata) BaselineDelta {
+	delta := BaselineDelta{
+		BaselineID:       baseline.ID,
+		BaselineImage:    baseline.Image,
+		SizeBytes:        entry.SizeBytes - baseline.Summary.SizeBytes,
+		InefficientBytes: entry.InefficientBytes - baseline.Summary.InefficientBytes,
+		EfficiencyScore:  entry.EfficiencyScore - baseline.Summary.EfficiencyScore,
+	}
+	if entry.LayerCount > 0 && baseline.Summary.LayerCount > 0 {
+		layers := entry.LayerCount - baseline.Summary.LayerCount
+		delta.LayerCount = &layers
+	}
+	if entry.EstimatedPullBytes > 0 && baseline.Summary.EstimatedPullBytes > 0 {
+		pull := entry.EstimatedPullBytes - baseline.Summary.EstimatedPullBytes
+		delta.EstimatedPullBytes = &pull
+	}
+	return delta
+}
+
+// FindBaseline returns the baseline of a repository. SetBaseline and bundle
+// imports keep one per repository; should a store written before that hold
+// several, the most recently completed one wins.
+func FindBaseline(entries []Metadata, repository string) (Metadata, bool) {
+	var found Metadata
+	ok := false
+	for _, entry := range entries {
+		if !entry.Baseline || Repository(entry.Image) != repository {
+			continue
+		}
+		if !ok || entry.CompletedAt.After(found.CompletedAt) {
+			found = entry
+			ok = true
+		}
+	}
+	return found, ok
+}
+
+// Baselines returns the baseline of every repository that has one, sorted
+// by repository.
+func Baselines(entries []Metadata) []Metadata {
+	repositories := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.Baseline {
+			repositories[Repository(entry.Image)] = true
+		}
+	}
+	baselines := make([]Metadata, 0, len(repositories))
+	for repository := range repositories {
+		baseline, _ := FindBaseline(entries, repository)
+		baselines = append(baselines, baseline)
+	}
+	sort.Slice(baselines, func(i, j int) bool {
+		return Repository(baselines[i].Image) < Repository(baselines[j].Image)
+	})
+	return baselines
+}
+
+// SetBaseline makes an entry the baseline of its repository, replacing the
+// previous one. The previous baselines are cleared first, so a failure part
+// way leaves the repository with no baseline rather than two.
+func SetBaseline(store Store, id string) (Metadata, error) {
+	entries, err := store.List()
+	if err != nil {
+		return Metadata{}, err
+	}
+	repository, found := "", false
+	for _, entry := range entries {
+		if entry.ID == id {
+			repository, found = Repository(entry.Image), true
+			break
+		}
+	}
+	if !found {
+		return Metadata{}, ErrNotFound
+	}
+	for _, other := range entries {
+		if other.ID == id || !other.Baseline || Repository(other.Image) != repository {
+			continue
+		}
+		if _, err := ClearBaseline(store, other.ID); err != nil && !errors.Is(err, ErrNotFound) {
+			return Metadata{}, err
+		}
+	}
+	return store.Update(id, func(metadata *Metadata) error {
+		metadata.Baseline = true
+		return nil
+	})
+}
+
+func ClearBaseline(store Store, id string) (Metadata, error) {
+	return store.Update(id, func(metadata *Metadata) error {
+		metadata.Baseline = false
+		return nil
+	})
+}
+
+// AttachBaselineDelta sets the delta of a new entry against its repository's
+// baseline, if there is one. The store is only read.
+func AttachBaselineDelta(store Store, entry *Entry) error {
+	entries, err := store.List()
+	if err != nil {
+		return err
+	}
+	baseline, ok := FindBaseline(entries, Repository(entry.Metadata.Image))
+	if !ok || baseline.ID == entry.Metadata.ID {
+		return nil
+	}
+	delta := NewBaselineDelta(entry.Metadata.Summary, baseline)
+	entry.Metadata.BaselineDelta = &delta
+	return nil
+}
@@ -0,0 +1,684 @@
+package history
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	metadataBucket = []byte("metadata")
+	entriesBucket  = []byte("entries")
+	exportsBucket  = []byte("exports")
+	blobsBucket    = []byte("blobs")
+	// quarantineBucket is only created when fsck quarantines records.
+	quarantineBucket = []byte("quarantine")
+)
+
+const boltOpenTimeout = 5 * time.Second
+
+// BoltStore keeps history in a single embedded bbolt database file. Metadata
+// lives in its own bucket so listing never decodes analysis results, and
+// results live in a blobs bucket keyed by digest so entries can share them.
+type BoltStore struct {
+	db      *bolt.DB
+	options Options
+}
+
+func NewBoltStore(path string, options Options) (*BoltStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(path, 0o644, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{metadataBucket, entriesBucket, exportsBucket, blobsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	options.Retention = options.Retention.normalized()
+	if options.Compression == "" {
+		options.Compression = DefaultCompression
+	}
+	return &BoltStore{
+		db:      db,
+		options: options,
+	}, nil
+}
+
+func (s *BoltStore) Save(entry Entry) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if _, err := s.putEntryTx(tx, entry); err != nil {
+			return err
+		}
+		return s.pruneTx(tx, entry.Metadata.ID)
+	})
+}
+
+// putEntryTx stores the result blob if it is new, then writes the encoded
+// entry and its Metadata, with sizes and blob digest filled in, in the
+// caller's transaction. A blob the entry no longer references is released.
+func (s *BoltStore) putEntryTx(tx *bolt.Tx, entry Entry) (Metadata, error) {
+	key := []byte(entry.Metadata.ID)
+	previous := metadataDigestTx(tx, key)
+
+	entry, digest, result := splitResult(entry)
+	var blobBytes int64
+	if digest != "" {
+		blobs := tx.Bucket(blobsBucket)
+		blob := blobs.Get([]byte(digest))
+		if blob == nil {
+			compressed, err := compress(result, s.options.Compression)
+			if err != nil {
+				return Metadata{}, err
+			}
+			if err := blobs.Put([]byte(digest), compressed); err != nil {
+				return Metadata{}, err
+			}
+			blob = compressed
+		}
+		blobBytes = int64(len(blob))
+	}
+
+	entryData, logicalBytes, err := encodeEntry(entry, s.options.Compression)
+	if err != nil {
+		return Metadata{}, err
+	}
+	metadata := entry.Metadata
+	metadata.StoredBytes = int64(len(entryData)) + blobBytes
+	metadata.LogicalBytes = logicalBytes + int64(len(result))
+	metadataData, err := json.Marshal(metadata)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	if err := tx.Bucket(entriesBucket).Put(key, entryData); err != nil {
+		return Metadata{}, err
+	}
+	if err := tx.Bucket(metadataBucket).Put(key, metadataData); err != nil {
+		return Metadata{}, err
+	}
+	if previous != digest {
+		references, err := blobReferencesTx(tx)
+		if err != nil {
+			return Metadata{}, err
+		}
+		if err := releaseBlobTx(tx, references, previous); err != nil {
+			return Metadata{}, err
+		}
+	}
+	return metadata, nil
+}
+
+func (s *BoltStore) List() ([]Metadata, error) {
+	var results []Metadata
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		results, err = listMetadataTx(tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].CompletedAt.After(results[j].CompletedAt)
+	})
+	return results, nil
+}
+
+func (s *BoltStore) Get(id string) (Entry, error) {
+	var entry Entry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		entry, err = getEntryTx(tx, id)
+		return err
+	})
+	if err != nil {
+		return Entry{}, err
+	}
+	return entry, nil
+}
+
+// getEntryTx decodes an entry, attaches its result blob and fills in the
+// store-managed size fields.
+func getEntryTx(tx *bolt.Tx, id string) (Entry, error) {
+	data := tx.Bucket(entriesBucket).Get([]byte(id))
+	if data == nil {
+		return Entry{}, ErrNotFound
+	}
+	entry, logicalBytes, err := decodeEntry(data)
+	if err != nil {
+		return Entry{}, err
+	}
+	entry.Metadata.StoredBytes = int64(len(data))
+	entry.Metadata.LogicalBytes = logicalBytes
+	if digest := entry.Metadata.ResultDigest; digest != "" {
+		blob := tx.Bucket(blobsBucket).Get([]byte(digest))
+		if blob == nil {
+			return Entry{}, fmt.Errorf("result blob %s is missing", digest)
+		}
+		result, err := decompress(blob)
+		if err != nil {
+			return Entry{}, err
+		}
+		entry.Result = result
+		entry.Metadata.StoredBytes += int64(len(blob))
+		entry.Metadata.LogicalBytes += int64(len(result))
+	}
+	return entry, nil
+}
+
+func (s *BoltStore) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		references, err := blobReferencesTx(tx)
+		if err != nil {
+			return err
+		}
+		return deleteEntryTx(tx, references, id)
+	})
+}
+
+func (s *BoltStore) DeleteAll() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{metadataBucket, entriesBucket, exportsBucket, blobsBucket} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) SaveExport(id string, filename string, data []byte) error {
+	if err := validateExportFilename(filename); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(exportsBucket).Put(exportKey(id, filename), data)
+	})
+}
+
+func (s *BoltStore) GetExport(id string, filename string) ([]byte, error) {
+	if err := validateExportFilename(filename); err != nil {
+		return nil, err
+	}
+	var data []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		stored := tx.Bucket(exportsBucket).Get(exportKey(id, filename))
+		if stored == nil {
+			return ErrExportNotFound
+		}
+		data = append([]byte(nil), stored...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *BoltStore) DeleteExport(id string, filename string) error {
+	if err := validateExportFilename(filename); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		exports := tx.Bucket(exportsBucket)
+		if exports.Get(exportKey(id, filename)) == nil {
+			return ErrExportNotFound
+		}
+		return exports.Delete(exportKey(id, filename))
+	})
+}
+
+func (s *BoltStore) ListExports(id string) ([]string, error) {
+	filenames := []string{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := exportKey(id, "")
+		cursor := tx.Bucket(exportsBucket).Cursor()
+		for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+			filenames = append(filenames, string(key[len(prefix):]))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return filenames, nil
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltStore) Update(id string, update func(metadata *Metadata) error) (Metadata, error) {
+	return s.UpdateEntry(id, func(entry *Entry) error {
+		return update(&entry.Metadata)
+	})
+}
+
+func (s *BoltStore) UpdateEntry(id string, update func(entry *Entry) error) (Metadata, error) {
+	var updated Metadata
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		entry, err := getEntryTx(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := update(&entry); err != nil {
+			return err
+		}
+		entry.Metadata.ID = id
+
+		updated, err = s.putEntryTx(tx, entry)
+		return err
+	})
+	if err != nil {
+		return Metadata{}, err
+	}
+	return updated, nil
+}
+
+func (s *BoltStore) Stats() (Stats, error) {
+	entries, err := s.List()
+	if err != nil {
+		return Stats{}, err
+	}
+	info, err := os.Stat(s.db.Path())
+	if err != nil {
+		return Stats{}, err
+	}
+	blobSizes := make(map[string]int64)
+	err = s.db.View(func(tx *bolt.Tx) error {
+		blobs := tx.Bucket(blobsBucket)
+		for _, entry := range entries {
+			if blob := blobs.Get([]byte(entry.ResultDigest)); entry.ResultDigest != "" && blob != nil {
+				blobSizes[entry.ResultDigest] = int64(len(blob))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return Stats{}, err
+	}
+	return buildStats(entries, info.Size(), blobSizes, s.options), nil
+}
+
+// MigrateSchema checks every stored entry against the current schema and,
+// unless dryRun is set, rewrites outdated ones in a single transaction.
+// Entries that can't be decoded, and entry or metadata records missing
+// their counterpart, are reported as failures and left untouched.
+func (s *BoltStore) MigrateSchema(dryRun bool) (SchemaReport, error) {
+	report := newSchemaReport(dryRun)
+	run := func(tx *bolt.Tx) error {
+		entries := tx.Bucket(entriesBucket)
+		metadata := tx.Bucket(metadataBucket)
+		var outdated []string
+		err := entries.ForEach(func(key, value []byte) error {
+			id := string(key)
+			report.Scanned++
+			entry, _, version, err := decodeEntryVersion(value)
+			if err != nil {
+				report.fail(id, version, err)
+				return nil
+			}
+			if entry.Metadata.ID != id {
+				report.fail(id, version, fmt.Errorf("entry is stored under a different id (%s)", entry.Metadata.ID))
+				return nil
+			}
+			if metadata.Get(key) == nil {
+				report.fail(id, version, fmt.Errorf("metadata record is missing"))
+				return nil
+			}
+			report.Versions[version]++
+			if version < CurrentSchemaVersion {
+				outdated = append(outdated, id)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = metadata.ForEach(func(key, value []byte) error {
+			if entries.Get(key) == nil {
+				report.fail(string(key), 0, fmt.Errorf("entry record is missing"))
+			} else if !json.Valid(value) {
+				report.fail(string(key), 0, fmt.Errorf("metadata record is unreadable"))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		report.Outdated = append(report.Outdated, outdated...)
+		if dryRun {
+			return nil
+		}
+		for _, id := range outdated {
+			entry, err := getEntryTx(tx, id)
+			if err != nil {
+				report.fail(id, 0, err)
+				continue
+			}
+			if _, err := s.putEntryTx(tx, entry); err != nil {
+				return err
+			}
+			report.Migrated = append(report.Migrated, id)
+		}
+		return nil
+	}
+
+	var err error
+	if dryRun {
+		err = s.db.View(run)
+	} else {
+		err = s.db.Update(run)
+	}
+	if err != nil {
+		return SchemaReport{}, err
+	}
+	return report, nil
+}
+
+// Fsck checks that every entry decodes and has a metadata record, that
+// every metadata record and export belongs to an entry, and that every
+// result blob is referenced. Quarantined records are moved into a separate
+// bucket keyed by their original bucket and key.
+func (s *BoltStore) Fsck(mode FsckMode) (FsckReport, error) {
+	report := newFsckReport(mode)
+	run := func(tx *bolt.Tx) error {
+		var quarantine *bolt.Bucket
+		if mode == FsckModeQuarantine {
+			var err error
+			if quarantine, err = tx.CreateBucketIfNotExists(quarantineBucket); err != nil {
+				return err
+			}
+		}
+		// remove deletes keys from a bucket, copying them into the
+		// quarantine bucket first when quarantining.
+		remove := func(bucketName []byte, keys ...[]byte) (string, error) {
+			bucket := tx.Bucket(bucketName)
+			for _, key := range keys {
+				if quarantine != nil {
+					if value := bucket.Get(key); value != nil {
+						if err := quarantine.Put([]byte(string(bucketName)+"/"+string(key)), append([]byte(nil), value...)); err != nil {
+							return "", err
+						}
+					}
+				}
+				if err := bucket.Delete(key); err != nil {
+					return "", err
+				}
+			}
+			if quarantine != nil {
+				report.QuarantinePath = string(quarantineBucket)
+				return fsckActionQuarantined, nil
+			}
+			return fsckActionRemoved, nil
+		}
+		exportKeys := func(id string) [][]byte {
+			var keys [][]byte
+			prefix := exportKey(id, "")
+			cursor := tx.Bucket(exportsBucket).Cursor()
+			for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+				keys = append(keys, append([]byte(nil), key...))
+			}
+			return keys
+		}
+
+		entries := tx.Bucket(entriesBucket)
+		metadata := tx.Bucket(metadataBucket)
+		var ids []string
+		entries.ForEach(func(key, _ []byte) error {
+			ids = append(ids, string(key))
+			return nil
+		})
+
+		valid := make(map[string]bool, len(ids))
+		referenced := make(map[string]bool)
+		for _, id := range ids {
+			key := []byte(id)
+			entry, err := getEntryTx(tx, id)
+			if err == nil && entry.Metadata.ID != id {
+				err = fmt.Errorf("entry is stored under a different id (%s)", entry.Metadata.ID)
+			}
+			if err != nil {
+				report.add(FsckUnreadableEntry, id, "entries/"+id, err.Error(), func() (string, error) {
+					if _, err := remove(exportsBucket, exportKeys(id)...); err != nil {
+						return "", err
+					}
+					if _, err := remove(metadataBucket, key); err != nil {
+						return "", err
+					}
+					return remove(entriesBucket, key)
+				})
+				continue
+			}
+
+			valid[id] = true
+			referenced[entry.Metadata.ResultDigest] = true
+			var stored Metadata
+			if value := metadata.Get(key); value == nil || json.Unmarshal(value, &stored) != nil {
+				report.add(FsckUnindexedEntry, id, "metadata/"+id, "metadata record is missing or unreadable", func() (string, error) {
+					if _, err := s.putEntryTx(tx, entry); err != nil {
+						return "", err
+					}
+					return fsckActionReindexed, nil
+				})
+			}
+		}
+
+		var orphanMetadata []string
+		metadata.ForEach(func(key, _ []byte) error {
+			if entries.Get(key) == nil {
+				orphanMetadata = append(orphanMetadata, string(key))
+			}
+			return nil
+		})
+		for _, id := range orphanMetadata {
+			report.add(FsckMissingEntry, id, "metadata/"+id, "metadata record has no entry", func() (string, error) {
+				return remove(metadataBucket, []byte(id))
+			})
+		}
+
+		orphanExports := make(map[string][][]byte)
+		tx.Bucket(exportsBucket).ForEach(func(key, _ []byte) error {
+			id, _, _ := strings.Cut(string(key), "/")
+			if entries.Get([]byte(id)) == nil {
+				orphanExports[id] = append(orphanExports[id], append([]byte(nil), key...))
+			}
+			return nil
+		})
+		for id, keys := range orphanExports {
+			report.add(FsckOrphanExports, id, "exports/"+id, fmt.Sprintf("%d export files without an entry", len(keys)), func() (string, error) {
+				return remove(exportsBucket, keys...)
+			})
+		}
+
+		var orphanBlobs []string
+		tx.Bucket(blobsBucket).ForEach(func(key, _ []byte) error {
+			if !referenced[string(key)] {
+				orphanBlobs = append(orphanBlobs, string(key))
+			}
+			return nil
+		})
+		for _, digest := range orphanBlobs {
+			if mode == FsckModeReport && referencedByMetadataTx(tx, digest) {
+				continue
+			}
+			report.add(FsckOrphanBlob, "", "blobs/"+digest, digest, func() (string, error) {
+				return remove(blobsBucket, []byte(digest))
+			})
+		}
+		return nil
+	}
+
+	var err error
+	if mode == FsckModeReport {
+		err = s.db.View(run)
+	} else {
+		err = s.db.Update(run)
+	}
+	if err != nil {
+		return FsckReport{}, err
+	}
+	report.sort()
+	return report, nil
+}
+
+// referencedByMetadataTx reports whether any metadata record, including
+// those of entries that fail to decode, refers to the blob.
+func referencedByMetadataTx(tx *bolt.Tx, digest string) bool {
+	metadata, err := listMetadataTx(tx)
+	if err != nil {
+		return false
+	}
+	for _, entry := range metadata {
+		if entry.ResultDigest == digest {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *BoltStore) pruneTx(tx *bolt.Tx, keep string) error {
+	metadata, err := listMetadataTx(tx)
+	if err != nil {
+		return err
+	}
+
+	// Each entry is charged an equal share of a shared result blob.
+	references := make(map[string]int64)
+	for _, entry := range metadata {
+		references[entry.ResultDigest]++
+	}
+	sizes := make(map[string]int64, len(metadata))
+	entries := tx.Bucket(entriesBucket)
+	blobs := tx.Bucket(blobsBucket)
+	for _, entry := range metadata {
+		sizes[entry.ID] = int64(len(entries.Get([]byte(entry.ID))))
+		if entry.ResultDigest != "" {
+			sizes[entry.ID] += int64(len(blobs.Get([]byte(entry.ResultDigest)))) / references[entry.ResultDigest]
+		}
+	}
+
+	for _, id := range s.options.Retention.Select(metadata, sizes, time.Now(), keep) {
+		if err := deleteEntryTx(tx, references, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listMetadataTx decodes every Metadata record. Records written before sizes
+// were tracked always belong to uncompressed entries, so their logical size
+// is the stored size.
+func listMetadataTx(tx *bolt.Tx) ([]Metadata, error) {
+	results := []Metadata{}
+	entries := tx.Bucket(entriesBucket)
+	err := tx.Bucket(metadataBucket).ForEach(func(key, value []byte) error {
+		var metadata Metadata
+		if err := json.Unmarshal(value, &metadata); err != nil {
+			return nil
+		}
+		if metadata.StoredBytes == 0 {
+			if data := entries.Get(key); data != nil && !isCompressed(data) {
+				metadata.StoredBytes = int64(len(data))
+				metadata.LogicalBytes = metadata.StoredBytes
+			}
+		}
+		results = append(results, metadata)
+		return nil
+	})
+	return results, err
+}
+
+// deleteEntryTx removes an entry and its exports. references counts the
+// metadata records referring to each blob; it is updated for the removed
+// entry so callers deleting several entries only count once.
+func deleteEntryTx(tx *bolt.Tx, references map[string]int64, id string) error {
+	key := []byte(id)
+	digest := metadataDigestTx(tx, key)
+	if err := tx.Bucket(entriesBucket).Delete(key); err != nil {
+		return err
+	}
+	if err := tx.Bucket(metadataBucket).Delete(key); err != nil {
+		return err
+	}
+	if digest != "" && references[digest] > 0 {
+		references[digest]--
+	}
+	if err := releaseBlobTx(tx, references, digest); err != nil {
+		return err
+	}
+
+	exports := tx.Bucket(exportsBucket)
+	prefix := exportKey(id, "")
+	var keys [][]byte
+	cursor := exports.Cursor()
+	for exportName, _ := cursor.Seek(prefix); exportName != nil && bytes.HasPrefix(exportName, prefix); exportName, _ = cursor.Next() {
+		keys = append(keys, append([]byte(nil), exportName...))
+	}
+	for _, exportName := range keys {
+		if err := exports.Delete(exportName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func metadataDigestTx(tx *bolt.Tx, key []byte) string {
+	var metadata Metadata
+	if data := tx.Bucket(metadataBucket).Get(key); data != nil {
+		json.Unmarshal(data, &metadata)
+	}
+	return metadata.ResultDigest
+}
+
+// blobReferencesTx counts the metadata records referring to each result
+// blob.
+func blobReferencesTx(tx *bolt.Tx) (map[string]int64, error) {
+	metadata, err := listMetadataTx(tx)
+	if err != nil {
+		return nil, err
+	}
+	references := make(map[string]int64)
+	for _, entry := range metadata {
+		references[entry.ResultDigest]++
+	}
+	return references, nil
+}
+
+// releaseBlobTx deletes a result blob once references shows no entry
+// refers to it.
+func releaseBlobTx(tx *bolt.Tx, references map[string]int64, digest string) error {
+	if digest == "" || references[digest] > 0 {
+		return nil
+	}
+	return tx.Bucket(blobsBucket).Delete([]byte(digest))
+}
+
+func exportKey(id string, filename string) []byte {
+	return []byte(id + "/" + filename)
+}
@@ -0,0 +1,418 @@
+package history
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	bundleVersion      = 1
+	bundleManifestName = "manifest.json"
+	bundleEntriesDir   = "entries"
+	// An imported bundle is validated in memory before anything is saved,
+	// so its files are bounded one by one, in number and in total
+	// decompressed size.
+	maxBundleFileBytes  = 512 << 20
+	maxBundleTotalBytes = 1 << 30
+	maxBundleFiles      = 10000
+)
+
+const (
+	ConflictRename    = "rename"
+	ConflictSkip      = "skip"
+	ConflictOverwrite = "overwrite"
+)
+
+var ErrInvalidBundle = errors.New("invalid history bundle")
+
+// BundleManifest lists every entry in a bundle and the checksum of every file
+// belonging to it.
+type BundleManifest struct {
+	Version   int                   `json:"version"`
+	CreatedAt time.Time             `json:"createdAt"`
+	Entries   []BundleManifestEntry `json:"entries"`
+}
+
+type BundleManifestEntry struct {
+	ID          string       `json:"id"`
+	Image       string       `json:"image"`
+	CompletedAt time.Time    `json:"completedAt"`
+	Files       []BundleFile `json:"files"`
+}
+
+type BundleFile struct {
+	Path      string `json:"path"`
+	SizeBytes int64  `json:"sizeBytes"`
+	SHA256    string `json:"sha256"`
+}
+
+type ImportOptions struct {
+	// Conflict decides what happens when an imported ID already exists:
+	// rename assigns a new ID from NewID, skip keeps the existing entry and
+	// overwrite replaces it.
+	Conflict string
+	NewID    func() string
+	// RenameExport returns the name an export is stored under once its
+	// entry has been renamed, since export filenames carry the entry ID.
+	// Without it exports keep their names.
+	RenameExport func(filename string, originalID string, newID string) string
+}
+
+type ImportedEntry struct {
+	ID         string `json:"id"`
+	OriginalID string `json:"originalId"`
+	Image      string `json:"image"`
+	Exports    int    `json:"exports"`
+}
+
+type ImportResult struct {
+	Imported []ImportedEntry `json:"imported"`
+	Skipped  []string        `json:"skipped"`
+}
+
+func ParseConflict(value string) (string, error) {
+	switch value = strings.ToLower(strings.TrimSpace(value)); value {
+	case "":
+		return ConflictRename, nil
+	case ConflictRename, ConflictSkip, ConflictOverwrite:
+		return value, nil
+	default:
+		return "", fmt.Errorf("onConflict must be rename, skip or overwrite")
+	}
+}
+
+// WriteBundle writes the given entries, with their stored exports, as a
+// gzip-compressed tar archive. The manifest is written last so it can carry
+// the checksum of every file before it.
+func WriteBundle(writer io.Writer, store Store, ids []string) (BundleManifest, error) {
+	manifest := BundleManifest{
+		Version:   bundleVersion,
+		CreatedAt: time.Now().UTC(),
+		Entries:   make([]BundleManifestEntry, 0, len(ids)),
+	}
+
+	compressed := gzip.NewWriter(writer)
+	archive := tar.NewWriter(compressed)
+	for _, id := range ids {
+		entry, err := store.Get(id)
+		if err != nil {
+			return BundleManifest{}, fmt.Errorf("failed to read entry %s: %w", id, err)
+		}
+		entry.Metadata.StoredBytes = 0
+		entry.Metadata.LogicalBytes = 0
+		entry.Metadata.ResultDigest = ""
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return BundleManifest{}, err
+		}
+
+		item := BundleManifestEntry{
+			ID:          entry.Metadata.ID,
+			Image:       entry.Metadata.Image,
+			CompletedAt: entry.Metadata.CompletedAt,
+		}
+		file, err := writeBundleFile(archive, path.Join(bundleEntriesDir, id, entryFileName), data, manifest.CreatedAt)
+		if err != nil {
+			return BundleManifest{}, err
+		}
+		item.Files = append(item.Files, file)
+
+		filenames, err := store.ListExports(id)
+		if err != nil {
+			return BundleManifest{}, fmt.Errorf("failed to list exports for %s: %w", id, err)
+		}
+		for _, filename := range filenames {
+			exportData, err := store.GetExport(id, filename)
+			if err != nil {
+				return BundleManifest{}, fmt.Errorf("failed to read export %s for %s: %w", filename, id, err)
+			}
+			file, err := writeBundleFile(archive, path.Join(bundleEntriesDir, id, exportsDirName, filename), exportData, manifest.CreatedAt)
+			if err != nil {
+				return BundleManifest{}, err
+			}
+			item.Files = append(item.Files, file)
+		}
+		manifest.Entries = append(manifest.Entries, item)
+	}
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return BundleManifest{}, err
+	}
+	if _, err := writeBundleFile(archive, bundleManifestName, manifestData, manifest.CreatedAt); err != nil {
+		return BundleManifest{}, err
+	}
+	if err := archive.Close(); err != nil {
+		return BundleManifest{}, err
+	}
+	if err := compressed.Close(); err != nil {
+		return BundleManifest{}, err
+	}
+	return manifest, nil
+}
+
+func writeBundleFile(archive *tar.Writer, name string, data []byte, modTime time.Time) (BundleFile, error) {
+	header := &tar.Header{
+		Name:     name,
+		Mode:     0o644,
+		Size:     int64(len(data)),
+		ModTime:  modTime,
+		Typeflag: tar.TypeReg,
+	}
+	if err := archive.WriteHeader(header); err != nil {
+		return BundleFile{}, err
+	}
+	if _, err := archive.Write(data); err != nil {
+		return BundleFile{}, err
+	}
+	sum := sha256.Sum256(data)
+	return BundleFile{Path: name, SizeBytes: int64(len(data)), SHA256: hex.EncodeToString(sum[:])}, nil
+}
+
+// ImportBundle validates a bundle written by WriteBundle and saves its
+// entries and exports into store. Nothing is imported unless every file
+// matches the manifest.
+func ImportBundle(reader io.Reader, store Store, options ImportOptions) (ImportResult, error) {
+	manifest, files, err := readBundle(reader)
+	if err != nil {
+		return ImportResult{}, err
+	}
+
+	type pendingEntry struct {
+		entry   Entry
+		exports map[string][]byte
+	}
+	pending := make([]pendingEntry, 0, len(manifest.Entries))
+	for _, item := range manifest.Entries {
+		entryPath := path.Join(bundleEntriesDir, item.ID, entryFileName)
+		upgraded, _, err := upgradeEntryJSON(files[entryPath])
+		if err != nil {
+			return ImportResult{}, fmt.Errorf("%w: %s: %v", ErrInvalidBundle, entryPath, err)
+		}
+		var entry Entry
+		if err := json.Unmarshal(upgraded, &entry); err != nil {
+			return ImportResult{}, fmt.Errorf("%w: %s is not a history entry", ErrInvalidBundle, entryPath)
+		}
+		if entry.Metadata.ID != item.ID || len(entry.Result) == 0 {
+			return ImportResult{}, fmt.Errorf("%w: %s does not match the manifest", ErrInvalidBundle, entryPath)
+		}
+
+		exports := make(map[string][]byte)
+		exportsPrefix := path.Join(bundleEntriesDir, item.ID, exportsDirName) + "/"
+		for _, file := range item.Files {
+			filename, ok := strings.CutPrefix(file.Path, exportsPrefix)
+			if !ok {
+				continue
+			}
+			if err := validateExportFilename(filename); err != nil {
+				return ImportResult{}, fmt.Errorf("%w: %v", ErrInvalidBundle, err)
+			}
+			exports[filename] = files[file.Path]
+		}
+		pending = append(pending, pendingEntry{entry: entry, exports: exports})
+	}
+
+	existing, err := store.List()
+	if err != nil {
+		return ImportResult{}, err
+	}
+	taken := make(map[string]Metadata, len(existing))
+	// baselines maps each repository to its baseline entry, so imports keep
+	// the one-baseline-per-repository rule SetBaseline enforces.
+	baselines := make(map[string]string)
+	for _, metadata := range existing {
+		taken[metadata.ID] = metadata
+		if metadata.Baseline {
+			baselines[Repository(metadata.Image)] = metadata.ID
+		}
+	}
+
+	// Save oldest first so retention in the destination keeps the newest.
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].entry.Metadata.CompletedAt.Before(pending[j].entry.Metadata.CompletedAt)
+	})
+
+	result := ImportResult{Imported: []ImportedEntry{}, Skipped: []string{}}
+	for _, item := range pending {
+		entry := item.entry
+		originalID := entry.Metadata.ID
+		// stale lists the replaced entry's exports; they are removed only
+		// once the new entry has been saved over it.
+		var stale []string
+		if replaced, ok := taken[originalID]; ok {
+			switch options.Conflict {
+			case ConflictSkip:
+				result.Skipped = append(result.Skipped, originalID)
+				continue
+			case ConflictOverwrite:
+				if stale, err = store.ListExports(originalID); err != nil {
+					return result, fmt.Errorf("failed to replace entry %s: %w", originalID, err)
+				}
+				if repository := Repository(replaced.Image); baselines[repository] == originalID {
+					delete(baselines, repository)
+				}
+			default:
+				if options.NewID == nil {
+					return result, fmt.Errorf("entry %s already exists", originalID)
+				}
+				entry.Metadata.ID = options.NewID()
+			}
+		}
+
+		// A bundle's baseline yields to the one the destination already has.
+		if entry.Metadata.Baseline {
+			repository := Repository(entry.Metadata.Image)
+			if _, ok := baselines[repository]; ok {
+				entry.Metadata.Baseline = false
+			} else {
+				baselines[repository] = entry.Metadata.ID
+			}
+		}
+
+		if err := store.Save(entry); err != nil {
+			return result, fmt.Errorf("failed to import entry %s: %w", originalID, err)
+		}
+		filenames := make([]string, 0, len(item.exports))
+		for filename := range item.exports {
+			filenames = append(filenames, filename)
+		}
+		sort.Strings(filenames)
+		saved := make(map[string]bool, len(filenames))
+		for _, filename := range filenames {
+			target := filename
+			if entry.Metadata.ID != originalID && options.RenameExport != nil {
+				target = options.RenameExport(filename, originalID, entry.Metadata.ID)
+			}
+			if err := store.SaveExport(entry.Metadata.ID, target, item.exports[filename]); err != nil {
+				return result, fmt.Errorf("failed to import export %s for %s: %w", filename, originalID, err)
+			}
+			saved[target] = true
+		}
+		for _, filename := range stale {
+			if saved[filename] {
+				continue
+			}
+			if err := store.DeleteExport(originalID, filename); err != nil && !errors.Is(err, ErrExportNotFound) {
+				return result, fmt.Errorf("failed to remove replaced export %s for %s: %w", filename, originalID, err)
+			}
+		}
+		taken[entry.Metadata.ID] = entry.Metadata
+		result.Imported = append(result.Imported, ImportedEntry{
+			ID:         entry.Metadata.ID,
+			OriginalID: originalID,
+			Image:      entry.Metadata.Image,
+			Exports:    len(filenames),
+		})
+	}
+	return result, nil
+}
+
+// readBundle reads every file in the archive and checks it against the
+// manifest: each listed file must be present with a matching size and
+// checksum, and no unlisted files may appear.
+func readBundle(reader io.Reader) (BundleManifest, map[string][]byte, error) {
+	compressed, err := gzip.NewReader(reader)
+	if err != nil {
+		return BundleManifest{}, nil, fmt.Errorf("%w: not a gzip archive", ErrInvalidBundle)
+	}
+	defer compressed.Close()
+
+	files := make(map[string][]byte)
+	var totalBytes int64
+	archive := tar.NewReader(compressed)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return BundleManifest{}, nil, fmt.Errorf("%w: %w", ErrInvalidBundle, err)
+		}
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+		name := path.Clean(header.Name)
+		if header.Typeflag != tar.TypeReg || name != header.Name || strings.HasPrefix(name, "../") || path.IsAbs(name) {
+			return BundleManifest{}, nil, fmt.Errorf("%w: unexpected file %q", ErrInvalidBundle, header.Name)
+		}
+		if _, ok := files[name]; ok {
+			return BundleManifest{}, nil, fmt.Errorf("%w: duplicate file %q", ErrInvalidBundle, name)
+		}
+		if len(files) >= maxBundleFiles {
+			return BundleManifest{}, nil, fmt.Errorf("%w: more than %d files", ErrInvalidBundle, maxBundleFiles)
+		}
+		limit := min(int64(maxBundleFileBytes), maxBundleTotalBytes-totalBytes)
+		data, err := io.ReadAll(io.LimitReader(archive, limit+1))
+		if err != nil {
+			return BundleManifest{}, nil, fmt.Errorf("%w: %w", ErrInvalidBundle, err)
+		}
+		if int64(len(data)) > limit {
+			if limit < maxBundleFileBytes {
+				return BundleManifest{}, nil, fmt.Errorf("%w: more than %d bytes uncompressed", ErrInvalidBundle, maxBundleTotalBytes)
+			}
+			return BundleManifest{}, nil, fmt.Errorf("%w: %s is too large", ErrInvalidBundle, name)
+		}
+		totalBytes += int64(len(data))
+		files[name] = data
+	}
+
+	manifestData, ok := files[bundleManifestName]
+	if !ok {
+		return BundleManifest{}, nil, fmt.Errorf("%w: missing %s", ErrInvalidBundle, bundleManifestName)
+	}
+	var manifest BundleManifest
+	if err := json.Unmarshal(manifestData, &manifest); err != nil {
+		return BundleManifest{}, nil, fmt.Errorf("%w: unreadable manifest", ErrInvalidBundle)
+	}
+	if manifest.Version != bundleVersion {
+		return BundleManifest{}, nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidBundle, manifest.Version)
+	}
+
+	listed := map[string]bool{bundleManifestName: true}
+	ids := make(map[string]bool, len(manifest.Entries))
+	for _, item := range manifest.Entries {
+		if item.ID == "" || item.ID != path.Base(item.ID) || strings.HasPrefix(item.ID, ".") || ids[item.ID] {
+			return BundleManifest{}, nil, fmt.Errorf("%w: invalid entry ID %q", ErrInvalidBundle, item.ID)
+		}
+		ids[item.ID] = true
+
+		entryPrefix := path.Join(bundleEntriesDir, item.ID) + "/"
+		hasEntry := false
+		for _, file := range item.Files {
+			if !strings.HasPrefix(file.Path, entryPrefix) {
+				return BundleManifest{}, nil, fmt.Errorf("%w: %s is outside entry %s", ErrInvalidBundle, file.Path, item.ID)
+			}
+			data, ok := files[file.Path]
+			if !ok {
+				return BundleManifest{}, nil, fmt.Errorf("%w: missing %s", ErrInvalidBundle, file.Path)
+			}
+			sum := sha256.Sum256(data)
+			if int64(len(data)) != file.SizeBytes || hex.EncodeToString(sum[:]) != strings.ToLower(file.SHA256) {
+				return BundleManifest{}, nil, fmt.Errorf("%w: checksum mismatch for %s", ErrInvalidBundle, file.Path)
+			}
+			listed[file.Path] = true
+			if file.Path == entryPrefix+entryFileName {
+				hasEntry = true
+			}
+		}
+		if !hasEntry {
+			return BundleManifest{}, nil, fmt.Errorf("%w: entry %s has no %s", ErrInvalidBundle, item.ID, entryFileName)
+		}
+	}
+	for name := range files {
+		if !listed[name] {
+			return BundleManifest{}, nil, fmt.Errorf("%w: %s is not listed in the manifest", ErrInvalidBundle, name)
+		}
+	}
+	return manifest, files, nil
+}
@@ -0,0 +1,177 @@
+package history
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+const DefaultCompression = CompressionZstd
+
+const digestPrefix = "sha256:"
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// The zstd encoder and decoder are safe for concurrent EncodeAll and
+// DecodeAll calls, so one of each is shared by every store.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// ParseCompression validates a compression name, defaulting to zstd.
+func ParseCompression(value string) (string, error) {
+	switch value = strings.ToLower(strings.TrimSpace(value)); value {
+	case "":
+		return DefaultCompression, nil
+	case CompressionNone, CompressionGzip, CompressionZstd:
+		return value, nil
+	default:
+		return "", fmt.Errorf("unsupported history compression: %s", value)
+	}
+}
+
+// encodeEntry serializes an entry with the given compression and returns the
+// encoded bytes along with the size of the uncompressed JSON. Store-managed
+// size fields are cleared first since they describe the encoded form.
+func encodeEntry(entry Entry, compression string) ([]byte, int64, error) {
+	entry.SchemaVersion = CurrentSchemaVersion
+	entry.Metadata.StoredBytes = 0
+	entry.Metadata.LogicalBytes = 0
+
+	if compression == CompressionNone {
+		data, err := json.MarshalIndent(entry, "", "  ")
+		if err != nil {
+			return nil, 0, err
+		}
+		data = append(data, '\n')
+		return data, int64(len(data)), nil
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return nil, 0, err
+	}
+	compressed, err := compress(data, compression)
+	if err != nil {
+		return nil, 0, err
+	}
+	return compressed, int64(len(data)), nil
+}
+
+func compress(data []byte, compression string) ([]byte, error) {
+	switch compression {
+	case CompressionNone:
+		return data, nil
+	case CompressionGzip:
+		var buffer bytes.Buffer
+		writer := gzip.NewWriter(&buffer)
+		if _, err := writer.Write(data); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return buffer.Bytes(), nil
+	case CompressionZstd:
+		return zstdEncoder.EncodeAll(data, nil), nil
+	default:
+		return nil, fmt.Errorf("unsupported history compression: %s", compression)
+	}
+}
+
+// splitResult moves an entry's analysis result out so it can be stored once
+// in the blob area no matter how many entries share it. The result is
+// compacted before hashing so formatting differences don't defeat sharing.
+// It returns the entry referencing the blob, the blob digest and its content.
+func splitResult(entry Entry) (Entry, string, []byte) {
+	if len(entry.Result) == 0 {
+		entry.Metadata.ResultDigest = ""
+		return entry, "", nil
+	}
+
+	var compacted bytes.Buffer
+	data := []byte(entry.Result)
+	if err := json.Compact(&compacted, entry.Result); err == nil {
+		data = compacted.Bytes()
+	}
+	sum := sha256.Sum256(data)
+	digest := digestPrefix + hex.EncodeToString(sum[:])
+
+	entry.Result = nil
+	entry.Metadata.ResultDigest = digest
+	return entry, digest, data
+}
+
+func validDigest(digest string) bool {
+	value, ok := strings.CutPrefix(digest, digestPrefix)
+	if !ok || len(value) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(value)
+	return err == nil
+}
+
+// decodeEntry parses an entry written by encodeEntry, detecting the
+// compression from its magic bytes so plain JSON from older versions still
+// reads, and migrating it to the current schema. It also returns the
+// uncompressed size.
+func decodeEntry(data []byte) (Entry, int64, error) {
+	entry, logicalBytes, _, err := decodeEntryVersion(data)
+	return entry, logicalBytes, err
+}
+
+// decodeEntryVersion is decodeEntry that also reports the schema version the
+// entry was stored with.
+func decodeEntryVersion(data []byte) (Entry, int64, int, error) {
+	data, err := decompress(data)
+	if err != nil {
+		return Entry{}, 0, 0, err
+	}
+	logicalBytes := int64(len(data))
+	upgraded, version, err := upgradeEntryJSON(data)
+	if err != nil {
+		return Entry{}, 0, version, err
+	}
+	var entry Entry
+	if err := json.Unmarshal(upgraded, &entry); err != nil {
+		return Entry{}, 0, version, err
+	}
+	return entry, logicalBytes, version, nil
+}
+
+func decompress(data []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, zstdMagic):
+		return zstdDecoder.DecodeAll(data, nil)
+	case bytes.HasPrefix(data, gzipMagic):
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return io.ReadAll(reader)
+	default:
+		return data, nil
+	}
+}
+
+func isCompressed(data []byte) bool {
+	return bytes.HasPrefix(data, zstdMagic) || bytes.HasPrefix(data, gzipMagic)
+}
@@ -0,0 +1,35 @@
+package history
+
+import "deep-dive/compression"
+
+func (e *Entry) SetCompression(report compression.Report) {
+	e.Compression = &report
+	e.Metadata.Summary.EstimatedPullBytes = report.EstimatedPullBytes
+	e.Metadata.Summary.GzipSizeBytes = report.GzipBytes
+	e.Metadata.Summary.ZstdSizeBytes = report.ZstdBytes
+}
+
+// AttachCompression adds a compression report measured after the entry was
+// saved. A baseline delta taken at save time is refreshed so it includes
+// the estimated pull size.
+func AttachCompression(store Store, id string, report compression.Report) (Metadata, error) {
+	entries, err := store.List()
+	if err != nil {
+		return Metadata{}, err
+	}
+	return store.UpdateEntry(id, func(entry *Entry) error {
+		entry.SetCompression(report)
+		delta := entry.Metadata.BaselineDelta
+		if delta == nil {
+			return nil
+		}
+		for _, baseline := range entries {
+			if baseline.ID == delta.BaselineID {
+				refreshed := NewBaselineDelta(entry.Metadata.Summary, baseline)
+				entry.Metadata.BaselineDelta = &refreshed
+				break
+			}
+		}
+		return nil
+	})
+}
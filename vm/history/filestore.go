@@ -0,0 +1,903 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	entryFileName  = "entry.json"
+	exportsDirName = "exports"
+	indexFileName  = "index.json"
+	blobsDirName   = "blobs"
+)
+
+// entryFileNames lists every name an entry file may have, one per
+// compression. Older versions only ever wrote plain entry.json.
+var entryFileNames = map[string]string{
+	CompressionZstd: entryFileName + ".zst",
+	CompressionGzip: entryFileName + ".gz",
+	CompressionNone: entryFileName,
+}
+
+// FileStore keeps one directory per entry holding the entry file and any
+// stored exports, plus an index.json with every entry's Metadata. Analysis
+// results live in blobs/, named by digest and shared between entries.
+type FileStore struct {
+	dir     string
+	options Options
+	mu      sync.Mutex
+	// index caches every entry's Metadata so listing and pruning never need
+	// to parse full analysis results. It is persisted to index.json.
+	index map[string]Metadata
+	// indexStamp is index.json as last read or written. Another process
+	// sharing the directory changes it, which invalidates index.
+	indexStamp fileStamp
+}
+
+// fileStamp identifies a version of a file. The zero value stands for a
+// missing file.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func stampOf(info os.FileInfo) fileStamp {
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}
+}
+
+type indexFile struct {
+	Entries []Metadata `json:"entries"`
+}
+
+func NewFileStore(dir string, options Options) *FileStore {
+	options.Retention = options.Retention.normalized()
+	if options.Compression == "" {
+		options.Compression = DefaultCompression
+	}
+	return &FileStore{
+		dir:     dir,
+		options: options,
+	}
+}
+
+func (s *FileStore) BaseDir() string {
+	return s.dir
+}
+
+func (s *FileStore) EntryDir(id string) string {
+	return filepath.Join(s.dir, id)
+}
+
+// EntryPath returns where the entry is written with the configured
+// compression. An existing entry may use a different name; see findEntryPath.
+func (s *FileStore) EntryPath(id string) string {
+	return filepath.Join(s.EntryDir(id), entryFileNames[s.options.Compression])
+}
+
+// findEntryPath returns the entry file that exists for id, whichever
+// compression it was written with.
+func (s *FileStore) findEntryPath(id string) (string, error) {
+	for _, compression := range []string{CompressionZstd, CompressionGzip, CompressionNone} {
+		candidate := filepath.Join(s.EntryDir(id), entryFileNames[compression])
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	return "", ErrNotFound
+}
+
+func (s *FileStore) ExportsDir(id string) string {
+	return filepath.Join(s.EntryDir(id), exportsDirName)
+}
+
+func (s *FileStore) IndexPath() string {
+	return filepath.Join(s.dir, indexFileName)
+}
+
+func (s *FileStore) BlobsDir() string {
+	return filepath.Join(s.dir, blobsDirName)
+}
+
+// BlobPath fans blobs out by the first two hex digits of their digest.
+func (s *FileStore) BlobPath(digest string) string {
+	value := strings.TrimPrefix(digest, digestPrefix)
+	return filepath.Join(s.BlobsDir(), value[:2], value)
+}
+
+func (s *FileStore) Save(entry Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.loadIndexLocked(); err != nil {
+		return err
+	}
+	previous := s.index[entry.Metadata.ID].ResultDigest
+
+	metadata, err := s.writeEntryLocked(entry)
+	if err != nil {
+		return err
+	}
+	s.index[metadata.ID] = metadata
+	released := append(s.pruneLocked(metadata.ID), previous)
+	if err := s.writeIndexLocked(); err != nil {
+		return err
+	}
+	for _, digest := range released {
+		s.releaseBlobLocked(digest)
+	}
+	return nil
+}
+
+// writeEntryLocked stores the result blob if it is new, encodes the entry
+// with the configured compression, replaces any copy written with another
+// compression and returns the Metadata with its sizes and blob digest set.
+func (s *FileStore) writeEntryLocked(entry Entry) (Metadata, error) {
+	id := entry.Metadata.ID
+	entry, digest, result := splitResult(entry)
+	var blobBytes int64
+	if digest != "" {
+		var err error
+		if blobBytes, err = s.writeBlobLocked(digest, result); err != nil {
+			return Metadata{}, err
+		}
+	}
+
+	data, logicalBytes, err := encodeEntry(entry, s.options.Compression)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	runDir := s.EntryDir(id)
+	if err := os.MkdirAll(runDir, 0o755); err != nil {
+		return Metadata{}, err
+	}
+
+	tempFile, err := os.CreateTemp(runDir, "entry-*.tmp")
+	if err != nil {
+		return Metadata{}, err
+	}
+	if _, err := tempFile.Write(data); err != nil {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+		return Metadata{}, err
+	}
+	if err := tempFile.Close(); err != nil {
+		os.Remove(tempFile.Name())
+		return Metadata{}, err
+	}
+
+	target := s.EntryPath(id)
+	if err := os.Rename(tempFile.Name(), target); err != nil {
+		os.Remove(tempFile.Name())
+		return Metadata{}, err
+	}
+	for _, name := range entryFileNames {
+		if other := filepath.Join(runDir, name); other != target {
+			os.Remove(other)
+		}
+	}
+
+	metadata := entry.Metadata
+	metadata.StoredBytes = int64(len(data)) + blobBytes
+	metadata.LogicalBytes = logicalBytes + int64(len(result))
+	return metadata, nil
+}
+
+// writeBlobLocked stores a result under its digest unless an identical blob
+// already exists, and returns the blob's size on disk.
+func (s *FileStore) writeBlobLocked(digest string, data []byte) (int64, error) {
+	blobPath := s.BlobPath(digest)
+	if info, err := os.Stat(blobPath); err == nil {
+		return info.Size(), nil
+	}
+
+	compressed, err := compress(data, s.options.Compression)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0o755); err != nil {
+		return 0, err
+	}
+	tempFile, err := os.CreateTemp(filepath.Dir(blobPath), "blob-*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tempFile.Write(compressed); err != nil {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+		return 0, err
+	}
+	if err := tempFile.Close(); err != nil {
+		os.Remove(tempFile.Name())
+		return 0, err
+	}
+	if err := os.Rename(tempFile.Name(), blobPath); err != nil {
+		os.Remove(tempFile.Name())
+		return 0, err
+	}
+	return int64(len(compressed)), nil
+}
+
+// readBlobLocked returns a result blob's size on disk and its content.
+func (s *FileStore) readBlobLocked(digest string) (int64, []byte, error) {
+	if !validDigest(digest) {
+		return 0, nil, fmt.Errorf("invalid result digest: %q", digest)
+	}
+	data, err := os.ReadFile(s.BlobPath(digest))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil, fmt.Errorf("result blob %s is missing", digest)
+		}
+		return 0, nil, err
+	}
+	result, err := decompress(data)
+	if err != nil {
+		return 0, nil, err
+	}
+	return int64(len(data)), result, nil
+}
+
+// releaseBlobLocked removes a blob once no indexed entry references it.
+func (s *FileStore) releaseBlobLocked(digest string) {
+	if !validDigest(digest) || blobReferences(s.index, digest) > 0 {
+		return
+	}
+	blobPath := s.BlobPath(digest)
+	if err := os.Remove(blobPath); err == nil {
+		os.Remove(filepath.Dir(blobPath))
+	}
+}
+
+func blobReferences(index map[string]Metadata, digest string) int {
+	references := 0
+	for _, metadata := range index {
+		if metadata.ResultDigest == digest {
+			references++
+		}
+	}
+	return references
+}
+
+func (s *FileStore) Update(id string, update func(metadata *Metadata) error) (Metadata, error) {
+	return s.UpdateEntry(id, func(entry *Entry) error {
+		return update(&entry.Metadata)
+	})
+}
+
+func (s *FileStore) UpdateEntry(id string, update func(entry *Entry) error) (Metadata, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, err := s.readEntryLocked(id)
+	if err != nil {
+		return Metadata{}, err
+	}
+	if err := update(&entry); err != nil {
+		return Metadata{}, err
+	}
+	entry.Metadata.ID = id
+	metadata, err := s.writeEntryLocked(entry)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	if err := s.loadIndexLocked(); err != nil {
+		return Metadata{}, err
+	}
+	s.index[id] = metadata
+	if err := s.writeIndexLocked(); err != nil {
+		return Metadata{}, err
+	}
+	return metadata, nil
+}
+
+func (s *FileStore) Stats() (Stats, error) {
+	entries, err := s.List()
+	if err != nil {
+		return Stats{}, err
+	}
+	storedBytes, err := directorySize(s.dir)
+	if err != nil {
+		return Stats{}, err
+	}
+	blobSizes := make(map[string]int64)
+	for _, entry := range entries {
+		if _, ok := blobSizes[entry.ResultDigest]; ok || !validDigest(entry.ResultDigest) {
+			continue
+		}
+		if info, err := os.Stat(s.BlobPath(entry.ResultDigest)); err == nil {
+			blobSizes[entry.ResultDigest] = info.Size()
+		}
+	}
+	return buildStats(entries, storedBytes, blobSizes, s.options), nil
+}
+
+func (s *FileStore) List() ([]Metadata, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.loadIndexLocked(); err != nil {
+		return nil, err
+	}
+
+	results := make([]Metadata, 0, len(s.index))
+	for _, metadata := range s.index {
+		results = append(results, metadata)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].CompletedAt.After(results[j].CompletedAt)
+	})
+
+	return results, nil
+}
+
+func (s *FileStore) SaveExport(id string, filename string, data []byte) error {
+	if err := validateExportFilename(filename); err != nil {
+		return err
+	}
+	exportDir := s.ExportsDir(id)
+	if err := os.MkdirAll(exportDir, 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(exportDir, filename), data, 0o644)
+}
+
+func (s *FileStore) GetExport(id string, filename string) ([]byte, error) {
+	if err := validateExportFilename(filename); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(s.ExportsDir(id), filename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrExportNotFound
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *FileStore) DeleteExport(id string, filename string) error {
+	if err := validateExportFilename(filename); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(s.ExportsDir(id), filename)); err != nil {
+		if os.IsNotExist(err) {
+			return ErrExportNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *FileStore) ListExports(id string) ([]string, error) {
+	entries, err := os.ReadDir(s.ExportsDir(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	filenames := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			filenames = append(filenames, entry.Name())
+		}
+	}
+	sort.Strings(filenames)
+	return filenames, nil
+}
+
+func (s *FileStore) Close() error {
+	return nil
+}
+
+func (s *FileStore) Get(id string) (Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.readEntryLocked(id)
+}
+
+// readEntryLocked decodes the entry file, whatever its compression, and
+// fills in the store-managed size fields.
+func (s *FileStore) readEntryLocked(id string) (Entry, error) {
+	entryPath, err := s.findEntryPath(id)
+	if err != nil {
+		return Entry{}, err
+	}
+	data, err := os.ReadFile(entryPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Entry{}, ErrNotFound
+		}
+		return Entry{}, err
+	}
+
+	entry, logicalBytes, err := decodeEntry(data)
+	if err != nil {
+		return Entry{}, err
+	}
+	entry.Metadata.StoredBytes = int64(len(data))
+	entry.Metadata.LogicalBytes = logicalBytes
+	if entry.Metadata.ResultDigest != "" {
+		blobBytes, result, err := s.readBlobLocked(entry.Metadata.ResultDigest)
+		if err != nil {
+			return Entry{}, err
+		}
+		entry.Result = result
+		entry.Metadata.StoredBytes += blobBytes
+		entry.Metadata.LogicalBytes += int64(len(result))
+	}
+	return entry, nil
+}
+
+func (s *FileStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := s.EntryDir(id)
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+
+	if err := s.loadIndexLocked(); err != nil {
+		return err
+	}
+	digest := s.index[id].ResultDigest
+	delete(s.index, id)
+	if err := s.writeIndexLocked(); err != nil {
+		return err
+	}
+	s.releaseBlobLocked(digest)
+	return nil
+}
+
+func (s *FileStore) DeleteAll() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(s.dir, entry.Name())
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+
+	s.index = make(map[string]Metadata)
+	return s.writeIndexLocked()
+}
+
+// MigrateSchema checks every entry directory against the current schema
+// and, unless dryRun is set, rewrites outdated entries. Entries that can't be
+// decoded, and indexed entries whose file is gone, are reported as failures
+// and left untouched. Directories without an entry file are not entries and
+// are skipped.
+func (s *FileStore) MigrateSchema(dryRun bool) (SchemaReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report := newSchemaReport(dryRun)
+	if err := s.loadIndexLocked(); err != nil {
+		return SchemaReport{}, err
+	}
+	dirs, err := os.ReadDir(s.dir)
+	if err != nil && !os.IsNotExist(err) {
+		return SchemaReport{}, err
+	}
+
+	seen := make(map[string]bool, len(dirs))
+	for _, dir := range dirs {
+		id := dir.Name()
+		if !dir.IsDir() || id == blobsDirName {
+			continue
+		}
+		entryPath, err := s.findEntryPath(id)
+		if err != nil {
+			continue
+		}
+		seen[id] = true
+		report.Scanned++
+
+		data, err := os.ReadFile(entryPath)
+		if err != nil {
+			report.fail(id, 0, err)
+			continue
+		}
+		entry, _, version, err := decodeEntryVersion(data)
+		if err != nil {
+			report.fail(id, version, err)
+			continue
+		}
+		if entry.Metadata.ID != id {
+			report.fail(id, version, fmt.Errorf("entry is stored under a different id (%s)", entry.Metadata.ID))
+			continue
+		}
+		report.Versions[version]++
+		if version == CurrentSchemaVersion {
+			continue
+		}
+		report.Outdated = append(report.Outdated, id)
+		if dryRun {
+			continue
+		}
+
+		full, err := s.readEntryLocked(id)
+		if err != nil {
+			report.fail(id, version, err)
+			continue
+		}
+		metadata, err := s.writeEntryLocked(full)
+		if err != nil {
+			report.fail(id, version, err)
+			continue
+		}
+		s.index[id] = metadata
+		report.Migrated = append(report.Migrated, id)
+	}
+
+	for id := range s.index {
+		if !seen[id] {
+			report.fail(id, 0, fmt.Errorf("entry file is missing"))
+		}
+	}
+	sort.Slice(report.Failed, func(i, j int) bool {
+		return report.Failed[i].ID < report.Failed[j].ID
+	})
+	if len(report.Migrated) > 0 {
+		if err := s.writeIndexLocked(); err != nil {
+			return SchemaReport{}, err
+		}
+	}
+	return report, nil
+}
+
+// Fsck walks the history directory looking for data List can't see: temp
+// files left by interrupted writes, entry directories that are unreadable or
+// have no entry file, index records without a directory, entries missing
+// from the index and result blobs nothing references.
+func (s *FileStore) Fsck(mode FsckMode) (FsckReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report := newFsckReport(mode)
+	if err := s.loadIndexLocked(); err != nil {
+		return FsckReport{}, err
+	}
+	dirs, err := os.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return report, nil
+		}
+		return FsckReport{}, err
+	}
+
+	quarantineDir := filepath.Join(s.dir, quarantineDirName, time.Now().UTC().Format("20060102-150405"))
+	fix := func(target string) func() (string, error) {
+		return func() (string, error) {
+			if mode == FsckModeQuarantine {
+				relative, err := filepath.Rel(s.dir, target)
+				if err != nil {
+					return "", err
+				}
+				destination := filepath.Join(quarantineDir, relative)
+				if err := os.MkdirAll(filepath.Dir(destination), 0o755); err != nil {
+					return "", err
+				}
+				if err := os.Rename(target, destination); err != nil {
+					return "", err
+				}
+				report.QuarantinePath = quarantineDir
+				return fsckActionQuarantined, nil
+			}
+			if err := os.RemoveAll(target); err != nil {
+				return "", err
+			}
+			return fsckActionRemoved, nil
+		}
+	}
+
+	indexChanged := false
+	seen := make(map[string]bool, len(dirs))
+	referenced := make(map[string]bool)
+	for _, dir := range dirs {
+		name := dir.Name()
+		target := filepath.Join(s.dir, name)
+		if !dir.IsDir() {
+			if isTempFileName(name) {
+				report.add(FsckOrphanTempFile, "", target, "", fix(target))
+			}
+			continue
+		}
+		if name == blobsDirName || name == quarantineDirName {
+			continue
+		}
+
+		id := name
+		files, err := os.ReadDir(target)
+		if err != nil {
+			return FsckReport{}, err
+		}
+		for _, file := range files {
+			if file.Type().IsRegular() && isTempFileName(file.Name()) {
+				tempPath := filepath.Join(target, file.Name())
+				report.add(FsckOrphanTempFile, id, tempPath, "", fix(tempPath))
+			}
+		}
+
+		dropFromIndex := func(action func() (string, error)) func() (string, error) {
+			return func() (string, error) {
+				result, err := action()
+				if err == nil {
+					if _, ok := s.index[id]; ok {
+						delete(s.index, id)
+						indexChanged = true
+					}
+				}
+				return result, err
+			}
+		}
+
+		if _, err := s.findEntryPath(id); err != nil {
+			exports, _ := s.ListExports(id)
+			if len(exports) > 0 {
+				report.add(FsckOrphanExports, id, target, fmt.Sprintf("%d export files without an entry", len(exports)), dropFromIndex(fix(target)))
+			} else {
+				report.add(FsckMissingMetadata, id, target, "directory has no entry file", dropFromIndex(fix(target)))
+			}
+			seen[id] = true
+			continue
+		}
+
+		entry, err := s.readEntryLocked(id)
+		if err == nil && entry.Metadata.ID != id {
+			err = fmt.Errorf("entry is stored under a different id (%s)", entry.Metadata.ID)
+		}
+		if err != nil {
+			report.add(FsckUnreadableEntry, id, target, err.Error(), dropFromIndex(fix(target)))
+			seen[id] = true
+			continue
+		}
+
+		seen[id] = true
+		referenced[entry.Metadata.ResultDigest] = true
+		if _, ok := s.index[id]; !ok {
+			report.add(FsckUnindexedEntry, id, target, "entry is missing from the index", func() (string, error) {
+				s.index[id] = entry.Metadata
+				indexChanged = true
+				return fsckActionReindexed, nil
+			})
+		}
+	}
+
+	for id := range s.index {
+		if seen[id] {
+			continue
+		}
+		report.add(FsckMissingEntry, id, s.EntryDir(id), "index refers to a missing directory", func() (string, error) {
+			delete(s.index, id)
+			indexChanged = true
+			return fsckActionReindexed, nil
+		})
+	}
+
+	err = filepath.WalkDir(s.BlobsDir(), func(blobPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		if isTempFileName(entry.Name()) {
+			report.add(FsckOrphanTempFile, "", blobPath, "", fix(blobPath))
+			return nil
+		}
+		digest := digestPrefix + entry.Name()
+		if !referenced[digest] && blobReferences(s.index, digest) == 0 {
+			report.add(FsckOrphanBlob, "", blobPath, digest, fix(blobPath))
+		}
+		return nil
+	})
+	if err != nil {
+		return FsckReport{}, err
+	}
+
+	if indexChanged {
+		if err := s.writeIndexLocked(); err != nil {
+			return FsckReport{}, err
+		}
+	}
+	report.sort()
+	return report, nil
+}
+
+// pruneLocked removes the entries the retention policy selects, never keep,
+// and returns the result digests they referenced, to be released once the
+// index is written. Each entry is charged an equal share of a shared blob.
+func (s *FileStore) pruneLocked(keep string) []string {
+	references := make(map[string]int64)
+	for _, entry := range s.index {
+		references[entry.ResultDigest]++
+	}
+
+	metadata := make([]Metadata, 0, len(s.index))
+	sizes := make(map[string]int64, len(s.index))
+	for id, entry := range s.index {
+		metadata = append(metadata, entry)
+		if s.options.Retention.MaxTotalBytes > 0 {
+			size, err := directorySize(s.EntryDir(id))
+			if err == nil {
+				sizes[id] = size
+			}
+			if !validDigest(entry.ResultDigest) {
+				continue
+			}
+			if info, err := os.Stat(s.BlobPath(entry.ResultDigest)); err == nil {
+				sizes[id] += info.Size() / references[entry.ResultDigest]
+			}
+		}
+	}
+
+	var released []string
+	for _, id := range s.options.Retention.Select(metadata, sizes, time.Now(), keep) {
+		if err := os.RemoveAll(s.EntryDir(id)); err != nil {
+			continue
+		}
+		released = append(released, s.index[id].ResultDigest)
+		delete(s.index, id)
+	}
+	return released
+}
+
+func directorySize(dir string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(dir, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		total += info.Size()
+		return nil
+	})
+	return total, err
+}
+
+// loadIndexLocked reads index.json into memory on first use and again when
+// its modification time or size no longer match the cached copy, rebuilding
+// it from the entry files when it is missing or unreadable. Entries indexed
+// before sizes were tracked get them filled in.
+func (s *FileStore) loadIndexLocked() error {
+	info, err := os.Stat(s.IndexPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	stamp := fileStamp{}
+	if err == nil {
+		stamp = stampOf(info)
+	}
+	if s.index != nil && stamp == s.indexStamp {
+		return nil
+	}
+	s.index = nil
+	s.indexStamp = stamp
+
+	data, err := os.ReadFile(s.IndexPath())
+	if err == nil {
+		var parsed indexFile
+		if err := json.Unmarshal(data, &parsed); err == nil {
+			s.index = make(map[string]Metadata, len(parsed.Entries))
+			missingSizes := false
+			for _, metadata := range parsed.Entries {
+				if metadata.StoredBytes == 0 {
+					if entry, err := s.readEntryLocked(metadata.ID); err == nil {
+						metadata.StoredBytes = entry.Metadata.StoredBytes
+						metadata.LogicalBytes = entry.Metadata.LogicalBytes
+						missingSizes = true
+					}
+				}
+				s.index[metadata.ID] = metadata
+			}
+			if missingSizes {
+				return s.writeIndexLocked()
+			}
+			return nil
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	return s.rebuildIndexLocked()
+}
+
+func (s *FileStore) rebuildIndexLocked() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			s.index = make(map[string]Metadata)
+			return nil
+		}
+		return err
+	}
+
+	index := make(map[string]Metadata, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		parsed, err := s.readEntryLocked(entry.Name())
+		if err != nil {
+			continue
+		}
+		index[parsed.Metadata.ID] = parsed.Metadata
+	}
+	s.index = index
+	return s.writeIndexLocked()
+}
+
+func (s *FileStore) writeIndexLocked() error {
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+
+	parsed := indexFile{Entries: make([]Metadata, 0, len(s.index))}
+	for _, metadata := range s.index {
+		parsed.Entries = append(parsed.Entries, metadata)
+	}
+	sort.Slice(parsed.Entries, func(i, j int) bool {
+		return parsed.Entries[i].ID < parsed.Entries[j].ID
+	})
+
+	tempFile, err := os.CreateTemp(s.dir, "index-*.json")
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(tempFile).Encode(parsed); err != nil {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+	if err := os.Rename(tempFile.Name(), s.IndexPath()); err != nil {
+		return err
+	}
+	if info, err := os.Stat(s.IndexPath()); err == nil {
+		s.indexStamp = stampOf(info)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package history
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type FsckMode string
+
+const (
+	// FsckModeReport only lists problems. FsckModeRepair deletes what can't be
+	// recovered and rebuilds what can; FsckModeQuarantine does the same but
+	// moves unrecoverable data aside instead of deleting it.
+	FsckModeReport     FsckMode = "report"
+	FsckModeRepair     FsckMode = "repair"
+	FsckModeQuarantine FsckMode = "quarantine"
+)
+
+type FsckKind string
+
+const (
+	FsckOrphanTempFile  FsckKind = "orphan-temp-file"
+	FsckUnreadableEntry FsckKind = "unreadable-entry"
+	FsckOrphanExports   FsckKind = "orphan-exports"
+	FsckMissingMetadata FsckKind = "missing-metadata"
+	FsckUnindexedEntry  FsckKind = "unindexed-entry"
+	FsckMissingEntry    FsckKind = "missing-entry"
+	FsckOrphanBlob      FsckKind = "orphan-blob"
+)
+
+const (
+	fsckActionReported    = "reported"
+	fsckActionRemoved     = "removed"
+	fsckActionQuarantined = "quarantined"
+	fsckActionReindexed   = "reindexed"
+	fsckActionFailed      = "failed"
+)
+
+const quarantineDirName = ".quarantine"
+
+type FsckIssue struct {
+	Kind   FsckKind `json:"kind"`
+	ID     string   `json:"id,omitempty"`
+	Path   string   `json:"path"`
+	Detail string   `json:"detail,omitempty"`
+	Action string   `json:"action"`
+}
+
+type FsckReport struct {
+	Mode   FsckMode         `json:"mode"`
+	Issues []FsckIssue      `json:"issues"`
+	Counts map[FsckKind]int `json:"counts"`
+	// QuarantinePath is where quarantined data was moved, if anything was.
+	QuarantinePath string `json:"quarantinePath,omitempty"`
+}
+
+func ParseFsckMode(value string) (FsckMode, error) {
+	switch mode := FsckMode(strings.ToLower(strings.TrimSpace(value))); mode {
+	case "":
+		return FsckModeReport, nil
+	case FsckModeReport, FsckModeRepair, FsckModeQuarantine:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("mode must be report, repair or quarantine")
+	}
+}
+
+func newFsckReport(mode FsckMode) FsckReport {
+	return FsckReport{
+		Mode:   mode,
+		Issues: []FsckIssue{},
+		Counts: make(map[FsckKind]int),
+	}
+}
+
+// add records an issue. fix is called unless the mode only reports, and
+// returns the action taken.
+func (r *FsckReport) add(kind FsckKind, id string, location string, detail string, fix func() (string, error)) {
+	issue := FsckIssue{Kind: kind, ID: id, Path: location, Detail: detail, Action: fsckActionReported}
+	if r.Mode != FsckModeReport && fix != nil {
+		action, err := fix()
+		if err != nil {
+			issue.Action = fsckActionFailed
+			issue.Detail = strings.TrimSpace(issue.Detail + "; " + err.Error())
+		} else {
+			issue.Action = action
+		}
+	}
+	r.Counts[kind]++
+	r.Issues = append(r.Issues, issue)
+}
+
+func (r *FsckReport) sort() {
+	sort.SliceStable(r.Issues, func(i, j int) bool {
+		if r.Issues[i].Kind != r.Issues[j].Kind {
+			return r.Issues[i].Kind < r.Issues[j].Kind
+		}
+		return r.Issues[i].Path < r.Issues[j].Path
+	})
+}
+
+// isTempFileName matches the temporary files Save, the index writer and the
+// blob writer create before renaming them into place.
+func isTempFileName(name string) bool {
+	switch {
+	case strings.HasPrefix(name, "entry-") && (strings.HasSuffix(name, ".tmp") || strings.HasSuffix(name, ".json")):
+		return true
+	case strings.HasPrefix(name, "index-") && strings.HasSuffix(name, ".json"):
+		return true
+	case strings.HasPrefix(name, "blob-") && strings.HasSuffix(name, ".tmp"):
+		return true
+	default:
+		return false
+	}
+}
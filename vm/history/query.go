@@ -0,0 +1,363 @@
+package history
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SortCompletedAt      = "completedAt"
+	SortCreatedAt        = "createdAt"
+	SortImage            = "image"
+	SortSizeBytes        = "sizeBytes"
+	SortInefficientBytes = "inefficientBytes"
+	SortEfficiencyScore  = "efficiencyScore"
+)
+
+const maxQueryLimit = 500
+
+type Query struct {
+	Image          string
+	ImagePrefix    string
+	ImageID        string
+	Source         string
+	CompletedFrom  time.Time
+	CompletedTo    time.Time
+	MinEfficiency  *float64
+	MaxEfficiency  *float64
+	MinWastedBytes *int64
+	MaxWastedBytes *int64
+	// Labels must all be present on an entry; Notes matches a substring of
+	// its notes; Pinned and Baseline restrict to entries with or without
+	// the flag.
+	Labels    []string
+	Notes     string
+	Pinned    *bool
+	Baseline  *bool
+	SortBy    string
+	Ascending bool
+	Limit     int
+	Cursor    string
+}
+
+type Page struct {
+	Entries    []Metadata `json:"entries"`
+	Total      int        `json:"total"`
+	NextCursor string     `json:"nextCursor,omitempty"`
+}
+
+// cursorPayload carries the sort-relevant fields of the last returned entry
+// so the next page resumes after it even if entries were added or removed.
+type cursorPayload struct {
+	ID               string    `json:"id"`
+	Image            string    `json:"image,omitempty"`
+	CreatedAt        time.Time `json:"createdAt"`
+	CompletedAt      time.Time `json:"completedAt"`
+	SizeBytes        int64     `json:"sizeBytes,omitempty"`
+	InefficientBytes int64     `json:"inefficientBytes,omitempty"`
+	EfficiencyScore  float64   `json:"efficiencyScore,omitempty"`
+}
+
+// ParseQuery reads list filters from URL query parameters. Dates accept
+// RFC 3339 timestamps or YYYY-MM-DD days.
+func ParseQuery(values url.Values) (Query, error) {
+	query := Query{
+		Image:       strings.TrimSpace(values.Get("image")),
+		ImagePrefix: strings.TrimSpace(values.Get("imagePrefix")),
+		ImageID:     strings.TrimSpace(values.Get("imageId")),
+		Source:      strings.TrimSpace(values.Get("source")),
+		Notes:       strings.TrimSpace(values.Get("notes")),
+		SortBy:      strings.TrimSpace(values.Get("sort")),
+		Cursor:      strings.TrimSpace(values.Get("cursor")),
+	}
+
+	var err error
+	if query.CompletedFrom, err = parseQueryTime(values.Get("from"), false); err != nil {
+		return Query{}, err
+	}
+	if query.CompletedTo, err = parseQueryTime(values.Get("to"), true); err != nil {
+		return Query{}, err
+	}
+	if query.MinEfficiency, err = parseQueryFloat(values, "minEfficiency"); err != nil {
+		return Query{}, err
+	}
+	if query.MaxEfficiency, err = parseQueryFloat(values, "maxEfficiency"); err != nil {
+		return Query{}, err
+	}
+	if query.MinWastedBytes, err = parseQueryInt(values, "minWastedBytes"); err != nil {
+		return Query{}, err
+	}
+	if query.MaxWastedBytes, err = parseQueryInt(values, "maxWastedBytes"); err != nil {
+		return Query{}, err
+	}
+	for _, value := range values["label"] {
+		for _, label := range strings.Split(value, ",") {
+			if label = strings.TrimSpace(label); label != "" {
+				query.Labels = append(query.Labels, label)
+			}
+		}
+	}
+	if pinned := strings.TrimSpace(values.Get("pinned")); pinned != "" {
+		parsed, err := strconv.ParseBool(pinned)
+		if err != nil {
+			return Query{}, fmt.Errorf("pinned must be true or false")
+		}
+		query.Pinned = &parsed
+	}
+	if baseline := strings.TrimSpace(values.Get("baseline")); baseline != "" {
+		parsed, err := strconv.ParseBool(baseline)
+		if err != nil {
+			return Query{}, fmt.Errorf("baseline must be true or false")
+		}
+		query.Baseline = &parsed
+	}
+
+	if query.SortBy == "" {
+		query.SortBy = SortCompletedAt
+	}
+	switch query.SortBy {
+	case SortCompletedAt, SortCreatedAt, SortImage, SortSizeBytes, SortInefficientBytes, SortEfficiencyScore:
+	default:
+		return Query{}, fmt.Errorf("unsupported sort field: %s", query.SortBy)
+	}
+
+	switch strings.ToLower(strings.TrimSpace(values.Get("order"))) {
+	case "", "desc":
+	case "asc":
+		query.Ascending = true
+	default:
+		return Query{}, fmt.Errorf("order must be asc or desc")
+	}
+
+	if limit := strings.TrimSpace(values.Get("limit")); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed <= 0 {
+			return Query{}, fmt.Errorf("limit must be a positive integer")
+		}
+		if parsed > maxQueryLimit {
+			parsed = maxQueryLimit
+		}
+		query.Limit = parsed
+	}
+
+	return query, nil
+}
+
+// Apply filters, sorts and paginates metadata. Total counts every entry that
+// matches the filters, not just the returned page.
+func (q Query) Apply(metadata []Metadata) (Page, error) {
+	matches := make([]Metadata, 0, len(metadata))
+	for _, entry := range metadata {
+		if q.matches(entry) {
+			matches = append(matches, entry)
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return q.less(matches[i], matches[j])
+	})
+
+	start := 0
+	if q.Cursor != "" {
+		after, err := decodeCursor(q.Cursor)
+		if err != nil {
+			return Page{}, err
+		}
+		start = sort.Search(len(matches), func(i int) bool {
+			return q.less(after, matches[i])
+		})
+	}
+
+	end := len(matches)
+	if q.Limit > 0 && start+q.Limit < end {
+		end = start + q.Limit
+	}
+
+	page := Page{
+		Entries: append([]Metadata{}, matches[start:end]...),
+		Total:   len(matches),
+	}
+	if end < len(matches) && end > start {
+		page.NextCursor = encodeCursor(matches[end-1])
+	}
+	return page, nil
+}
+
+func (q Query) matches(entry Metadata) bool {
+	if q.Image != "" && entry.Image != q.Image {
+		return false
+	}
+	if q.ImagePrefix != "" && !strings.HasPrefix(entry.Image, q.ImagePrefix) {
+		return false
+	}
+	if q.ImageID != "" && entry.ImageID != q.ImageID && !strings.HasPrefix(entry.ImageID, q.ImageID) {
+		return false
+	}
+	if q.Source != "" && entry.Source != q.Source {
+		return false
+	}
+	if !q.CompletedFrom.IsZero() && entry.CompletedAt.Before(q.CompletedFrom) {
+		return false
+	}
+	if !q.CompletedTo.IsZero() && entry.CompletedAt.After(q.CompletedTo) {
+		return false
+	}
+	if q.MinEfficiency != nil && entry.Summary.EfficiencyScore < *q.MinEfficiency {
+		return false
+	}
+	if q.MaxEfficiency != nil && entry.Summary.EfficiencyScore > *q.MaxEfficiency {
+		return false
+	}
+	if q.MinWastedBytes != nil && entry.Summary.InefficientBytes < *q.MinWastedBytes {
+		return false
+	}
+	if q.MaxWastedBytes != nil && entry.Summary.InefficientBytes > *q.MaxWastedBytes {
+		return false
+	}
+	for _, label := range q.Labels {
+		if !entry.HasLabel(label) {
+			return false
+		}
+	}
+	if q.Notes != "" && !strings.Contains(strings.ToLower(entry.Notes), strings.ToLower(q.Notes)) {
+		return false
+	}
+	if q.Pinned != nil && entry.Pinned != *q.Pinned {
+		return false
+	}
+	if q.Baseline != nil && entry.Baseline != *q.Baseline {
+		return false
+	}
+	return true
+}
+
+// less orders entries by the requested field and direction, breaking ties by
+// ID so pagination is stable.
+func (q Query) less(left Metadata, right Metadata) bool {
+	compared := 0
+	switch q.SortBy {
+	case SortCreatedAt:
+		compared = left.CreatedAt.Compare(right.CreatedAt)
+	case SortImage:
+		compared = strings.Compare(left.Image, right.Image)
+	case SortSizeBytes:
+		compared = compareInt64(left.Summary.SizeBytes, right.Summary.SizeBytes)
+	case SortInefficientBytes:
+		compared = compareInt64(left.Summary.InefficientBytes, right.Summary.InefficientBytes)
+	case SortEfficiencyScore:
+		compared = compareFloat64(left.Summary.EfficiencyScore, right.Summary.EfficiencyScore)
+	default:
+		compared = left.CompletedAt.Compare(right.CompletedAt)
+	}
+	if compared == 0 {
+		compared = strings.Compare(left.ID, right.ID)
+	}
+	if q.Ascending {
+		return compared < 0
+	}
+	return compared > 0
+}
+
+func compareInt64(left int64, right int64) int {
+	switch {
+	case left < right:
+		return -1
+	case left > right:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func compareFloat64(left float64, right float64) int {
+	switch {
+	case left < right:
+		return -1
+	case left > right:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func encodeCursor(entry Metadata) string {
+	data, _ := json.Marshal(cursorPayload{
+		ID:               entry.ID,
+		Image:            entry.Image,
+		CreatedAt:        entry.CreatedAt,
+		CompletedAt:      entry.CompletedAt,
+		SizeBytes:        entry.Summary.SizeBytes,
+		InefficientBytes: entry.Summary.InefficientBytes,
+		EfficiencyScore:  entry.Summary.EfficiencyScore,
+	})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(value string) (Metadata, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return Metadata{}, fmt.Errorf("invalid cursor")
+	}
+	var payload cursorPayload
+	if err := json.Unmarshal(data, &payload); err != nil || payload.ID == "" {
+		return Metadata{}, fmt.Errorf("invalid cursor")
+	}
+	return Metadata{
+		ID:          payload.ID,
+		Image:       payload.Image,
+		CreatedAt:   payload.CreatedAt,
+		CompletedAt: payload.CompletedAt,
+		Summary: Summary{
+			SizeBytes:        payload.SizeBytes,
+			InefficientBytes: payload.InefficientBytes,
+			EfficiencyScore:  payload.EfficiencyScore,
+		},
+	}, nil
+}
+
+func parseQueryTime(value string, endOfDay bool) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		return parsed, nil
+	}
+	parsed, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date: %s", value)
+	}
+	if endOfDay {
+		return parsed.Add(24*time.Hour - time.Nanosecond), nil
+	}
+	return parsed, nil
+}
+
+func parseQueryFloat(values url.Values, key string) (*float64, error) {
+	value := strings.TrimSpace(values.Get(key))
+	if value == "" {
+		return nil, nil
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be a number", key)
+	}
+	return &parsed, nil
+}
+
+func parseQueryInt(values url.Values, key string) (*int64, error) {
+	value := strings.TrimSpace(values.Get(key))
+	if value == "" {
+		return nil, nil
+	}
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be an integer", key)
+	}
+	return &parsed, nil
+}
@@ -0,0 +1,195 @@
+package history
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+type RetentionPolicy struct {
+	MaxEntries         int   `json:"maxEntries"`
+	MaxEntriesPerImage int   `json:"maxEntriesPerImage,omitempty"`
+	MaxAgeDays         int   `json:"maxAgeDays,omitempty"`
+	MaxTotalBytes      int64 `json:"maxTotalBytes,omitempty"`
+	KeepLatestPerTag   int   `json:"keepLatestPerTag,omitempty"`
+}
+
+type Stats struct {
+	EntryCount  int   `json:"entryCount"`
+	PinnedCount int   `json:"pinnedCount"`
+	StoredBytes int64 `json:"storedBytes"`
+	// ResultStoredBytes and ResultLogicalBytes sum every entry's on-disk and
+	// uncompressed size, excluding exports and store overhead. Shared result
+	// blobs are counted once on disk but once per entry logically.
+	ResultStoredBytes  int64    `json:"resultStoredBytes"`
+	ResultLogicalBytes int64    `json:"resultLogicalBytes"`
+	CompressionRatio   *float64 `json:"compressionRatio,omitempty"`
+	// ResultBlobs counts distinct stored results; DeduplicatedBytes is the
+	// disk space saved by sharing them.
+	ResultBlobs       int             `json:"resultBlobs"`
+	DeduplicatedBytes int64           `json:"deduplicatedBytes"`
+	Compression       string          `json:"compression"`
+	OldestEntry       *time.Time      `json:"oldestEntry,omitempty"`
+	NewestEntry       *time.Time      `json:"newestEntry,omitempty"`
+	Policy            RetentionPolicy `json:"policy"`
+	EntriesUsage      *float64        `json:"entriesUsage,omitempty"`
+	BytesUsage        *float64        `json:"bytesUsage,omitempty"`
+}
+
+func DefaultRetentionPolicy() RetentionPolicy {
+	return RetentionPolicy{MaxEntries: defaultMaxEntries}
+}
+
+func (p RetentionPolicy) normalized() RetentionPolicy {
+	if p.MaxEntries <= 0 {
+		p.MaxEntries = defaultMaxEntries
+	}
+	return p
+}
+
+// Select returns the IDs the policy would prune. Pinned entries, baselines,
+// the latest KeepLatestPerTag entries of each image reference and the entry
+// keep are never selected; every other rule removes the oldest eligible
+// entries first. Stores pass the entry being saved as keep, so a save never
+// prunes its own entry, even one larger than MaxTotalBytes.
+func (p RetentionPolicy) Select(entries []Metadata, sizes map[string]int64, now time.Time, keep string) []string {
+	p = p.normalized()
+
+	ordered := make([]Metadata, len(entries))
+	copy(ordered, entries)
+	sort.Slice(ordered, func(i, j int) bool {
+		return ordered[i].CompletedAt.After(ordered[j].CompletedAt)
+	})
+
+	protected := map[string]bool{keep: true}
+	perTag := make(map[string]int)
+	for _, entry := range ordered {
+		if entry.Pinned || entry.Baseline {
+			protected[entry.ID] = true
+		}
+		if p.KeepLatestPerTag > 0 && perTag[entry.Image] < p.KeepLatestPerTag {
+			perTag[entry.Image]++
+			protected[entry.ID] = true
+		}
+	}
+
+	removed := make(map[string]bool)
+	remove := func(id string) {
+		if !protected[id] {
+			removed[id] = true
+		}
+	}
+
+	if p.MaxAgeDays > 0 {
+		cutoff := now.Add(-time.Duration(p.MaxAgeDays) * 24 * time.Hour)
+		for _, entry := range ordered {
+			if entry.CompletedAt.Before(cutoff) {
+				remove(entry.ID)
+			}
+		}
+	}
+
+	if p.MaxEntriesPerImage > 0 {
+		perImage := make(map[string]int)
+		for _, entry := range ordered {
+			if removed[entry.ID] {
+				continue
+			}
+			repository := Repository(entry.Image)
+			perImage[repository]++
+			if perImage[repository] > p.MaxEntriesPerImage {
+				remove(entry.ID)
+			}
+		}
+	}
+
+	remaining := 0
+	var remainingBytes int64
+	for _, entry := range ordered {
+		if !removed[entry.ID] {
+			remaining++
+			remainingBytes += sizes[entry.ID]
+		}
+	}
+	for i := len(ordered) - 1; i >= 0; i-- {
+		entry := ordered[i]
+		overEntries := remaining > p.MaxEntries
+		overBytes := p.MaxTotalBytes > 0 && remainingBytes > p.MaxTotalBytes
+		if !overEntries && !overBytes {
+			break
+		}
+		if removed[entry.ID] || protected[entry.ID] {
+			continue
+		}
+		removed[entry.ID] = true
+		remaining--
+		remainingBytes -= sizes[entry.ID]
+	}
+
+	ids := make([]string, 0, len(removed))
+	for _, entry := range ordered {
+		if removed[entry.ID] {
+			ids = append(ids, entry.ID)
+		}
+	}
+	return ids
+}
+
+// buildStats summarizes entries. blobSizes holds the on-disk size of each
+// referenced result blob, which every referencing entry's StoredBytes
+// includes.
+func buildStats(entries []Metadata, storedBytes int64, blobSizes map[string]int64, options Options) Stats {
+	stats := Stats{
+		EntryCount:  len(entries),
+		StoredBytes: storedBytes,
+		Compression: options.Compression,
+		Policy:      options.Retention,
+	}
+	policy := options.Retention
+	for i := range entries {
+		entry := entries[i]
+		stats.ResultStoredBytes += entry.StoredBytes - blobSizes[entry.ResultDigest]
+		stats.ResultLogicalBytes += entry.LogicalBytes
+		stats.DeduplicatedBytes += blobSizes[entry.ResultDigest]
+		if entry.Pinned {
+			stats.PinnedCount++
+		}
+		if stats.OldestEntry == nil || entry.CompletedAt.Before(*stats.OldestEntry) {
+			stats.OldestEntry = &entries[i].CompletedAt
+		}
+		if stats.NewestEntry == nil || entry.CompletedAt.After(*stats.NewestEntry) {
+			stats.NewestEntry = &entries[i].CompletedAt
+		}
+	}
+	for _, size := range blobSizes {
+		stats.ResultBlobs++
+		stats.ResultStoredBytes += size
+		stats.DeduplicatedBytes -= size
+	}
+	if stats.ResultStoredBytes > 0 {
+		ratio := float64(stats.ResultLogicalBytes) / float64(stats.ResultStoredBytes)
+		stats.CompressionRatio = &ratio
+	}
+	if policy.MaxEntries > 0 {
+		usage := float64(stats.EntryCount) / float64(policy.MaxEntries)
+		stats.EntriesUsage = &usage
+	}
+	if policy.MaxTotalBytes > 0 {
+		usage := float64(storedBytes) / float64(policy.MaxTotalBytes)
+		stats.BytesUsage = &usage
+	}
+	return stats
+}
+
+// Repository strips the tag or digest from an image reference, so
+// "registry:5000/team/api:1.2" becomes "registry:5000/team/api".
+func Repository(image string) string {
+	if index := strings.Index(image, "@"); index >= 0 {
+		image = image[:index]
+	}
+	lastSlash := strings.LastIndex(image, "/")
+	if lastColon := strings.LastIndex(image, ":"); lastColon > lastSlash {
+		image = image[:lastColon]
+	}
+	return image
+}
@@ -0,0 +1,145 @@
+package history
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// CurrentSchemaVersion is written into every saved entry. Bump it together
+// with a new step in schemaMigrations whenever the stored shape of Entry,
+// Metadata or Summary changes.
+const CurrentSchemaVersion = 1
+
+var ErrNewerSchema = errors.New("history entry was written by a newer version")
+
+// schemaMigrations[i] upgrades a decoded entry object from version i to
+// version i+1. Steps work on raw JSON so they can handle renamed or
+// restructured fields that no longer unmarshal into the current types.
+var schemaMigrations = []func(entry map[string]json.RawMessage) error{
+	migrateSchemaV0,
+}
+
+// SchemaFailure describes an entry that could not be read or migrated.
+type SchemaFailure struct {
+	ID      string `json:"id"`
+	Version int    `json:"version,omitempty"`
+	Error   string `json:"error"`
+}
+
+type SchemaReport struct {
+	CurrentVersion int `json:"currentVersion"`
+	Scanned        int `json:"scanned"`
+	// Versions counts entries by the schema version they were stored with.
+	Versions map[int]int `json:"versions"`
+	// Outdated lists entries stored with an older version; Migrated lists
+	// the ones rewritten at the current version.
+	Outdated []string        `json:"outdated"`
+	Migrated []string        `json:"migrated"`
+	Failed   []SchemaFailure `json:"failed"`
+	DryRun   bool            `json:"dryRun"`
+}
+
+func newSchemaReport(dryRun bool) SchemaReport {
+	return SchemaReport{
+		CurrentVersion: CurrentSchemaVersion,
+		Versions:       make(map[int]int),
+		Outdated:       []string{},
+		Migrated:       []string{},
+		Failed:         []SchemaFailure{},
+		DryRun:         dryRun,
+	}
+}
+
+func (r *SchemaReport) fail(id string, version int, err error) {
+	r.Failed = append(r.Failed, SchemaFailure{ID: id, Version: version, Error: err.Error()})
+}
+
+// upgradeEntryJSON runs every migration step needed to bring an encoded
+// entry to CurrentSchemaVersion and returns the upgraded JSON together with
+// the version it was stored with.
+func upgradeEntryJSON(data []byte) ([]byte, int, error) {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, 0, fmt.Errorf("entry is not a JSON object: %w", err)
+	}
+
+	version := 0
+	if raw, ok := object["schemaVersion"]; ok {
+		if err := json.Unmarshal(raw, &version); err != nil {
+			return nil, 0, fmt.Errorf("invalid schema version: %w", err)
+		}
+	}
+	if version > CurrentSchemaVersion {
+		return nil, version, fmt.Errorf("%w (schema %d, supported %d)", ErrNewerSchema, version, CurrentSchemaVersion)
+	}
+	if version == CurrentSchemaVersion {
+		return data, version, nil
+	}
+
+	for step := version; step < CurrentSchemaVersion; step++ {
+		if err := schemaMigrations[step](object); err != nil {
+			return nil, version, fmt.Errorf("migrating from schema %d: %w", step, err)
+		}
+	}
+	object["schemaVersion"] = json.RawMessage(fmt.Sprint(CurrentSchemaVersion))
+	upgraded, err := json.Marshal(object)
+	if err != nil {
+		return nil, version, err
+	}
+	return upgraded, version, nil
+}
+
+// migrateSchemaV0 upgrades entries written before versioning. Their
+// metadata must carry an ID, a missing summary is recovered from the
+// result, and labels are normalized.
+func migrateSchemaV0(entry map[string]json.RawMessage) error {
+	var metadata map[string]json.RawMessage
+	if err := json.Unmarshal(entry["metadata"], &metadata); err != nil || metadata == nil {
+		return fmt.Errorf("missing metadata")
+	}
+	var id string
+	if err := json.Unmarshal(metadata["id"], &id); err != nil || id == "" {
+		return fmt.Errorf("metadata has no id")
+	}
+
+	if _, ok := metadata["summary"]; !ok {
+		var payload diveSummaryPayload
+		if err := json.Unmarshal(entry["result"], &payload); err != nil {
+			return fmt.Errorf("missing summary and unreadable result")
+		}
+		summary, err := json.Marshal(Summary{
+			SizeBytes:        payload.Image.SizeBytes,
+			InefficientBytes: payload.Image.InefficientBytes,
+			EfficiencyScore:  payload.Image.EfficiencyScore,
+			LayerCount:       len(payload.Layers),
+		})
+		if err != nil {
+			return err
+		}
+		metadata["summary"] = summary
+	}
+
+	if raw, ok := metadata["labels"]; ok {
+		var labels []string
+		if err := json.Unmarshal(raw, &labels); err != nil {
+			return fmt.Errorf("invalid labels: %w", err)
+		}
+		normalized, err := NormalizeLabels(labels)
+		if err != nil {
+			return err
+		}
+		if len(normalized) == 0 {
+			delete(metadata, "labels")
+		} else if metadata["labels"], err = json.Marshal(normalized); err != nil {
+			return err
+		}
+	}
+
+	updated, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	entry["metadata"] = updated
+	return nil
+}
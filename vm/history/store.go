@@ -1,214 +1,130 @@
 package history
 
 import (
-	"encoding/json"
 	"errors"
-	"os"
+	"fmt"
 	"path/filepath"
-	"sort"
-	"sync"
+	"strings"
 )
 
+const defaultMaxEntries = 50
+
 const (
-	defaultMaxEntries = 50
-	entryFileName     = "entry.json"
-	exportsDirName    = "exports"
+	BackendFile = "file"
+	BackendBolt = "bolt"
 )
 
-var ErrNotFound = errors.New("history entry not found")
-
-type Store struct {
-	dir        string
-	maxEntries int
-	mu         sync.Mutex
-}
-
-func NewStore(dir string, maxEntries int) *Store {
-	if maxEntries <= 0 {
-		maxEntries = defaultMaxEntries
-	}
-	return &Store{
-		dir:        dir,
-		maxEntries: maxEntries,
-	}
-}
+const boltFileName = "history.db"
 
-func (s *Store) BaseDir() string {
-	return s.dir
-}
-
-func (s *Store) EntryDir(id string) string {
-	return filepath.Join(s.dir, id)
-}
+var (
+	ErrNotFound       = errors.New("history entry not found")
+	ErrExportNotFound = errors.New("history export not found")
+)
 
-func (s *Store) EntryPath(id string) string {
-	return filepath.Join(s.EntryDir(id), entryFileName)
+// Store persists analysis history. Implementations apply their retention
+// policy every time an entry is saved.
+type Store interface {
+	Save(entry Entry) error
+	List() ([]Metadata, error)
+	Get(id string) (Entry, error)
+	Delete(id string) error
+	DeleteAll() error
+	SaveExport(id string, filename string, data []byte) error
+	GetExport(id string, filename string) ([]byte, error)
+	ListExports(id string) ([]string, error)
+	DeleteExport(id string, filename string) error
+	// Update applies changes to an entry's Metadata and persists them.
+	Update(id string, update func(metadata *Metadata) error) (Metadata, error)
+	// UpdateEntry is Update for changes beyond the Metadata, such as
+	// reports attached after the entry was saved.
+	UpdateEntry(id string, update func(entry *Entry) error) (Metadata, error)
+	Stats() (Stats, error)
+	// MigrateSchema upgrades entries stored with an older schema version
+	// and reports any that can't be read or migrated.
+	MigrateSchema(dryRun bool) (SchemaReport, error)
+	// Fsck looks for stored data that List can't see and, depending on the
+	// mode, repairs or quarantines it.
+	Fsck(mode FsckMode) (FsckReport, error)
+	Close() error
 }
 
-func (s *Store) ExportsDir(id string) string {
-	return filepath.Join(s.EntryDir(id), exportsDirName)
+type Options struct {
+	Retention RetentionPolicy
+	// Compression is the codec used for newly written entries. Entries are
+	// always readable regardless of the codec they were written with.
+	Compression string
 }
 
-func (s *Store) Save(entry Entry) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	if err := os.MkdirAll(s.dir, 0o755); err != nil {
-		return err
-	}
-
-	runDir := s.EntryDir(entry.Metadata.ID)
-	if err := os.MkdirAll(runDir, 0o755); err != nil {
-		return err
-	}
-
-	tempFile, err := os.CreateTemp(runDir, "entry-*.json")
-	if err != nil {
-		return err
-	}
-
-	encoder := json.NewEncoder(tempFile)
-	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(entry); err != nil {
-		tempFile.Close()
-		os.Remove(tempFile.Name())
-		return err
+func DefaultOptions() Options {
+	return Options{
+		Retention:   DefaultRetentionPolicy(),
+		Compression: DefaultCompression,
 	}
-	if err := tempFile.Close(); err != nil {
-		return err
-	}
-
-	if err := os.Rename(tempFile.Name(), s.EntryPath(entry.Metadata.ID)); err != nil {
-		return err
-	}
-
-	return s.pruneLocked()
 }
 
-func (s *Store) List() ([]Metadata, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	entries, err := os.ReadDir(s.dir)
+// Open returns the store for the named backend rooted at dir.
+func Open(backend string, dir string, options Options) (Store, error) {
+	compression, err := ParseCompression(options.Compression)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return []Metadata{}, nil
-		}
 		return nil, err
 	}
+	options.Compression = compression
 
-	results := make([]Metadata, 0, len(entries))
-	for _, entry := range entries {
-		if !entry.IsDir() {
-			continue
-		}
-		path := s.EntryPath(entry.Name())
-		data, err := os.ReadFile(path)
-		if err != nil {
-			continue
-		}
-		var parsed Entry
-		if err := json.Unmarshal(data, &parsed); err != nil {
-			continue
-		}
-		results = append(results, parsed.Metadata)
+	switch strings.ToLower(strings.TrimSpace(backend)) {
+	case "", BackendFile:
+		return NewFileStore(dir, options), nil
+	case BackendBolt:
+		return NewBoltStore(filepath.Join(dir, boltFileName), options)
+	default:
+		return nil, fmt.Errorf("unsupported history backend: %s", backend)
 	}
-
-	sort.Slice(results, func(i, j int) bool {
-		return results[i].CompletedAt.After(results[j].CompletedAt)
-	})
-
-	return results, nil
 }
 
-func (s *Store) Get(id string) (Entry, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	data, err := os.ReadFile(s.EntryPath(id))
+// Migrate moves every entry and its stored exports from one store to
+// another, deleting each entry from the source once it has been copied.
+func Migrate(from Store, to Store) (int, error) {
+	entries, err := from.List()
 	if err != nil {
-		if os.IsNotExist(err) {
-			return Entry{}, ErrNotFound
-		}
-		return Entry{}, err
-	}
-
-	var entry Entry
-	if err := json.Unmarshal(data, &entry); err != nil {
-		return Entry{}, err
+		return 0, err
 	}
-	return entry, nil
-}
 
-func (s *Store) Delete(id string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	path := s.EntryDir(id)
-	if err := os.RemoveAll(path); err != nil {
-		return err
-	}
-	return nil
-}
-
-func (s *Store) DeleteAll() error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	entries, err := os.ReadDir(s.dir)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return err
-	}
-
-	for _, entry := range entries {
-		path := filepath.Join(s.dir, entry.Name())
-		if err := os.RemoveAll(path); err != nil {
-			return err
+	// Save oldest first so pruning in the destination keeps the newest.
+	migrated := 0
+	for i := len(entries) - 1; i >= 0; i-- {
+		id := entries[i].ID
+		entry, err := from.Get(id)
+		if err != nil {
+			return migrated, fmt.Errorf("failed to read entry %s: %w", id, err)
 		}
-	}
-	return nil
-}
-
-func (s *Store) pruneLocked() error {
-	entries, err := os.ReadDir(s.dir)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
+		if err := to.Save(entry); err != nil {
+			return migrated, fmt.Errorf("failed to write entry %s: %w", id, err)
 		}
-		return err
-	}
 
-	var metadata []Metadata
-	for _, entry := range entries {
-		if !entry.IsDir() {
-			continue
-		}
-		data, err := os.ReadFile(s.EntryPath(entry.Name()))
+		filenames, err := from.ListExports(id)
 		if err != nil {
-			continue
+			return migrated, fmt.Errorf("failed to list exports for %s: %w", id, err)
 		}
-		var parsed Entry
-		if err := json.Unmarshal(data, &parsed); err != nil {
-			continue
+		for _, filename := range filenames {
+			data, err := from.GetExport(id, filename)
+			if err != nil {
+				return migrated, fmt.Errorf("failed to read export %s for %s: %w", filename, id, err)
+			}
+			if err := to.SaveExport(id, filename, data); err != nil {
+				return migrated, fmt.Errorf("failed to write export %s for %s: %w", filename, id, err)
+			}
 		}
-		metadata = append(metadata, parsed.Metadata)
-	}
 
-	if len(metadata) <= s.maxEntries {
-		return nil
+		if err := from.Delete(id); err != nil {
+			return migrated, fmt.Errorf("failed to remove migrated entry %s: %w", id, err)
+		}
+		migrated++
 	}
+	return migrated, nil
+}
 
-	sort.Slice(metadata, func(i, j int) bool {
-		return metadata[i].CompletedAt.Before(metadata[j].CompletedAt)
-	})
-
-	toDelete := metadata[:len(metadata)-s.maxEntries]
-	for _, entry := range toDelete {
-		_ = os.RemoveAll(s.EntryDir(entry.ID))
+func validateExportFilename(filename string) error {
+	if filename == "" || filename != filepath.Base(filename) || strings.HasPrefix(filename, ".") {
+		return fmt.Errorf("invalid export filename: %q", filename)
 	}
-
 	return nil
 }
@@ -0,0 +1,163 @@
+package history
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	BucketNone = "none"
+	BucketDay  = "day"
+)
+
+type TrendQuery struct {
+	// Image is either a repository, matching every tag and digest of it, or
+	// a full reference matching only that tag or digest.
+	Image  string
+	Bucket string
+	From   time.Time
+	To     time.Time
+}
+
+// TrendPoint is one entry, or with day bucketing the mean of every entry
+// completed that day. EntryID is only set for unbucketed points.
+type TrendPoint struct {
+	Time       time.Time `json:"time"`
+	EntryID    string    `json:"entryId,omitempty"`
+	Image      string    `json:"image,omitempty"`
+	EntryCount int       `json:"entryCount"`
+	Summary    Summary   `json:"summary"`
+}
+
+type Trend struct {
+	Image  string       `json:"image"`
+	Bucket string       `json:"bucket"`
+	Points []TrendPoint `json:"points"`
+}
+
+func ParseTrendQuery(values url.Values) (TrendQuery, error) {
+	query := TrendQuery{
+		Image:  strings.TrimSpace(values.Get("image")),
+		Bucket: strings.ToLower(strings.TrimSpace(values.Get("bucket"))),
+	}
+	if query.Image == "" {
+		return TrendQuery{}, fmt.Errorf("image is required")
+	}
+	switch query.Bucket {
+	case "":
+		query.Bucket = BucketNone
+	case BucketNone, BucketDay:
+	default:
+		return TrendQuery{}, fmt.Errorf("bucket must be none or day")
+	}
+
+	var err error
+	if query.From, err = parseQueryTime(values.Get("from"), false); err != nil {
+		return TrendQuery{}, err
+	}
+	if query.To, err = parseQueryTime(values.Get("to"), true); err != nil {
+		return TrendQuery{}, err
+	}
+	return query, nil
+}
+
+func (q TrendQuery) Matches(entry Metadata) bool {
+	if Repository(q.Image) == q.Image {
+		if Repository(entry.Image) != q.Image {
+			return false
+		}
+	} else if entry.Image != q.Image {
+		return false
+	}
+	if !q.From.IsZero() && entry.CompletedAt.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && entry.CompletedAt.After(q.To) {
+		return false
+	}
+	return true
+}
+
+// Build returns the matching entries oldest first, bucketed if requested.
+func (q TrendQuery) Build(entries []Metadata) Trend {
+	matches := make([]Metadata, 0, len(entries))
+	for _, entry := range entries {
+		if q.Matches(entry) {
+			matches = append(matches, entry)
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].CompletedAt.Before(matches[j].CompletedAt)
+	})
+
+	trend := Trend{Image: q.Image, Bucket: q.Bucket, Points: []TrendPoint{}}
+	if q.Bucket != BucketDay {
+		for _, entry := range matches {
+			trend.Points = append(trend.Points, TrendPoint{
+				Time:       entry.CompletedAt,
+				EntryID:    entry.ID,
+				Image:      entry.Image,
+				EntryCount: 1,
+				Summary:    entry.Summary,
+			})
+		}
+		return trend
+	}
+
+	for start := 0; start < len(matches); {
+		day := truncateDay(matches[start].CompletedAt)
+		end := start
+		for end < len(matches) && truncateDay(matches[end].CompletedAt).Equal(day) {
+			end++
+		}
+		trend.Points = append(trend.Points, TrendPoint{
+			Time:       day,
+			EntryCount: end - start,
+			Summary:    meanSummary(matches[start:end]),
+		})
+		start = end
+	}
+	return trend
+}
+
+func truncateDay(value time.Time) time.Time {
+	value = value.UTC()
+	return time.Date(value.Year(), value.Month(), value.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// meanSummary averages entries' summaries. Compression estimates are only
+// averaged over the entries that recorded them.
+func meanSummary(entries []Metadata) Summary {
+	var total Summary
+	var efficiency float64
+	var layers, measured int64
+	for _, entry := range entries {
+		total.SizeBytes += entry.Summary.SizeBytes
+		total.InefficientBytes += entry.Summary.InefficientBytes
+		efficiency += entry.Summary.EfficiencyScore
+		layers += int64(entry.Summary.LayerCount)
+		if entry.Summary.EstimatedPullBytes > 0 {
+			measured++
+			total.EstimatedPullBytes += entry.Summary.EstimatedPullBytes
+			total.GzipSizeBytes += entry.Summary.GzipSizeBytes
+			total.ZstdSizeBytes += entry.Summary.ZstdSizeBytes
+		}
+	}
+
+	count := int64(len(entries))
+	mean := Summary{
+		SizeBytes:        total.SizeBytes / count,
+		InefficientBytes: total.InefficientBytes / count,
+		EfficiencyScore:  efficiency / float64(count),
+		LayerCount:       int((layers + count/2) / count),
+	}
+	if measured > 0 {
+		mean.EstimatedPullBytes = total.EstimatedPullBytes / measured
+		mean.GzipSizeBytes = total.GzipSizeBytes / measured
+		mean.ZstdSizeBytes = total.ZstdSizeBytes / measured
+	}
+	return mean
+}
@@ -4,12 +4,21 @@ import (
 	"encoding/json"
 	"fmt"
 	"time"
+
+	"deep-dive/audit"
+	"deep-dive/breakdown"
+	"deep-dive/compression"
+	"deep-dive/dive"
 )
 
 type Summary struct {
-	SizeBytes        int64   `json:"sizeBytes"`
-	InefficientBytes int64   `json:"inefficientBytes"`
-	EfficiencyScore  float64 `json:"efficiencyScore"`
+	SizeBytes          int64   `json:"sizeBytes"`
+	InefficientBytes   int64   `json:"inefficientBytes"`
+	EfficiencyScore    float64 `json:"efficiencyScore"`
+	EstimatedPullBytes int64   `json:"estimatedPullBytes,omitempty"`
+	GzipSizeBytes      int64   `json:"gzipSizeBytes,omitempty"`
+	ZstdSizeBytes      int64   `json:"zstdSizeBytes,omitempty"`
+	LayerCount         int     `json:"layerCount,omitempty"`
 }
 
 type Metadata struct {
@@ -20,11 +29,41 @@ type Metadata struct {
 	CreatedAt   time.Time `json:"createdAt"`
 	CompletedAt time.Time `json:"completedAt"`
 	Summary     Summary   `json:"summary"`
+	Pinned      bool      `json:"pinned,omitempty"`
+	Notes       string    `json:"notes,omitempty"`
+	Labels      []string  `json:"labels,omitempty"`
+	// Baseline marks the entry other analyses of its repository are
+	// compared with; BaselineDelta is that comparison, taken when this
+	// entry was saved.
+	Baseline      bool           `json:"baseline,omitempty"`
+	BaselineDelta *BaselineDelta `json:"baselineDelta,omitempty"`
+	// StoredBytes and LogicalBytes are maintained by the store: the size of
+	// the entry as written to disk and the size of its uncompressed JSON.
+	StoredBytes  int64 `json:"storedBytes,omitempty"`
+	LogicalBytes int64 `json:"logicalBytes,omitempty"`
+	// ResultDigest names the content-addressed blob holding the analysis
+	// result. Entries written before results were shared keep it inline.
+	ResultDigest string `json:"resultDigest,omitempty"`
+	// Layers lists the result's layers, so layer sharing can be analyzed
+	// without loading results. Entries saved before it was recorded leave
+	// it empty.
+	Layers []LayerRef `json:"layers,omitempty"`
+}
+
+// LayerRef identifies one layer of an analyzed image, in image order.
+type LayerRef struct {
+	DigestID  string `json:"digestId,omitempty"`
+	SizeBytes int64  `json:"sizeBytes"`
+	Command   string `json:"command,omitempty"`
 }
 
 type Entry struct {
-	Metadata Metadata        `json:"metadata"`
-	Result   json.RawMessage `json:"result"`
+	SchemaVersion int                  `json:"schemaVersion"`
+	Metadata      Metadata             `json:"metadata"`
+	Result        json.RawMessage      `json:"result"`
+	Breakdown     *breakdown.Breakdown `json:"breakdown,omitempty"`
+	Audit         *audit.Report        `json:"audit,omitempty"`
+	Compression   *compression.Report  `json:"compression,omitempty"`
 }
 
 type diveSummaryPayload struct {
@@ -33,16 +72,13 @@ type diveSummaryPayload struct {
 		InefficientBytes int64   `json:"inefficientBytes"`
 		EfficiencyScore  float64 `json:"efficiencyScore"`
 	} `json:"image"`
+	Layers []json.RawMessage `json:"layer"`
 }
 
 func NewEntry(id string, image string, imageID string, source string, startedAt time.Time, completedAt time.Time, result json.RawMessage) (Entry, error) {
-	if len(result) == 0 {
-		return Entry{}, fmt.Errorf("analysis result is empty")
-	}
-
-	var payload diveSummaryPayload
-	if err := json.Unmarshal(result, &payload); err != nil {
-		return Entry{}, fmt.Errorf("failed to parse analysis result: %w", err)
+	parsed, err := dive.Parse(result)
+	if err != nil {
+		return Entry{}, err
 	}
 
 	metadata := Metadata{
@@ -53,14 +89,36 @@ func NewEntry(id string, image string, imageID string, source string, startedAt
 		CreatedAt:   startedAt,
 		CompletedAt: completedAt,
 		Summary: Summary{
-			SizeBytes:        payload.Image.SizeBytes,
-			InefficientBytes: payload.Image.InefficientBytes,
-			EfficiencyScore:  payload.Image.EfficiencyScore,
+			SizeBytes:        parsed.Image.SizeBytes,
+			InefficientBytes: parsed.Image.InefficientBytes,
+			EfficiencyScore:  parsed.Image.EfficiencyScore,
+			LayerCount:       len(parsed.Layers),
 		},
+		Layers: LayerRefs(parsed),
 	}
 
 	return Entry{
-		Metadata: metadata,
-		Result:   result,
+		SchemaVersion: CurrentSchemaVersion,
+		Metadata:      metadata,
+		Result:        result,
 	}, nil
 }
+
+// LayerRefs lists the layers of a parsed result as recorded in Metadata.
+func LayerRefs(result dive.Result) []LayerRef {
+	layers := make([]LayerRef, 0, len(result.Layers))
+	for _, layer := range result.Layers {
+		layers = append(layers, LayerRef{DigestID: layer.DigestID, SizeBytes: layer.SizeBytes, Command: layer.Command})
+	}
+	return layers
+}
+
+// LayerCount returns the number of layers in the entry's result, for entries
+// saved before Summary recorded it.
+func (e Entry) LayerCount() (int, error) {
+	var payload diveSummaryPayload
+	if err := json.Unmarshal(e.Result, &payload); err != nil {
+		return 0, fmt.Errorf("failed to parse analysis result: %w", err)
+	}
+	return len(payload.Layers), nil
+}
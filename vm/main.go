@@ -9,25 +9,38 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"math"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
-	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"deep-dive/audit"
+	"deep-dive/breakdown"
 	"deep-dive/ci"
+	"deep-dive/compare"
+	"deep-dive/compression"
+	"deep-dive/dive"
 	"deep-dive/exports"
+	"deep-dive/filediff"
 	"deep-dive/history"
+	"deep-dive/recommendations"
+	"deep-dive/search"
+	"deep-dive/sharing"
+	"deep-dive/simulate"
 	"github.com/labstack/echo"
 	"github.com/sirupsen/logrus"
 )
 
 const analysisTimeout = 5 * time.Minute
+const dockerSocketPath = "/var/run/docker.sock"
 const historyDir = "/data/history"
-const historyMaxEntries = 50
+const compareCacheDir = "/data/compare-cache"
 
 type JobStatus string
 
@@ -114,6 +127,26 @@ type AnalysisErrorResponse struct {
 
 type ExportRequest struct {
 	Format string `json:"format"`
+	// Detail and CompareTo only apply to markdown exports; CompareTo names
+	// the history entry to show a delta against. Such exports are stored
+	// under their own name and downloaded with the compareTo query
+	// parameter, leaving the plain markdown export alone.
+	Detail    string `json:"detail,omitempty"`
+	CompareTo string `json:"compareTo,omitempty"`
+	// Rules applies to sarif and junit exports and replaces Dive's default
+	// CI thresholds. Dockerfile only applies to sarif exports; it is the
+	// content the image was built from, used to point findings at
+	// instructions.
+	Rules      *ci.RulesRequest `json:"rules,omitempty"`
+	Dockerfile string           `json:"dockerfile,omitempty"`
+}
+
+type FileDiffResponse struct {
+	Left     compare.EntryRef `json:"left"`
+	Right    compare.EntryRef `json:"right"`
+	Files    filediff.Result  `json:"files"`
+	Warnings []string         `json:"warnings,omitempty"`
+	Cached   bool             `json:"cached"`
 }
 
 type ExportResponse struct {
@@ -123,13 +156,68 @@ type ExportResponse struct {
 }
 
 var jobStore = NewJobStore()
-var historyStore = history.NewStore(historyDir, historyMaxEntries)
+var historyStore history.Store
+var historyRetention = history.DefaultRetentionPolicy()
+var historySearchIndex = search.NewIndex()
+var compareCache *compare.Cache
+var compressionEstimates = true
+var compressionOptions = compression.DefaultOptions()
+
+// auditOptions is applied to the audit saved with every history entry.
+var auditOptions = audit.DefaultOptions()
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate-history" {
+		if err := runMigrateHistory(os.Args[2:]); err != nil {
+			logrus.WithError(err).Fatal("History migration failed")
+		}
+		return
+	}
+
 	var socketPath string
+	var historyBackend string
+	var historyCompression string
+	var historyMigrateOnStart bool
+	var compareCachePath string
+	var compareCacheEntries int
+	var auditExpectedUIDs string
 	flag.StringVar(&socketPath, "socket", "/run/guest/volumes-service.sock", "Unix domain socket to listen on")
+	flag.StringVar(&historyBackend, "history-backend", history.BackendFile, "History storage backend (file or bolt)")
+	flag.BoolVar(&historyMigrateOnStart, "history-migrate-on-start", true, "Upgrade history entries stored with an older schema at startup")
+	flag.StringVar(&historyCompression, "history-compression", history.DefaultCompression, "Compression for stored history entries (zstd, gzip or none)")
+	flag.IntVar(&historyRetention.MaxEntries, "history-max-entries", historyRetention.MaxEntries, "Maximum number of history entries to keep")
+	flag.IntVar(&historyRetention.MaxEntriesPerImage, "history-max-entries-per-image", 0, "Maximum history entries per image repository (0 for no limit)")
+	flag.IntVar(&historyRetention.MaxAgeDays, "history-max-age-days", 0, "Prune history entries older than this many days (0 for no limit)")
+	flag.Int64Var(&historyRetention.MaxTotalBytes, "history-max-bytes", 0, "Maximum bytes of history kept on disk (0 for no limit)")
+	flag.IntVar(&historyRetention.KeepLatestPerTag, "history-keep-latest-per-tag", 0, "Always keep this many of the newest entries per image tag")
+	flag.StringVar(&compareCachePath, "compare-cache-dir", compareCacheDir, "Directory for cached comparisons (empty to disable)")
+	flag.IntVar(&compareCacheEntries, "compare-cache-entries", compare.DefaultMaxCachedDiffs, "Maximum number of cached comparisons")
+	flag.BoolVar(&compressionEstimates, "compression-estimates", compressionEstimates, "Measure compressed layer sizes after each analysis")
+	flag.IntVar(&compressionOptions.GzipLevel, "gzip-level", compressionOptions.GzipLevel, "gzip level used to estimate compressed layer sizes")
+	flag.IntVar(&compressionOptions.ZstdLevel, "zstd-level", compressionOptions.ZstdLevel, "zstd level used to estimate compressed layer sizes")
+	flag.StringVar(&auditExpectedUIDs, "audit-expected-uids", "0", "Comma-separated UIDs files are expected to be owned by; the saved audit reports any other owner (empty to skip the check)")
 	flag.Parse()
 
+	expectedUIDs, err := audit.ParseUIDs(auditExpectedUIDs)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid -audit-expected-uids")
+	}
+	auditOptions.ExpectedUIDs = expectedUIDs
+
+	store, err := history.Open(historyBackend, historyDir, history.Options{
+		Retention:   historyRetention,
+		Compression: historyCompression,
+	})
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to open history store")
+	}
+	defer store.Close()
+	historyStore = store
+	compareCache = compare.NewCache(compareCachePath, compareCacheEntries)
+	if historyMigrateOnStart {
+		migrateHistorySchema()
+	}
+
 	os.RemoveAll(socketPath)
 
 	logrus.New().Infof("Starting listening on %s\n", socketPath)
@@ -150,10 +238,32 @@ func main() {
 	router.GET("/analysis/:id/result", getAnalysisResult)
 	router.GET("/history", listHistory)
 	router.DELETE("/history", deleteHistoryAll)
+	router.GET("/history/stats", getHistoryStats)
+	router.GET("/history/trends", getHistoryTrends)
+	router.GET("/history/search", searchHistory)
+	router.GET("/history/baselines", listHistoryBaselines)
+	router.GET("/history/layers", getHistoryLayerSharing)
+	router.GET("/history/bundle", exportHistoryBundle)
+	router.GET("/history/schema", getHistorySchema)
+	router.POST("/history/schema/migrate", migrateHistorySchemaHandler)
+	router.POST("/history/fsck", checkHistory)
+	router.POST("/history/bundle", importHistoryBundle, bodyLimit(maxBundleUploadBytes))
 	router.GET("/history/:id", getHistoryEntry)
 	router.DELETE("/history/:id", deleteHistoryEntry)
+	router.PATCH("/history/:id", patchHistoryEntry)
+	router.POST("/history/:id/pin", pinHistoryEntry)
+	router.DELETE("/history/:id/pin", unpinHistoryEntry)
+	router.POST("/history/:id/baseline", setHistoryBaseline)
+	router.DELETE("/history/:id/baseline", clearHistoryBaseline)
 	router.POST("/history/:id/export", createHistoryExport)
 	router.GET("/history/:id/export/:format", downloadHistoryExport)
+	router.POST("/history/:id/whatif", simulateHistoryEntry)
+	router.GET("/history/:id/recommendations", getHistoryRecommendations)
+	router.GET("/history/:id/breakdown", getHistoryBreakdown)
+	router.GET("/history/:id/audit", getHistoryAudit)
+	router.GET("/compare", compareHistoryEntries)
+	router.GET("/compare/files", compareHistoryFiles)
+	router.GET("/compare/series", compareHistorySeries)
 	router.POST("/ci/rules", createCIRules)
 
 	if err := router.Start(startURL); err != nil {
@@ -161,6 +271,59 @@ func main() {
 	}
 }
 
+// migrateHistorySchema upgrades outdated entries at startup and logs any
+// entry that can't be read, so it isn't just missing from the list.
+func migrateHistorySchema() {
+	report, err := historyStore.MigrateSchema(false)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to migrate history schema")
+		return
+	}
+	if len(report.Migrated) > 0 {
+		logrus.Infof("Migrated %d history entries to schema %d", len(report.Migrated), report.CurrentVersion)
+	}
+	for _, failure := range report.Failed {
+		logrus.WithField("id", failure.ID).Warnf("History entry can't be migrated: %s", failure.Error)
+	}
+}
+
+func runMigrateHistory(args []string) error {
+	flags := flag.NewFlagSet("migrate-history", flag.ExitOnError)
+	from := flags.String("from", history.BackendFile, "Backend to move history entries from")
+	to := flags.String("to", history.BackendBolt, "Backend to move history entries to")
+	dir := flags.String("dir", historyDir, "History directory")
+	compression := flags.String("compression", history.DefaultCompression, "Compression for entries written to the destination (zstd, gzip or none)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if strings.EqualFold(*from, *to) {
+		return fmt.Errorf("source and destination backends are both %s", *from)
+	}
+
+	// Migration must not prune, so both sides keep every entry.
+	keepAll := history.Options{
+		Retention:   history.RetentionPolicy{MaxEntries: math.MaxInt},
+		Compression: *compression,
+	}
+	source, err := history.Open(*from, *dir, keepAll)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	destination, err := history.Open(*to, *dir, keepAll)
+	if err != nil {
+		return err
+	}
+	defer destination.Close()
+
+	migrated, err := history.Migrate(source, destination)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Moved %d history entries from %s to %s", migrated, *from, *to)
+	return nil
+}
+
 func listen(path string) (net.Listener, error) {
 	return net.Listen("unix", path)
 }
@@ -296,8 +459,35 @@ func runAnalyzeJob(jobID string, req AnalyzeRequest, target string) {
 		logrus.WithError(err).Warn("Failed to build history entry")
 		return
 	}
+	if parsed, err := dive.Parse(job.Result); err == nil {
+		if parsed.HasFileData() {
+			classified := breakdown.Classify(parsed)
+			entry.Breakdown = &classified
+			findings := audit.Run(parsed, auditOptions)
+			entry.Audit = &findings
+		}
+	} else {
+		logrus.WithError(err).Warn("Failed to inspect image contents")
+	}
+	if err := history.AttachBaselineDelta(historyStore, &entry); err != nil {
+		logrus.WithError(err).Warn("Failed to compare with baseline")
+	}
 	if err := historyStore.Save(entry); err != nil {
 		logrus.WithError(err).Warn("Failed to persist history entry")
+		return
+	}
+
+	// Re-compressing every layer takes about as long as the analysis, so it
+	// runs after the job has succeeded and the entry is updated when done.
+	if compressionEstimates {
+		report, err := measureCompression(req.Source, target)
+		if err != nil {
+			logrus.WithError(err).Warn("Failed to measure compressed layer sizes")
+			return
+		}
+		if _, err := history.AttachCompression(historyStore, entry.Metadata.ID, report); err != nil && !errors.Is(err, history.ErrNotFound) {
+			logrus.WithError(err).Warn("Failed to attach compressed layer sizes")
+		}
 	}
 }
 
@@ -420,6 +610,20 @@ func runDive(jobID string, source string, target string) (json.RawMessage, error
 	return json.RawMessage(byteValue), nil
 }
 
+func measureCompression(source string, target string) (compression.Report, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), analysisTimeout)
+	defer cancel()
+
+	switch source {
+	case "docker":
+		return compression.MeasureDockerImage(ctx, dockerSocketPath, target, compressionOptions)
+	case "docker-archive":
+		return compression.MeasureArchiveFile(target, compressionOptions)
+	default:
+		return compression.Report{}, fmt.Errorf("Unsupported source: %s", source)
+	}
+}
+
 // parseProgressMessage extracts progress stage messages from Dive CLI output
 func parseProgressMessage(line string) string {
 	line = strings.TrimSpace(line)
@@ -474,6 +678,10 @@ func jsonError(c echo.Context, status int, message string) error {
 }
 
 func listHistory(c echo.Context) error {
+	query, err := history.ParseQuery(c.QueryParams())
+	if err != nil {
+		return jsonError(c, http.StatusBadRequest, err.Error())
+	}
 	entries, err := historyStore.List()
 	if err != nil {
 		return jsonError(
@@ -482,7 +690,23 @@ func listHistory(c echo.Context) error {
 			fmt.Sprintf("Failed to load history: %s", err),
 		)
 	}
-	return c.JSON(http.StatusOK, entries)
+	page, err := query.Apply(entries)
+	if err != nil {
+		return jsonError(c, http.StatusBadRequest, err.Error())
+	}
+	page.Entries = withoutLayers(page.Entries)
+	return c.JSON(http.StatusOK, page)
+}
+
+// withoutLayers drops the layer refs kept for layer sharing from listed
+// entries; they can run to hundreds per image and the entry itself has them.
+func withoutLayers(entries []history.Metadata) []history.Metadata {
+	listed := make([]history.Metadata, len(entries))
+	for i, entry := range entries {
+		entry.Layers = nil
+		listed[i] = entry
+	}
+	return listed
 }
 
 func getHistoryEntry(c echo.Context) error {
@@ -501,6 +725,353 @@ func getHistoryEntry(c echo.Context) error {
 	return c.JSON(http.StatusOK, entry)
 }
 
+func getHistoryStats(c echo.Context) error {
+	stats, err := historyStore.Stats()
+	if err != nil {
+		return jsonError(
+			c,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to load history stats: %s", err),
+		)
+	}
+	return c.JSON(http.StatusOK, stats)
+}
+
+func getHistoryTrends(c echo.Context) error {
+	query, err := history.ParseTrendQuery(c.QueryParams())
+	if err != nil {
+		return jsonError(c, http.StatusBadRequest, err.Error())
+	}
+	format := strings.ToLower(strings.TrimSpace(c.QueryParam("format")))
+	if format != "" && format != "json" && format != "csv" {
+		return jsonError(c, http.StatusBadRequest, "format must be json or csv")
+	}
+
+	entries, err := historyStore.List()
+	if err != nil {
+		return jsonError(
+			c,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to load history: %s", err),
+		)
+	}
+	// Entries saved before layer counts were recorded are counted from
+	// their results.
+	for i := range entries {
+		if entries[i].Summary.LayerCount > 0 || !query.Matches(entries[i]) {
+			continue
+		}
+		entry, err := historyStore.Get(entries[i].ID)
+		if err != nil {
+			continue
+		}
+		if count, err := entry.LayerCount(); err == nil {
+			entries[i].Summary.LayerCount = count
+		}
+	}
+
+	trend := query.Build(entries)
+	if format != "csv" {
+		return c.JSON(http.StatusOK, trend)
+	}
+	data, err := exports.TrendCSV(trend)
+	if err != nil {
+		return jsonError(c, http.StatusInternalServerError, fmt.Sprintf("Failed to export trend: %s", err))
+	}
+	c.Response().Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "trend.csv"))
+	return c.Blob(http.StatusOK, exports.ContentType(exports.FormatCSV), data)
+}
+
+// searchHistory finds files by path across the results of every stored
+// entry. The index is brought up to date on each request, so only entries
+// saved since the previous search are parsed.
+func searchHistory(c echo.Context) error {
+	query, err := search.ParseQuery(c.QueryParams())
+	if err != nil {
+		return jsonError(c, http.StatusBadRequest, err.Error())
+	}
+	if err := historySearchIndex.Sync(historyStore); err != nil {
+		return jsonError(
+			c,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to index history: %s", err),
+		)
+	}
+	return c.JSON(http.StatusOK, historySearchIndex.Search(query))
+}
+
+// getHistoryLayerSharing reports which layers the analyzed images share and
+// how much disk that saves. By default only the newest entry of each image
+// reference counts; scope=all includes every stored entry. Entries of the
+// same image ID count once.
+func getHistoryLayerSharing(c echo.Context) error {
+	options, err := sharing.ParseOptions(c.QueryParams())
+	if err != nil {
+		return jsonError(c, http.StatusBadRequest, err.Error())
+	}
+	report, err := sharing.Analyze(historyStore, options)
+	if err != nil {
+		return jsonError(
+			c,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to analyze history: %s", err),
+		)
+	}
+	return c.JSON(http.StatusOK, report)
+}
+
+// exportHistoryBundle archives the entries named in ids, or otherwise every
+// entry matching the list filters.
+func exportHistoryBundle(c echo.Context) error {
+	entries, err := historyStore.List()
+	if err != nil {
+		return jsonError(
+			c,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to load history: %s", err),
+		)
+	}
+	var ids []string
+	if value := strings.TrimSpace(c.QueryParam("ids")); value != "" {
+		known := make(map[string]bool, len(entries))
+		for _, entry := range entries {
+			known[entry.ID] = true
+		}
+		for _, id := range strings.Split(value, ",") {
+			if id = strings.TrimSpace(id); id == "" {
+				continue
+			}
+			if !known[id] {
+				return jsonError(c, http.StatusNotFound, fmt.Sprintf("History entry not found: %s", id))
+			}
+			ids = append(ids, id)
+		}
+	} else {
+		query, err := history.ParseQuery(c.QueryParams())
+		if err != nil {
+			return jsonError(c, http.StatusBadRequest, err.Error())
+		}
+		page, err := query.Apply(entries)
+		if err != nil {
+			return jsonError(c, http.StatusBadRequest, err.Error())
+		}
+		for _, entry := range page.Entries {
+			ids = append(ids, entry.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return jsonError(c, http.StatusNotFound, "No history entries to export")
+	}
+
+	// The bundle is streamed, so once the response has started a failure can
+	// only be logged and the download cut short.
+	filename := fmt.Sprintf("deep-dive-history-%s.tar.gz", time.Now().UTC().Format("20060102-150405"))
+	c.Response().Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Response().Header().Set(echo.HeaderContentType, "application/gzip")
+	c.Response().WriteHeader(http.StatusOK)
+	if _, err := history.WriteBundle(c.Response(), historyStore, ids); err != nil {
+		logrus.WithError(err).Warn("Failed to stream history bundle")
+	}
+	return nil
+}
+
+// maxBundleUploadBytes caps the compressed bundle a client may upload; the
+// history package separately caps what it decompresses.
+const maxBundleUploadBytes = 512 << 20
+
+// bodyLimit rejects request bodies larger than limit bytes with 413, before
+// or while they are read.
+func bodyLimit(limit int64) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			request := c.Request()
+			if request.ContentLength > limit {
+				return jsonError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body exceeds %d bytes", limit))
+			}
+			request.Body = http.MaxBytesReader(c.Response(), request.Body, limit)
+			return next(c)
+		}
+	}
+}
+
+// importHistoryBundle accepts a bundle either as the raw request body or as
+// a multipart "bundle" file field.
+func importHistoryBundle(c echo.Context) error {
+	conflict, err := history.ParseConflict(c.QueryParam("onConflict"))
+	if err != nil {
+		return jsonError(c, http.StatusBadRequest, err.Error())
+	}
+
+	var body io.Reader = c.Request().Body
+	if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+		file, err := c.FormFile("bundle")
+		if err != nil {
+			if tooLarge := new(http.MaxBytesError); errors.As(err, &tooLarge) {
+				return jsonError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body exceeds %d bytes", tooLarge.Limit))
+			}
+			return jsonError(c, http.StatusBadRequest, "Missing bundle file")
+		}
+		opened, err := file.Open()
+		if err != nil {
+			return jsonError(c, http.StatusBadRequest, "Failed to read uploaded bundle")
+		}
+		defer opened.Close()
+		body = opened
+	}
+
+	result, err := history.ImportBundle(body, historyStore, history.ImportOptions{
+		Conflict:     conflict,
+		NewID:        newJobID,
+		RenameExport: exports.RenameFilename,
+	})
+	if err != nil {
+		if tooLarge := new(http.MaxBytesError); errors.As(err, &tooLarge) {
+			return jsonError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body exceeds %d bytes", tooLarge.Limit))
+		}
+		if errors.Is(err, history.ErrInvalidBundle) {
+			return jsonError(c, http.StatusBadRequest, err.Error())
+		}
+		return jsonError(
+			c,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to import history bundle: %s", err),
+		)
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+func getHistorySchema(c echo.Context) error {
+	report, err := historyStore.MigrateSchema(true)
+	if err != nil {
+		return jsonError(
+			c,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to check history schema: %s", err),
+		)
+	}
+	return c.JSON(http.StatusOK, report)
+}
+
+func migrateHistorySchemaHandler(c echo.Context) error {
+	report, err := historyStore.MigrateSchema(false)
+	if err != nil {
+		return jsonError(
+			c,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to migrate history schema: %s", err),
+		)
+	}
+	return c.JSON(http.StatusOK, report)
+}
+
+func checkHistory(c echo.Context) error {
+	mode, err := history.ParseFsckMode(c.QueryParam("mode"))
+	if err != nil {
+		return jsonError(c, http.StatusBadRequest, err.Error())
+	}
+	report, err := historyStore.Fsck(mode)
+	if err != nil {
+		return jsonError(
+			c,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to check history: %s", err),
+		)
+	}
+	return c.JSON(http.StatusOK, report)
+}
+
+func pinHistoryEntry(c echo.Context) error {
+	return setHistoryPinned(c, true)
+}
+
+func unpinHistoryEntry(c echo.Context) error {
+	return setHistoryPinned(c, false)
+}
+
+func setHistoryPinned(c echo.Context, pinned bool) error {
+	id := c.Param("id")
+	metadata, err := historyStore.Update(id, func(metadata *history.Metadata) error {
+		metadata.Pinned = pinned
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, history.ErrNotFound) {
+			return jsonError(c, http.StatusNotFound, "History entry not found")
+		}
+		return jsonError(
+			c,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to update history entry: %s", err),
+		)
+	}
+	return c.JSON(http.StatusOK, metadata)
+}
+
+func listHistoryBaselines(c echo.Context) error {
+	entries, err := historyStore.List()
+	if err != nil {
+		return jsonError(
+			c,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to load history: %s", err),
+		)
+	}
+	return c.JSON(http.StatusOK, withoutLayers(history.Baselines(entries)))
+}
+
+func setHistoryBaseline(c echo.Context) error {
+	return updateHistoryBaseline(c, history.SetBaseline)
+}
+
+func clearHistoryBaseline(c echo.Context) error {
+	return updateHistoryBaseline(c, history.ClearBaseline)
+}
+
+func updateHistoryBaseline(c echo.Context, update func(store history.Store, id string) (history.Metadata, error)) error {
+	metadata, err := update(historyStore, c.Param("id"))
+	if err != nil {
+		if errors.Is(err, history.ErrNotFound) {
+			return jsonError(c, http.StatusNotFound, "History entry not found")
+		}
+		return jsonError(
+			c,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to update history entry: %s", err),
+		)
+	}
+	return c.JSON(http.StatusOK, metadata)
+}
+
+func patchHistoryEntry(c echo.Context) error {
+	var patch history.MetadataPatch
+	if err := c.Bind(&patch); err != nil {
+		return jsonError(c, http.StatusBadRequest, "Invalid request body")
+	}
+	if patch.IsEmpty() {
+		return jsonError(c, http.StatusBadRequest, "Provide notes, labels or pinned")
+	}
+
+	var invalid error
+	metadata, err := historyStore.Update(c.Param("id"), func(metadata *history.Metadata) error {
+		invalid = patch.Apply(metadata)
+		return invalid
+	})
+	if err != nil {
+		if errors.Is(err, history.ErrNotFound) {
+			return jsonError(c, http.StatusNotFound, "History entry not found")
+		}
+		if invalid != nil {
+			return jsonError(c, http.StatusBadRequest, invalid.Error())
+		}
+		return jsonError(
+			c,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to update history entry: %s", err),
+		)
+	}
+	return c.JSON(http.StatusOK, metadata)
+}
+
 func deleteHistoryAll(c echo.Context) error {
 	if err := historyStore.DeleteAll(); err != nil {
 		return jsonError(
@@ -544,6 +1115,25 @@ func createHistoryExport(c echo.Context) error {
 	if err != nil {
 		return jsonError(c, http.StatusBadRequest, err.Error())
 	}
+	options := exports.Options{}
+	if options.Detail, err = exports.ParseDetail(req.Detail); err != nil {
+		return jsonError(c, http.StatusBadRequest, err.Error())
+	}
+	if format == exports.FormatSARIF || format == exports.FormatJUnit {
+		if req.Rules != nil {
+			if err := req.Rules.Validate(); err != nil {
+				return jsonError(c, http.StatusBadRequest, err.Error())
+			}
+		}
+		options.Rules = req.Rules
+	}
+	if format == exports.FormatSARIF {
+		options.Dockerfile = req.Dockerfile
+	}
+	compareTo := strings.TrimSpace(req.CompareTo)
+	if compareTo != "" && format != exports.FormatMarkdown {
+		return jsonError(c, http.StatusBadRequest, "compareTo only applies to markdown exports")
+	}
 
 	entry, err := historyStore.Get(id)
 	if err != nil {
@@ -552,18 +1142,27 @@ func createHistoryExport(c echo.Context) error {
 		}
 		return jsonError(c, http.StatusInternalServerError, "Failed to load history entry")
 	}
+	if compareTo != "" {
+		target, err := historyStore.Get(compareTo)
+		if err != nil {
+			if errors.Is(err, history.ErrNotFound) {
+				return jsonError(c, http.StatusNotFound, "Comparison target not found")
+			}
+			return jsonError(c, http.StatusInternalServerError, "Failed to load history entry")
+		}
+		comparison, err := compareCache.Compare(target, entry)
+		if err != nil {
+			return jsonError(c, http.StatusInternalServerError, "Failed to compare history entries")
+		}
+		options.Comparison = &comparison
+	}
 
-	exported, err := exports.Generate(format, entry)
+	exported, err := exports.GenerateWithOptions(format, entry, options)
 	if err != nil {
 		return jsonError(c, http.StatusInternalServerError, "Failed to generate export")
 	}
 
-	exportDir := historyStore.ExportsDir(id)
-	if err := os.MkdirAll(exportDir, 0o755); err != nil {
-		return jsonError(c, http.StatusInternalServerError, "Failed to prepare export storage")
-	}
-	exportPath := filepath.Join(exportDir, exported.Filename)
-	if err := os.WriteFile(exportPath, exported.Data, 0o644); err != nil {
+	if err := historyStore.SaveExport(id, exported.Filename, exported.Data); err != nil {
 		return jsonError(c, http.StatusInternalServerError, "Failed to store export")
 	}
 
@@ -574,6 +1173,8 @@ func createHistoryExport(c echo.Context) error {
 	})
 }
 
+// downloadHistoryExport returns a stored export. compareTo selects the
+// markdown export generated with a delta against that entry.
 func downloadHistoryExport(c echo.Context) error {
 	id := c.Param("id")
 	formatParam := c.Param("format")
@@ -583,10 +1184,15 @@ func downloadHistoryExport(c echo.Context) error {
 	}
 
 	filename := exports.Filename(id, format)
-	exportPath := filepath.Join(historyStore.ExportsDir(id), filename)
-	data, err := os.ReadFile(exportPath)
+	if compareTo := strings.TrimSpace(c.QueryParam("compareTo")); compareTo != "" {
+		if format != exports.FormatMarkdown {
+			return jsonError(c, http.StatusBadRequest, "compareTo only applies to markdown exports")
+		}
+		filename = exports.ComparisonFilename(id, compareTo)
+	}
+	data, err := historyStore.GetExport(id, filename)
 	if err != nil {
-		if os.IsNotExist(err) {
+		if errors.Is(err, history.ErrExportNotFound) {
 			return jsonError(c, http.StatusNotFound, "Export not found")
 		}
 		return jsonError(c, http.StatusInternalServerError, "Failed to read export")
@@ -596,6 +1202,273 @@ func downloadHistoryExport(c echo.Context) error {
 	return c.Blob(http.StatusOK, exports.ContentType(format), data)
 }
 
+func simulateHistoryEntry(c echo.Context) error {
+	id := c.Param("id")
+	var plan simulate.Plan
+	if err := c.Bind(&plan); err != nil {
+		return jsonError(c, http.StatusBadRequest, "Invalid what-if plan payload")
+	}
+
+	entry, err := historyStore.Get(id)
+	if err != nil {
+		if errors.Is(err, history.ErrNotFound) {
+			return jsonError(c, http.StatusNotFound, "History entry not found")
+		}
+		return jsonError(c, http.StatusInternalServerError, "Failed to load history entry")
+	}
+
+	result, err := dive.Parse(entry.Result)
+	if err != nil {
+		return jsonError(c, http.StatusInternalServerError, err.Error())
+	}
+	outcome, err := simulate.Run(result, plan)
+	if err != nil {
+		if errors.Is(err, dive.ErrNoFileData) {
+			return jsonError(c, http.StatusUnprocessableEntity, "History entry has no per-layer file data to simulate")
+		}
+		return jsonError(c, http.StatusBadRequest, err.Error())
+	}
+	return c.JSON(http.StatusOK, outcome)
+}
+
+// compareHistoryEntries compares two history entries, right against left.
+// fileLimit caps the listed file and directory changes (default 500, 0 for
+// all); the totals always cover every change.
+func compareHistoryEntries(c echo.Context) error {
+	return respondComparison(c, false)
+}
+
+// compareHistoryFiles returns only the file-level diff, as JSON or as a CSV
+// or HTML export. Changes and directories are sorted by absolute byte delta,
+// largest first and then by path, so big removals rank with big additions.
+// limit defaults to 500 for JSON and to everything for exports; depth hides
+// directory roll-ups below that depth.
+func compareHistoryFiles(c echo.Context) error {
+	return respondComparison(c, true)
+}
+
+func respondComparison(c echo.Context, filesOnly bool) error {
+	leftID := strings.TrimSpace(c.QueryParam("left"))
+	rightID := strings.TrimSpace(c.QueryParam("right"))
+	if leftID == "" || rightID == "" {
+		return jsonError(c, http.StatusBadRequest, "left and right are required")
+	}
+	format := exports.FormatJSON
+	limitParam := "fileLimit"
+	if filesOnly {
+		limitParam = "limit"
+		if value := strings.TrimSpace(c.QueryParam("format")); value != "" {
+			parsed, err := exports.ParseFormat(value)
+			if err != nil || (parsed != exports.FormatJSON && parsed != exports.FormatCSV && parsed != exports.FormatHTML) {
+				return jsonError(c, http.StatusBadRequest, "format must be json, csv or html")
+			}
+			format = parsed
+		}
+	}
+	limits := filediff.Limits{}
+	if format == exports.FormatJSON {
+		limits.MaxChanges = 500
+		limits.MaxDirectories = 500
+	}
+	if value := strings.TrimSpace(c.QueryParam(limitParam)); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return jsonError(c, http.StatusBadRequest, fmt.Sprintf("%s must be a non-negative integer", limitParam))
+		}
+		limits.MaxChanges = parsed
+		limits.MaxDirectories = parsed
+	}
+	if value := strings.TrimSpace(c.QueryParam("depth")); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return jsonError(c, http.StatusBadRequest, "depth must be a non-negative integer")
+		}
+		limits.MaxDepth = parsed
+	}
+
+	entries := make([]history.Entry, 2)
+	for i, id := range []string{leftID, rightID} {
+		entry, err := historyStore.Get(id)
+		if err != nil {
+			if errors.Is(err, history.ErrNotFound) {
+				return jsonError(c, http.StatusNotFound, fmt.Sprintf("History entry not found: %s", id))
+			}
+			return jsonError(c, http.StatusInternalServerError, "Failed to load history entry")
+		}
+		entries[i] = entry
+	}
+
+	comparison, err := compareCache.Compare(entries[0], entries[1])
+	if err != nil {
+		return jsonError(
+			c,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to compare history entries: %s", err),
+		)
+	}
+	comparison.Files.Limit(limits)
+	if !filesOnly {
+		return c.JSON(http.StatusOK, comparison)
+	}
+
+	var data []byte
+	switch format {
+	case exports.FormatCSV:
+		data, err = exports.FileDiffCSV(comparison)
+	case exports.FormatHTML:
+		data, err = exports.FileDiffHTML(comparison)
+	default:
+		return c.JSON(http.StatusOK, FileDiffResponse{
+			Left:     comparison.Left,
+			Right:    comparison.Right,
+			Files:    comparison.Files,
+			Warnings: comparison.Warnings,
+			Cached:   comparison.Cached,
+		})
+	}
+	if err != nil {
+		return jsonError(c, http.StatusInternalServerError, fmt.Sprintf("Failed to export diff: %s", err))
+	}
+	c.Response().Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exports.FileDiffFilename(leftID, rightID, format)))
+	return c.Blob(http.StatusOK, exports.ContentType(format), data)
+}
+
+// compareHistorySeries compares the entries listed in ids, in that order.
+// fileLimit caps the listed common files (default 200, 0 for all) and
+// format=html returns a report instead of JSON.
+func compareHistorySeries(c echo.Context) error {
+	var ids []string
+	seen := make(map[string]bool)
+	for _, id := range strings.Split(c.QueryParam("ids"), ",") {
+		if id = strings.TrimSpace(id); id == "" {
+			continue
+		}
+		if seen[id] {
+			return jsonError(c, http.StatusBadRequest, fmt.Sprintf("Duplicate history entry: %s", id))
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	if len(ids) < compare.MinSeriesEntries || len(ids) > compare.MaxSeriesEntries {
+		return jsonError(c, http.StatusBadRequest, fmt.Sprintf("ids must list %d to %d history entries", compare.MinSeriesEntries, compare.MaxSeriesEntries))
+	}
+	format := strings.ToLower(strings.TrimSpace(c.QueryParam("format")))
+	if format != "" && format != "json" && format != "html" {
+		return jsonError(c, http.StatusBadRequest, "format must be json or html")
+	}
+	fileLimit := 200
+	if value := strings.TrimSpace(c.QueryParam("fileLimit")); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return jsonError(c, http.StatusBadRequest, "fileLimit must be a non-negative integer")
+		}
+		fileLimit = parsed
+	}
+
+	entries := make([]history.Entry, len(ids))
+	for i, id := range ids {
+		entry, err := historyStore.Get(id)
+		if err != nil {
+			if errors.Is(err, history.ErrNotFound) {
+				return jsonError(c, http.StatusNotFound, fmt.Sprintf("History entry not found: %s", id))
+			}
+			return jsonError(c, http.StatusInternalServerError, "Failed to load history entry")
+		}
+		entries[i] = entry
+	}
+
+	series, err := compare.CompareSeries(entries, fileLimit)
+	if err != nil {
+		return jsonError(
+			c,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to compare history entries: %s", err),
+		)
+	}
+	if format != "html" {
+		return c.JSON(http.StatusOK, series)
+	}
+	data, err := exports.SeriesHTML(series)
+	if err != nil {
+		return jsonError(c, http.StatusInternalServerError, fmt.Sprintf("Failed to export comparison: %s", err))
+	}
+	c.Response().Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "dive-comparison.html"))
+	return c.Blob(http.StatusOK, exports.ContentType(exports.FormatHTML), data)
+}
+
+func getHistoryRecommendations(c echo.Context) error {
+	id := c.Param("id")
+	entry, err := historyStore.Get(id)
+	if err != nil {
+		if errors.Is(err, history.ErrNotFound) {
+			return jsonError(c, http.StatusNotFound, "History entry not found")
+		}
+		return jsonError(c, http.StatusInternalServerError, "Failed to load history entry")
+	}
+
+	result, err := dive.Parse(entry.Result)
+	if err != nil {
+		return jsonError(c, http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, recommendations.Generate(result))
+}
+
+func getHistoryBreakdown(c echo.Context) error {
+	id := c.Param("id")
+	entry, err := historyStore.Get(id)
+	if err != nil {
+		if errors.Is(err, history.ErrNotFound) {
+			return jsonError(c, http.StatusNotFound, "History entry not found")
+		}
+		return jsonError(c, http.StatusInternalServerError, "Failed to load history entry")
+	}
+	if entry.Breakdown != nil {
+		return c.JSON(http.StatusOK, entry.Breakdown)
+	}
+
+	result, err := dive.Parse(entry.Result)
+	if err != nil {
+		return jsonError(c, http.StatusInternalServerError, err.Error())
+	}
+	if !result.HasFileData() {
+		return jsonError(c, http.StatusUnprocessableEntity, "History entry has no per-layer file data to classify")
+	}
+	return c.JSON(http.StatusOK, breakdown.Classify(result))
+}
+
+func getHistoryAudit(c echo.Context) error {
+	id := c.Param("id")
+	options := auditOptions
+	expectedParam := strings.TrimSpace(c.QueryParam("expectedUids"))
+	if expectedParam != "" {
+		uids, err := audit.ParseUIDs(expectedParam)
+		if err != nil {
+			return jsonError(c, http.StatusBadRequest, fmt.Sprintf("Invalid UID list: %s", err))
+		}
+		options.ExpectedUIDs = uids
+	}
+
+	entry, err := historyStore.Get(id)
+	if err != nil {
+		if errors.Is(err, history.ErrNotFound) {
+			return jsonError(c, http.StatusNotFound, "History entry not found")
+		}
+		return jsonError(c, http.StatusInternalServerError, "Failed to load history entry")
+	}
+	if entry.Audit != nil && expectedParam == "" {
+		return c.JSON(http.StatusOK, entry.Audit)
+	}
+
+	result, err := dive.Parse(entry.Result)
+	if err != nil {
+		return jsonError(c, http.StatusInternalServerError, err.Error())
+	}
+	if !result.HasFileData() {
+		return jsonError(c, http.StatusUnprocessableEntity, "History entry has no per-layer file data to audit")
+	}
+	return c.JSON(http.StatusOK, audit.Run(result, options))
+}
+
 func createCIRules(c echo.Context) error {
 	var req ci.RulesRequest
 	if err := c.Bind(&req); err != nil {
@@ -0,0 +1,355 @@
+package recommendations
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"deep-dive/dive"
+)
+
+type Kind string
+
+const (
+	KindMultiStageBuild Kind = "multi-stage-build"
+	KindCacheCleanup    Kind = "cache-cleanup"
+	KindDockerignore    Kind = "dockerignore"
+	KindSlimmerBase     Kind = "slimmer-base"
+	KindDuplicateFiles  Kind = "duplicate-files"
+)
+
+const (
+	maxEvidence             = 10
+	minDuplicateFileBytes   = 1024
+	slimBaseThresholdBytes  = 100 * 1024 * 1024
+	slimBaseMinSavingsBytes = 10 * 1024 * 1024
+)
+
+type Evidence struct {
+	Path       string `json:"path"`
+	SizeBytes  int64  `json:"sizeBytes"`
+	LayerIndex int    `json:"layerIndex"`
+}
+
+type Recommendation struct {
+	Kind                  Kind   `json:"kind"`
+	Title                 string `json:"title"`
+	Description           string `json:"description"`
+	EstimatedSavingsBytes int64  `json:"estimatedSavingsBytes"`
+	// Heuristic marks estimates inferred from file names and sizes rather
+	// than measured, since Dive does not export file contents.
+	Heuristic bool       `json:"heuristic,omitempty"`
+	Evidence  []Evidence `json:"evidence"`
+}
+
+var buildToolPrefixes = []string{
+	"/usr/lib/gcc",
+	"/usr/libexec/gcc",
+	"/usr/include",
+	"/usr/local/go",
+	"/usr/local/cargo",
+	"/usr/local/rustup",
+	"/root/.cargo",
+	"/root/.rustup",
+	"/root/go/pkg",
+	"/usr/share/maven",
+}
+
+var buildToolBinaries = map[string]bool{
+	"gcc": true, "g++": true, "cc1": true, "cc1plus": true, "clang": true,
+	"make": true, "cmake": true, "ld": true, "as": true, "go": true, "rustc": true,
+	"cargo": true, "javac": true, "mvn": true, "gradle": true,
+}
+
+var cachePrefixes = []string{
+	"/var/cache/apt",
+	"/var/lib/apt/lists",
+	"/var/cache/apk",
+	"/var/cache/yum",
+	"/var/cache/dnf",
+	"/root/.cache",
+	"/root/.npm",
+	"/usr/local/share/.cache",
+	"/root/.m2/repository",
+	"/root/.gradle/caches",
+	"/tmp",
+	"/var/tmp",
+}
+
+// slimVariantPrefixes hold what slim, alpine and distroless variants of a
+// distribution base usually leave out. Toolchains are left to
+// buildToolPrefixes so their bytes are not suggested twice.
+var slimVariantPrefixes = []string{
+	"/usr/share/doc",
+	"/usr/share/man",
+	"/usr/share/info",
+	"/usr/share/locale",
+	"/usr/lib/locale",
+	"/var/lib/apt/lists",
+	"/var/cache/apt",
+}
+
+var dockerignoreNames = map[string]bool{
+	".git": true, "node_modules": true, "__pycache__": true, ".pytest_cache": true,
+	".DS_Store": true, ".env": true, ".idea": true, ".vscode": true, "coverage": true,
+	".terraform": true, ".tox": true,
+}
+
+var dockerignoreSuffixes = []string{".log", ".swp", ".tmp", ".pyc"}
+
+// Generate inspects the analysis result and returns suggestions ordered by
+// estimated savings, largest first.
+func Generate(result dive.Result) []Recommendation {
+	recommendations := []Recommendation{}
+	if result.HasFileData() {
+		aggregate := result.Aggregate()
+		recommendations = appendIfUseful(recommendations, multiStageBuild(aggregate))
+		recommendations = appendIfUseful(recommendations, cacheCleanup(result))
+		recommendations = appendIfUseful(recommendations, dockerignore(result))
+		recommendations = appendIfUseful(recommendations, slimmerBase(result))
+		recommendations = appendIfUseful(recommendations, duplicateFiles(aggregate))
+	} else {
+		recommendations = appendIfUseful(recommendations, cacheCleanupFromReferences(result.Image.FileReference))
+	}
+
+	sort.SliceStable(recommendations, func(i, j int) bool {
+		return recommendations[i].EstimatedSavingsBytes > recommendations[j].EstimatedSavingsBytes
+	})
+	return recommendations
+}
+
+func appendIfUseful(recommendations []Recommendation, candidate *Recommendation) []Recommendation {
+	if candidate == nil || candidate.EstimatedSavingsBytes <= 0 {
+		return recommendations
+	}
+	return append(recommendations, *candidate)
+}
+
+func multiStageBuild(aggregate []dive.AggregateFile) *Recommendation {
+	var evidence []Evidence
+	var total int64
+	for _, file := range aggregate {
+		if file.IsDir {
+			continue
+		}
+		if !hasAnyPrefix(file.Path, buildToolPrefixes) && !isBuildToolBinary(file.Path) {
+			continue
+		}
+		total += file.SizeBytes
+		evidence = append(evidence, Evidence{Path: file.Path, SizeBytes: file.SizeBytes, LayerIndex: file.LayerIndex})
+	}
+	return &Recommendation{
+		Kind:                  KindMultiStageBuild,
+		Title:                 "Move build toolchains into a builder stage",
+		Description:           "Compilers, headers and SDKs are present in the final image. Build in a separate stage and copy only the artifacts into the runtime stage.",
+		EstimatedSavingsBytes: total,
+		Heuristic:             true,
+		Evidence:              topEvidence(evidence),
+	}
+}
+
+func isBuildToolBinary(filePath string) bool {
+	dir := path.Dir(filePath)
+	if !strings.HasSuffix(dir, "/bin") {
+		return false
+	}
+	return buildToolBinaries[path.Base(filePath)]
+}
+
+// cacheCleanup counts package manager and temp caches in every layer, since a
+// cache deleted by a later RUN step still ships in the layer that created it.
+func cacheCleanup(result dive.Result) *Recommendation {
+	var evidence []Evidence
+	var total int64
+	for position, layer := range result.Layers {
+		for _, file := range layer.Files {
+			if file.IsDir || file.IsWhiteout() || !hasAnyPrefix(file.Path, cachePrefixes) {
+				continue
+			}
+			total += file.SizeBytes
+			evidence = append(evidence, Evidence{Path: file.Path, SizeBytes: file.SizeBytes, LayerIndex: position})
+		}
+	}
+	return &Recommendation{
+		Kind:                  KindCacheCleanup,
+		Title:                 "Clean package caches in the same layer",
+		Description:           "Package manager caches and temporary files are stored in image layers. Remove them in the same RUN instruction that creates them, or use a cache mount.",
+		EstimatedSavingsBytes: total,
+		Evidence:              topEvidence(evidence),
+	}
+}
+
+func cacheCleanupFromReferences(references []dive.FileReference) *Recommendation {
+	var evidence []Evidence
+	var total int64
+	for _, reference := range references {
+		filePath := dive.CleanPath(reference.File)
+		if !hasAnyPrefix(filePath, cachePrefixes) {
+			continue
+		}
+		total += reference.SizeBytes
+		evidence = append(evidence, Evidence{Path: filePath, SizeBytes: reference.SizeBytes, LayerIndex: -1})
+	}
+	return &Recommendation{
+		Kind:                  KindCacheCleanup,
+		Title:                 "Clean package caches in the same layer",
+		Description:           "Wasted space includes package manager caches and temporary files. Remove them in the same RUN instruction that creates them, or use a cache mount.",
+		EstimatedSavingsBytes: total,
+		Evidence:              topEvidence(evidence),
+	}
+}
+
+func dockerignore(result dive.Result) *Recommendation {
+	var evidence []Evidence
+	var total int64
+	for position, layer := range result.Layers {
+		if !isCopyCommand(layer.Command) {
+			continue
+		}
+		for _, file := range layer.Files {
+			if file.IsDir || file.IsWhiteout() || !isDockerignoreCandidate(file.Path) {
+				continue
+			}
+			total += file.SizeBytes
+			evidence = append(evidence, Evidence{Path: file.Path, SizeBytes: file.SizeBytes, LayerIndex: position})
+		}
+	}
+	return &Recommendation{
+		Kind:                  KindDockerignore,
+		Title:                 "Exclude build context files with .dockerignore",
+		Description:           "COPY or ADD instructions brought in VCS metadata, local dependencies, logs or editor files. Add them to .dockerignore.",
+		EstimatedSavingsBytes: total,
+		Evidence:              topEvidence(evidence),
+	}
+}
+
+func isCopyCommand(command string) bool {
+	normalized := strings.ToUpper(strings.TrimSpace(command))
+	normalized = strings.TrimPrefix(normalized, "/BIN/SH -C #(NOP) ")
+	normalized = strings.TrimSpace(normalized)
+	return strings.HasPrefix(normalized, "COPY") || strings.HasPrefix(normalized, "ADD")
+}
+
+func isDockerignoreCandidate(filePath string) bool {
+	for _, segment := range strings.Split(strings.TrimPrefix(filePath, "/"), "/") {
+		if dockerignoreNames[segment] {
+			return true
+		}
+	}
+	for _, suffix := range dockerignoreSuffixes {
+		if strings.HasSuffix(filePath, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// slimmerBase counts the files of the base layer that slim variants usually
+// omit. The base is taken to be the first layer, the root filesystem of
+// most distribution bases, so bases spread over several layers are
+// undercounted.
+func slimmerBase(result dive.Result) *Recommendation {
+	if len(result.Layers) == 0 {
+		return nil
+	}
+	base := result.Layers[0]
+	if base.SizeBytes < slimBaseThresholdBytes {
+		return nil
+	}
+
+	directories := make(map[string]int64)
+	var total int64
+	for _, file := range base.Files {
+		if file.IsDir || file.IsWhiteout() || !hasAnyPrefix(file.Path, slimVariantPrefixes) {
+			continue
+		}
+		total += file.SizeBytes
+		directories[topDirectories(file.Path, 3)] += file.SizeBytes
+	}
+	if total < slimBaseMinSavingsBytes {
+		return nil
+	}
+	evidence := make([]Evidence, 0, len(directories))
+	for directory, size := range directories {
+		evidence = append(evidence, Evidence{Path: directory, SizeBytes: size, LayerIndex: 0})
+	}
+
+	return &Recommendation{
+		Kind:                  KindSlimmerBase,
+		Title:                 "Switch to a slimmer base image",
+		Description:           fmt.Sprintf("The base layer is %d bytes, %d of them documentation, locales or package lists that slim, alpine and distroless variants usually leave out. The estimate only counts those files.", base.SizeBytes, total),
+		EstimatedSavingsBytes: total,
+		Heuristic:             true,
+		Evidence:              topEvidence(evidence),
+	}
+}
+
+func topDirectories(filePath string, depth int) string {
+	parts := strings.Split(strings.TrimPrefix(path.Dir(filePath), "/"), "/")
+	if len(parts) > depth {
+		parts = parts[:depth]
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+// duplicateFiles groups final-image files by name, size and mode. Dive does
+// not export content hashes, so matches are likely rather than proven
+// duplicates.
+func duplicateFiles(aggregate []dive.AggregateFile) *Recommendation {
+	type duplicateKey struct {
+		name string
+		size int64
+		mode uint32
+	}
+	groups := make(map[duplicateKey][]dive.AggregateFile)
+	for _, file := range aggregate {
+		if file.IsDir || file.LinkName != "" || file.SizeBytes < minDuplicateFileBytes {
+			continue
+		}
+		key := duplicateKey{name: path.Base(file.Path), size: file.SizeBytes, mode: file.Mode}
+		groups[key] = append(groups[key], file)
+	}
+
+	var evidence []Evidence
+	var total int64
+	for _, files := range groups {
+		if len(files) < 2 {
+			continue
+		}
+		total += files[0].SizeBytes * int64(len(files)-1)
+		for _, file := range files {
+			evidence = append(evidence, Evidence{Path: file.Path, SizeBytes: file.SizeBytes, LayerIndex: file.LayerIndex})
+		}
+	}
+	return &Recommendation{
+		Kind:                  KindDuplicateFiles,
+		Title:                 "Remove duplicate files",
+		Description:           "Files with the same name, size and mode appear at several paths. Their contents are not compared, so check they match, then keep one copy and link or reference it instead.",
+		EstimatedSavingsBytes: total,
+		Heuristic:             true,
+		Evidence:              topEvidence(evidence),
+	}
+}
+
+func hasAnyPrefix(filePath string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if dive.IsUnder(filePath, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func topEvidence(evidence []Evidence) []Evidence {
+	sort.SliceStable(evidence, func(i, j int) bool {
+		if evidence[i].SizeBytes != evidence[j].SizeBytes {
+			return evidence[i].SizeBytes > evidence[j].SizeBytes
+		}
+		return evidence[i].Path < evidence[j].Path
+	})
+	if len(evidence) > maxEvidence {
+		return evidence[:maxEvidence]
+	}
+	return evidence
+}
@@ -0,0 +1,125 @@
+package recommendations
+
+import (
+	"reflect"
+	"testing"
+
+	"deep-dive/dive"
+)
+
+const megabyte = 1024 * 1024
+
+// outcome is the part of a recommendation the tests compare; titles,
+// descriptions and evidence are left to the UI.
+type outcome struct {
+	Kind                  Kind
+	EstimatedSavingsBytes int64
+	Heuristic             bool
+}
+
+func TestGenerate(t *testing.T) {
+	tests := []struct {
+		name   string
+		result dive.Result
+		want   []outcome
+	}{
+		{
+			name: "nothing to suggest",
+			result: dive.Result{Layers: []dive.Layer{
+				{Command: "COPY main /app/main", Files: []dive.File{{Path: "/app/main", SizeBytes: 5000, Mode: 0o755}}},
+			}},
+		},
+		{
+			name: "file references without file data",
+			result: dive.Result{
+				Layers: []dive.Layer{{Command: "FROM base"}},
+				Image: dive.Image{FileReference: []dive.FileReference{
+					{File: "var/cache/apt/archives/curl.deb", SizeBytes: 500},
+					{File: "app/main", SizeBytes: 900},
+				}},
+			},
+			want: []outcome{{Kind: KindCacheCleanup, EstimatedSavingsBytes: 500}},
+		},
+		{
+			name: "build toolchain in the final image",
+			result: dive.Result{Layers: []dive.Layer{
+				{Command: "RUN apt-get install gcc", Files: []dive.File{
+					{Path: "/usr/lib/gcc/x86_64-linux-gnu/12/cc1", SizeBytes: 2000},
+					{Path: "/usr/bin/gcc", SizeBytes: 1000},
+					{Path: "/usr/share/gcc/README", SizeBytes: 100},
+				}},
+			}},
+			want: []outcome{{Kind: KindMultiStageBuild, EstimatedSavingsBytes: 3000, Heuristic: true}},
+		},
+		{
+			name: "cache deleted by a later layer",
+			result: dive.Result{Layers: []dive.Layer{
+				{Command: "RUN apt-get update", Files: []dive.File{{Path: "/var/lib/apt/lists/main", SizeBytes: 4000}}},
+				{Command: "RUN rm -rf /var/lib/apt/lists", Files: []dive.File{{Path: "/var/lib/apt/.wh.lists"}}},
+			}},
+			want: []outcome{{Kind: KindCacheCleanup, EstimatedSavingsBytes: 4000}},
+		},
+		{
+			name: "dockerignore only counts copied files",
+			result: dive.Result{Layers: []dive.Layer{
+				{Command: "RUN git clone repo /src", Files: []dive.File{{Path: "/src/.git/HEAD", SizeBytes: 5000}}},
+				{Command: "COPY . /app", Files: []dive.File{
+					{Path: "/app/.git/HEAD", SizeBytes: 100},
+					{Path: "/app/debug.log", SizeBytes: 200},
+					{Path: "/app/main.go", SizeBytes: 300},
+				}},
+			}},
+			want: []outcome{{Kind: KindDockerignore, EstimatedSavingsBytes: 300}},
+		},
+		{
+			name: "slimmer base leaves toolchains to the multi-stage suggestion",
+			result: dive.Result{Layers: []dive.Layer{
+				{Command: "FROM debian", SizeBytes: 200 * megabyte, Files: []dive.File{
+					{Path: "/usr/share/doc/libc6/changelog", SizeBytes: 8 * megabyte},
+					{Path: "/usr/share/locale/de/LC_MESSAGES/libc.mo", SizeBytes: 4 * megabyte},
+					{Path: "/usr/include/stdio.h", SizeBytes: 20 * megabyte},
+				}},
+			}},
+			want: []outcome{
+				{Kind: KindMultiStageBuild, EstimatedSavingsBytes: 20 * megabyte, Heuristic: true},
+				{Kind: KindSlimmerBase, EstimatedSavingsBytes: 12 * megabyte, Heuristic: true},
+			},
+		},
+		{
+			name: "small base is not flagged",
+			result: dive.Result{Layers: []dive.Layer{
+				{Command: "FROM alpine", SizeBytes: 50 * megabyte, Files: []dive.File{
+					{Path: "/usr/share/doc/README", SizeBytes: 20 * megabyte},
+				}},
+			}},
+		},
+		{
+			name: "duplicates match on name, size and mode",
+			result: dive.Result{Layers: []dive.Layer{
+				{Command: "COPY libs /", Files: []dive.File{
+					{Path: "/a/libfoo.so", SizeBytes: 2048, Mode: 0o644},
+					{Path: "/b/libfoo.so", SizeBytes: 2048, Mode: 0o644},
+					{Path: "/c/libfoo.so", SizeBytes: 2048, Mode: 0o755},
+					{Path: "/a/small", SizeBytes: 512},
+					{Path: "/b/small", SizeBytes: 512},
+				}},
+			}},
+			want: []outcome{{Kind: KindDuplicateFiles, EstimatedSavingsBytes: 2048, Heuristic: true}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []outcome
+			for _, recommendation := range Generate(test.result) {
+				got = append(got, outcome{
+					Kind:                  recommendation.Kind,
+					EstimatedSavingsBytes: recommendation.EstimatedSavingsBytes,
+					Heuristic:             recommendation.Heuristic,
+				})
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Generate() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
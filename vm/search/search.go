@@ -0,0 +1,453 @@
+package search
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"deep-dive/dive"
+	"deep-dive/history"
+)
+
+const (
+	ModeAuto      = "auto"
+	ModeSubstring = "substring"
+	ModeGlob      = "glob"
+)
+
+const (
+	defaultMaxMatches = 500
+	maxMatchesLimit   = 5000
+)
+
+type Query struct {
+	Pattern string
+	// Mode picks how Pattern matches. Auto uses glob matching when the
+	// pattern contains *, ? or [ and substring matching otherwise. Globs
+	// without a slash match the file name, globs with one the full path;
+	// substrings always match the full path, ignoring case.
+	Mode string
+	// Image limits the search to one reference, or to every tag of a
+	// repository.
+	Image        string
+	MinSizeBytes int64
+	IncludeDirs  bool
+	MaxMatches   int
+}
+
+type Match struct {
+	Path         string `json:"path"`
+	SizeBytes    int64  `json:"sizeBytes"`
+	IsDir        bool   `json:"isDir,omitempty"`
+	LayerIndex   int    `json:"layerIndex"`
+	LayerDigest  string `json:"layerDigest,omitempty"`
+	LayerCommand string `json:"layerCommand,omitempty"`
+	// InFinalImage is false when a later layer deleted or replaced the file.
+	InFinalImage bool `json:"inFinalImage"`
+}
+
+type EntryMatches struct {
+	ID          string    `json:"id"`
+	Image       string    `json:"image"`
+	CompletedAt time.Time `json:"completedAt"`
+	MatchCount  int       `json:"matchCount"`
+	TotalBytes  int64     `json:"totalBytes"`
+	Matches     []Match   `json:"matches"`
+}
+
+type Result struct {
+	Pattern        string         `json:"pattern"`
+	Mode           string         `json:"mode"`
+	Entries        []EntryMatches `json:"entries"`
+	TotalMatches   int            `json:"totalMatches"`
+	Truncated      bool           `json:"truncated,omitempty"`
+	EntriesIndexed int            `json:"entriesIndexed"`
+	// EntriesWithoutFileData counts entries whose results have no per-layer
+	// file lists and so can't be searched.
+	EntriesWithoutFileData int `json:"entriesWithoutFileData"`
+}
+
+type layerInfo struct {
+	digest  string
+	command string
+}
+
+type indexedFile struct {
+	path         string
+	sizeBytes    int64
+	isDir        bool
+	layer        int
+	inFinalImage bool
+}
+
+type indexedEntry struct {
+	metadata    history.Metadata
+	layers      []layerInfo
+	files       []indexedFile
+	hasFileData bool
+}
+
+// indexedPath is one distinct path and every file, across all entries,
+// stored under it.
+type indexedPath struct {
+	path  string
+	name  string
+	files []posting
+}
+
+type posting struct {
+	entry *indexedEntry
+	file  int
+}
+
+// Index keeps every stored result's file tree in memory. Sync brings it in
+// line with the store, parsing only entries it hasn't seen.
+//
+// Files are indexed by path: a search matches each distinct path once, and
+// globs with a literal prefix only visit the paths or file names that start
+// with it.
+type Index struct {
+	// syncMu serializes syncs, so results can be loaded and parsed without
+	// holding mu and blocking searches.
+	syncMu  sync.Mutex
+	mu      sync.RWMutex
+	entries map[string]*indexedEntry
+	// byPath and byName list the distinct paths of live entries, sorted by
+	// path and by file name. They are rebuilt whenever entries come or go.
+	byPath []*indexedPath
+	byName []*indexedPath
+}
+
+func NewIndex() *Index {
+	return &Index{
+		entries: make(map[string]*indexedEntry),
+	}
+}
+
+func ParseQuery(values url.Values) (Query, error) {
+	query := Query{
+		Pattern:    strings.TrimSpace(values.Get("path")),
+		Mode:       strings.ToLower(strings.TrimSpace(values.Get("mode"))),
+		Image:      strings.TrimSpace(values.Get("image")),
+		MaxMatches: defaultMaxMatches,
+	}
+	if query.Pattern == "" {
+		return Query{}, fmt.Errorf("path is required")
+	}
+	switch query.Mode {
+	case "":
+		query.Mode = ModeAuto
+	case ModeAuto, ModeSubstring, ModeGlob:
+	default:
+		return Query{}, fmt.Errorf("mode must be auto, substring or glob")
+	}
+	if query.Mode == ModeAuto {
+		query.Mode = ModeSubstring
+		if strings.ContainsAny(query.Pattern, "*?[") {
+			query.Mode = ModeGlob
+		}
+	}
+	if query.Mode == ModeGlob {
+		if _, err := path.Match(query.Pattern, ""); err != nil {
+			return Query{}, fmt.Errorf("invalid glob pattern: %s", query.Pattern)
+		}
+	}
+
+	if value := strings.TrimSpace(values.Get("minSizeBytes")); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 0 {
+			return Query{}, fmt.Errorf("minSizeBytes must be a non-negative integer")
+		}
+		query.MinSizeBytes = parsed
+	}
+	if value := strings.TrimSpace(values.Get("includeDirs")); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return Query{}, fmt.Errorf("includeDirs must be true or false")
+		}
+		query.IncludeDirs = parsed
+	}
+	if value := strings.TrimSpace(values.Get("limit")); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			return Query{}, fmt.Errorf("limit must be a positive integer")
+		}
+		query.MaxMatches = min(parsed, maxMatchesLimit)
+	}
+	return query, nil
+}
+
+// Sync indexes entries added to the store since the last call, refreshes
+// metadata of known entries and forgets deleted ones. Entries that fail to
+// load are skipped and retried on the next sync.
+func (i *Index) Sync(store history.Store) error {
+	i.syncMu.Lock()
+	defer i.syncMu.Unlock()
+
+	entries, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	// Only Sync changes i.entries, so it can be read here without mu.
+	current := make(map[string]bool, len(entries))
+	var refreshed []history.Metadata
+	built := make(map[string]*indexedEntry)
+	for _, metadata := range entries {
+		current[metadata.ID] = true
+		// An entry overwritten in place, e.g. by a bundle import, keeps its
+		// ID but points at a different result.
+		if existing, ok := i.entries[metadata.ID]; ok && existing.metadata.ResultDigest == metadata.ResultDigest {
+			refreshed = append(refreshed, metadata)
+			continue
+		}
+		entry, err := store.Get(metadata.ID)
+		if err != nil {
+			continue
+		}
+		indexed, err := build(metadata, entry.Result)
+		if err != nil {
+			continue
+		}
+		built[metadata.ID] = indexed
+	}
+	var removed []string
+	for id := range i.entries {
+		if !current[id] {
+			removed = append(removed, id)
+		}
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for _, metadata := range refreshed {
+		i.entries[metadata.ID].metadata = metadata
+	}
+	for id, indexed := range built {
+		i.entries[id] = indexed
+	}
+	for _, id := range removed {
+		delete(i.entries, id)
+	}
+	if len(built) > 0 || len(removed) > 0 {
+		i.rebuildPaths()
+	}
+	return nil
+}
+
+func build(metadata history.Metadata, raw []byte) (*indexedEntry, error) {
+	result, err := dive.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	indexed := &indexedEntry{
+		metadata:    metadata,
+		layers:      make([]layerInfo, len(result.Layers)),
+		hasFileData: result.HasFileData(),
+	}
+	for position, layer := range result.Layers {
+		indexed.layers[position] = layerInfo{digest: layer.DigestID, command: layer.Command}
+	}
+	if !indexed.hasFileData {
+		return indexed, nil
+	}
+
+	type fileKey struct {
+		path  string
+		layer int
+	}
+	final := make(map[fileKey]bool)
+	for _, file := range result.Aggregate() {
+		final[fileKey{dive.CleanPath(file.Path), file.LayerIndex}] = true
+	}
+	for position, layer := range result.Layers {
+		for _, file := range layer.Files {
+			if file.IsWhiteout() {
+				continue
+			}
+			filePath := dive.CleanPath(file.Path)
+			indexed.files = append(indexed.files, indexedFile{
+				path:         filePath,
+				sizeBytes:    file.SizeBytes,
+				isDir:        file.IsDir,
+				layer:        position,
+				inFinalImage: final[fileKey{filePath, position}],
+			})
+		}
+	}
+	return indexed, nil
+}
+
+// rebuildPaths regroups every entry's files by path and re-sorts the path
+// and file name lists. It also interns the path strings, which repeat
+// heavily across entries of the same image.
+func (i *Index) rebuildPaths() {
+	paths := make(map[string]*indexedPath, len(i.byPath))
+	for _, entry := range i.entries {
+		for position := range entry.files {
+			file := &entry.files[position]
+			indexed, ok := paths[file.path]
+			if !ok {
+				indexed = &indexedPath{path: file.path, name: path.Base(file.path)}
+				paths[file.path] = indexed
+			}
+			file.path = indexed.path
+			indexed.files = append(indexed.files, posting{entry: entry, file: position})
+		}
+	}
+	byPath := make([]*indexedPath, 0, len(paths))
+	for _, indexed := range paths {
+		byPath = append(byPath, indexed)
+	}
+	sort.Slice(byPath, func(a, b int) bool {
+		return byPath[a].path < byPath[b].path
+	})
+	byName := append([]*indexedPath(nil), byPath...)
+	sort.SliceStable(byName, func(a, b int) bool {
+		return byName[a].name < byName[b].name
+	})
+	i.byPath, i.byName = byPath, byName
+}
+
+// candidates returns the paths a query has to be matched against. Globs
+// with a literal prefix narrow the sorted path or file name list to the
+// range starting with it; everything else visits every distinct path.
+func (i *Index) candidates(query Query) []*indexedPath {
+	if query.Mode != ModeGlob {
+		return i.byPath
+	}
+	pattern, list, key := query.Pattern, i.byName, func(indexed *indexedPath) string { return indexed.name }
+	if strings.Contains(pattern, "/") {
+		if !strings.HasPrefix(pattern, "/") {
+			pattern = "/" + pattern
+		}
+		list, key = i.byPath, func(indexed *indexedPath) string { return indexed.path }
+	}
+	prefix := pattern
+	if index := strings.IndexAny(pattern, `*?[\`); index >= 0 {
+		prefix = pattern[:index]
+	}
+	first := sort.Search(len(list), func(n int) bool { return key(list[n]) >= prefix })
+	last := first
+	for last < len(list) && strings.HasPrefix(key(list[last]), prefix) {
+		last++
+	}
+	return list[first:last]
+}
+
+// Search returns matching files grouped by entry, newest entry first, and
+// within an entry in layer order. At most MaxMatches files are returned;
+// TotalMatches still counts every match.
+func (i *Index) Search(query Query) Result {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	result := Result{
+		Pattern:        query.Pattern,
+		Mode:           query.Mode,
+		Entries:        []EntryMatches{},
+		EntriesIndexed: len(i.entries),
+	}
+	images := history.TrendQuery{Image: query.Image}
+
+	searched := make(map[*indexedEntry]bool, len(i.entries))
+	for _, entry := range i.entries {
+		if query.Image != "" && !images.Matches(entry.metadata) {
+			continue
+		}
+		if !entry.hasFileData {
+			result.EntriesWithoutFileData++
+			continue
+		}
+		searched[entry] = true
+	}
+
+	matcher := newMatcher(query)
+	found := make(map[*indexedEntry][]int)
+	for _, indexed := range i.candidates(query) {
+		if !matcher(indexed) {
+			continue
+		}
+		for _, posting := range indexed.files {
+			if !searched[posting.entry] {
+				continue
+			}
+			file := posting.entry.files[posting.file]
+			if file.isDir && !query.IncludeDirs || file.sizeBytes < query.MinSizeBytes {
+				continue
+			}
+			found[posting.entry] = append(found[posting.entry], posting.file)
+		}
+	}
+
+	ordered := make([]*indexedEntry, 0, len(found))
+	for entry := range found {
+		ordered = append(ordered, entry)
+	}
+	sort.Slice(ordered, func(a, b int) bool {
+		return ordered[a].metadata.CompletedAt.After(ordered[b].metadata.CompletedAt)
+	})
+
+	returned := 0
+	for _, entry := range ordered {
+		// Files are stored in layer order, so sorting positions restores it.
+		positions := found[entry]
+		sort.Ints(positions)
+		matches := EntryMatches{
+			ID:          entry.metadata.ID,
+			Image:       entry.metadata.Image,
+			CompletedAt: entry.metadata.CompletedAt,
+			MatchCount:  len(positions),
+			Matches:     []Match{},
+		}
+		for _, position := range positions {
+			file := entry.files[position]
+			matches.TotalBytes += file.sizeBytes
+			if returned >= query.MaxMatches {
+				result.Truncated = true
+				continue
+			}
+			returned++
+			layer := entry.layers[file.layer]
+			matches.Matches = append(matches.Matches, Match{
+				Path:         file.path,
+				SizeBytes:    file.sizeBytes,
+				IsDir:        file.isDir,
+				LayerIndex:   file.layer,
+				LayerDigest:  layer.digest,
+				LayerCommand: layer.command,
+				InFinalImage: file.inFinalImage,
+			})
+		}
+		result.TotalMatches += matches.MatchCount
+		result.Entries = append(result.Entries, matches)
+	}
+	return result
+}
+
+func newMatcher(query Query) func(*indexedPath) bool {
+	if query.Mode == ModeGlob {
+		fullPath := strings.Contains(query.Pattern, "/")
+		pattern := query.Pattern
+		if fullPath && !strings.HasPrefix(pattern, "/") {
+			pattern = "/" + pattern
+		}
+		return func(candidate *indexedPath) bool {
+			target := candidate.name
+			if fullPath {
+				target = candidate.path
+			}
+			matched, _ := path.Match(pattern, target)
+			return matched
+		}
+	}
+	needle := strings.ToLower(query.Pattern)
+	return func(candidate *indexedPath) bool {
+		return strings.Contains(strings.ToLower(candidate.path), needle)
+	}
+}
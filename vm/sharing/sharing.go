@@ -0,0 +1,383 @@
+package sharing
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"deep-dive/dive"
+	"deep-dive/history"
+)
+
+const (
+	// ScopeLatest analyzes the newest entry of every image reference, which
+	// is what is on disk; ScopeAll every stored entry. Either way an image
+	// ID is counted once.
+	ScopeLatest = "latest"
+	ScopeAll    = "all"
+)
+
+const (
+	defaultLayerLimit = 100
+	// minSuggestionBytes keeps suggestions to bases worth rebuilding for.
+	minSuggestionBytes = 1 << 20
+)
+
+type Options struct {
+	Scope string
+	// Image limits the analysis to one reference or every tag of a
+	// repository.
+	Image      string
+	LayerLimit int
+}
+
+type Layer struct {
+	DigestID  string `json:"digestId"`
+	Command   string `json:"command,omitempty"`
+	SizeBytes int64  `json:"sizeBytes"`
+	// References counts the analyzed images containing the layer.
+	References int      `json:"references"`
+	EntryIDs   []string `json:"entryIds"`
+}
+
+type Image struct {
+	EntryID   string `json:"entryId"`
+	Image     string `json:"image"`
+	SizeBytes int64  `json:"sizeBytes"`
+	// Exclusive layers are referenced by this image only; shared ones by
+	// at least one other. Layers without a digest count as exclusive.
+	ExclusiveLayers int    `json:"exclusiveLayers"`
+	ExclusiveBytes  int64  `json:"exclusiveBytes"`
+	SharedLayers    int    `json:"sharedLayers"`
+	SharedBytes     int64  `json:"sharedBytes"`
+	BaseDigest      string `json:"baseDigest,omitempty"`
+}
+
+// Suggestion proposes rebuilding the images on a less common base onto the
+// most widely used one, so their base layers no longer need to be stored.
+type Suggestion struct {
+	BaseDigest            string   `json:"baseDigest"`
+	BaseBytes             int64    `json:"baseBytes"`
+	EntryIDs              []string `json:"entryIds"`
+	Images                []string `json:"images"`
+	TargetBaseDigest      string   `json:"targetBaseDigest"`
+	TargetImages          []string `json:"targetImages"`
+	EstimatedSavingsBytes int64    `json:"estimatedSavingsBytes"`
+	Message               string   `json:"message"`
+}
+
+type Report struct {
+	Scope      string `json:"scope"`
+	ImageCount int    `json:"imageCount"`
+	// TotalBytes adds up every image's layers as if nothing were shared;
+	// UniqueBytes counts each distinct layer once, which is closer to the
+	// disk actually used. SharingSavedBytes is the difference.
+	TotalBytes        int64        `json:"totalBytes"`
+	UniqueBytes       int64        `json:"uniqueBytes"`
+	SharingSavedBytes int64        `json:"sharingSavedBytes"`
+	LayerCount        int          `json:"layerCount"`
+	Layers            []Layer      `json:"layers"`
+	LayersTruncated   bool         `json:"layersTruncated,omitempty"`
+	Images            []Image      `json:"images"`
+	Suggestions       []Suggestion `json:"suggestions"`
+	// Skipped lists entries whose results could not be read.
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+func ParseOptions(values url.Values) (Options, error) {
+	options := Options{
+		Scope:      strings.ToLower(strings.TrimSpace(values.Get("scope"))),
+		Image:      strings.TrimSpace(values.Get("image")),
+		LayerLimit: defaultLayerLimit,
+	}
+	switch options.Scope {
+	case "":
+		options.Scope = ScopeLatest
+	case ScopeLatest, ScopeAll:
+	default:
+		return Options{}, fmt.Errorf("scope must be latest or all")
+	}
+	if value := strings.TrimSpace(values.Get("limit")); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return Options{}, fmt.Errorf("limit must be a non-negative integer")
+		}
+		options.LayerLimit = parsed
+	}
+	return options, nil
+}
+
+type analyzedImage struct {
+	metadata history.Metadata
+	layers   []history.LayerRef
+}
+
+// Analyze groups the layers of the selected history entries by digest.
+func Analyze(store history.Store, options Options) (Report, error) {
+	entries, err := store.List()
+	if err != nil {
+		return Report{}, err
+	}
+	report := Report{
+		Scope:       options.Scope,
+		Layers:      []Layer{},
+		Images:      []Image{},
+		Suggestions: []Suggestion{},
+	}
+
+	var images []analyzedImage
+	for _, metadata := range selectEntries(entries, options) {
+		if len(metadata.Layers) > 0 {
+			images = append(images, analyzedImage{metadata: metadata, layers: metadata.Layers})
+			continue
+		}
+		// Entries saved before layers were recorded in their metadata are
+		// read from their results.
+		layers, err := resultLayers(store, metadata.ID)
+		if err != nil {
+			report.Skipped = append(report.Skipped, metadata.ID)
+			continue
+		}
+		images = append(images, analyzedImage{metadata: metadata, layers: layers})
+	}
+	report.ImageCount = len(images)
+
+	layers := make(map[string]*Layer)
+	var order []string
+	for _, image := range images {
+		seen := make(map[string]bool)
+		for _, layer := range image.layers {
+			report.TotalBytes += layer.SizeBytes
+			if layer.DigestID == "" {
+				report.UniqueBytes += layer.SizeBytes
+				continue
+			}
+			if seen[layer.DigestID] {
+				continue
+			}
+			seen[layer.DigestID] = true
+			shared, ok := layers[layer.DigestID]
+			if !ok {
+				shared = &Layer{DigestID: layer.DigestID, Command: layer.Command, SizeBytes: layer.SizeBytes}
+				layers[layer.DigestID] = shared
+				order = append(order, layer.DigestID)
+				report.UniqueBytes += layer.SizeBytes
+			}
+			shared.References++
+			shared.EntryIDs = append(shared.EntryIDs, image.metadata.ID)
+		}
+	}
+	report.SharingSavedBytes = report.TotalBytes - report.UniqueBytes
+	report.LayerCount = len(order)
+
+	for _, image := range images {
+		summary := Image{EntryID: image.metadata.ID, Image: image.metadata.Image}
+		if len(image.layers) > 0 {
+			summary.BaseDigest = image.layers[0].DigestID
+		}
+		seen := make(map[string]bool)
+		for _, layer := range image.layers {
+			summary.SizeBytes += layer.SizeBytes
+			if layer.DigestID != "" && seen[layer.DigestID] {
+				continue
+			}
+			seen[layer.DigestID] = true
+			if layer.DigestID != "" && layers[layer.DigestID].References > 1 {
+				summary.SharedLayers++
+				summary.SharedBytes += layer.SizeBytes
+			} else {
+				summary.ExclusiveLayers++
+				summary.ExclusiveBytes += layer.SizeBytes
+			}
+		}
+		report.Images = append(report.Images, summary)
+	}
+	sort.SliceStable(report.Images, func(i, j int) bool {
+		return report.Images[i].ExclusiveBytes > report.Images[j].ExclusiveBytes
+	})
+
+	for _, digest := range order {
+		report.Layers = append(report.Layers, *layers[digest])
+	}
+	sort.SliceStable(report.Layers, func(i, j int) bool {
+		left, right := report.Layers[i], report.Layers[j]
+		if left.References != right.References {
+			return left.References > right.References
+		}
+		return left.SizeBytes > right.SizeBytes
+	})
+	if options.LayerLimit > 0 && len(report.Layers) > options.LayerLimit {
+		report.Layers = report.Layers[:options.LayerLimit]
+		report.LayersTruncated = true
+	}
+
+	report.Suggestions = suggest(images)
+	return report, nil
+}
+
+func resultLayers(store history.Store, id string) ([]history.LayerRef, error) {
+	entry, err := store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	result, err := dive.Parse(entry.Result)
+	if err != nil {
+		return nil, err
+	}
+	return history.LayerRefs(result), nil
+}
+
+// selectEntries applies the image filter and, for ScopeLatest, keeps the
+// most recently completed entry of each image reference. Entries analyzing
+// the same image ID, whether repeated analyses or several tags of one image,
+// then collapse to the most recent one so the image counts once.
+func selectEntries(entries []history.Metadata, options Options) []history.Metadata {
+	filter := history.TrendQuery{Image: options.Image}
+	var candidates []history.Metadata
+	latest := make(map[string]history.Metadata)
+	for _, entry := range entries {
+		if options.Image != "" && !filter.Matches(entry) {
+			continue
+		}
+		if options.Scope == ScopeAll {
+			candidates = append(candidates, entry)
+			continue
+		}
+		if current, ok := latest[entry.Image]; !ok || entry.CompletedAt.After(current.CompletedAt) {
+			latest[entry.Image] = entry
+		}
+	}
+	for _, entry := range latest {
+		candidates = append(candidates, entry)
+	}
+
+	var selected []history.Metadata
+	byImageID := make(map[string]history.Metadata)
+	for _, entry := range candidates {
+		if entry.ImageID == "" {
+			selected = append(selected, entry)
+			continue
+		}
+		if current, ok := byImageID[entry.ImageID]; !ok || entry.CompletedAt.After(current.CompletedAt) {
+			byImageID[entry.ImageID] = entry
+		}
+	}
+	for _, entry := range byImageID {
+		selected = append(selected, entry)
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		return selected[i].ID < selected[j].ID
+	})
+	return selected
+}
+
+type baseGroup struct {
+	digest string
+	images []analyzedImage
+	// layers is the longest run of leading layers every image in the
+	// group shares, which is taken to be the base image.
+	layers []history.LayerRef
+}
+
+func (g baseGroup) bytes() int64 {
+	var total int64
+	for _, layer := range g.layers {
+		total += layer.SizeBytes
+	}
+	return total
+}
+
+// suggest groups images by their first layer and proposes moving every
+// smaller group onto the base of the largest one. Moving a group frees its
+// base layers, since the target base is already stored.
+func suggest(images []analyzedImage) []Suggestion {
+	groups := make(map[string]*baseGroup)
+	var order []string
+	for _, image := range images {
+		if len(image.layers) == 0 || image.layers[0].DigestID == "" {
+			continue
+		}
+		digest := image.layers[0].DigestID
+		group, ok := groups[digest]
+		if !ok {
+			group = &baseGroup{digest: digest, layers: image.layers}
+			groups[digest] = group
+			order = append(order, digest)
+		}
+		group.layers = commonPrefix(group.layers, image.layers)
+		group.images = append(group.images, image)
+	}
+	for _, group := range groups {
+		// A lone image shares its leading layers with nobody, so only its
+		// first layer is known to belong to the base.
+		if len(group.images) == 1 {
+			group.layers = group.layers[:1]
+		}
+	}
+	suggestions := []Suggestion{}
+	if len(order) < 2 {
+		return suggestions
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		left, right := groups[order[i]], groups[order[j]]
+		if len(left.images) != len(right.images) {
+			return len(left.images) > len(right.images)
+		}
+		return left.bytes() > right.bytes()
+	})
+	target := groups[order[0]]
+	targetImages := imageNames(target.images)
+
+	for _, digest := range order[1:] {
+		group := groups[digest]
+		savings := group.bytes()
+		if savings < minSuggestionBytes {
+			continue
+		}
+		suggestion := Suggestion{
+			BaseDigest:            group.digest,
+			BaseBytes:             savings,
+			TargetBaseDigest:      target.digest,
+			TargetImages:          targetImages,
+			EstimatedSavingsBytes: savings,
+		}
+		for _, image := range group.images {
+			suggestion.EntryIDs = append(suggestion.EntryIDs, image.metadata.ID)
+		}
+		suggestion.Images = imageNames(group.images)
+		suggestion.Message = fmt.Sprintf(
+			"%d image(s) are built on a different base than the %d image(s) sharing the most common one. Rebuilding them on that base would free about %d bytes of base layers.",
+			len(group.images), len(target.images), savings,
+		)
+		suggestions = append(suggestions, suggestion)
+	}
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		return suggestions[i].EstimatedSavingsBytes > suggestions[j].EstimatedSavingsBytes
+	})
+	return suggestions
+}
+
+// imageNames lists the distinct image references, which repeat when every
+// entry is analyzed.
+func imageNames(images []analyzedImage) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, image := range images {
+		if !seen[image.metadata.Image] {
+			seen[image.metadata.Image] = true
+			names = append(names, image.metadata.Image)
+		}
+	}
+	return names
+}
+
+func commonPrefix(left []history.LayerRef, right []history.LayerRef) []history.LayerRef {
+	count := 0
+	for count < len(left) && count < len(right) && left[count].DigestID != "" && left[count].DigestID == right[count].DigestID {
+		count++
+	}
+	return left[:count]
+}
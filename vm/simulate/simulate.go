@@ -0,0 +1,351 @@
+package simulate
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"deep-dive/dive"
+)
+
+type LayerRange struct {
+	From int `json:"from"`
+	To   int `json:"to"`
+}
+
+type Plan struct {
+	MergeLayers   []LayerRange `json:"mergeLayers,omitempty"`
+	DropPaths     []string     `json:"dropPaths,omitempty"`
+	MoveDeletions []string     `json:"moveDeletions,omitempty"`
+}
+
+type Metrics struct {
+	SizeBytes        int64   `json:"sizeBytes"`
+	InefficientBytes int64   `json:"inefficientBytes"`
+	EfficiencyScore  float64 `json:"efficiencyScore"`
+	LayerCount       int     `json:"layerCount"`
+}
+
+type LayerMetrics struct {
+	SourceIndexes []int    `json:"sourceIndexes"`
+	Commands      []string `json:"commands"`
+	SizeBytes     int64    `json:"sizeBytes"`
+}
+
+type Savings struct {
+	SizeBytes        int64   `json:"sizeBytes"`
+	InefficientBytes int64   `json:"inefficientBytes"`
+	EfficiencyScore  float64 `json:"efficiencyScore"`
+	LayerCount       int     `json:"layerCount"`
+}
+
+type Outcome struct {
+	Baseline  Metrics        `json:"baseline"`
+	Simulated Metrics        `json:"simulated"`
+	Savings   Savings        `json:"savings"`
+	Layers    []LayerMetrics `json:"layers"`
+	Warnings  []string       `json:"warnings,omitempty"`
+}
+
+type simLayer struct {
+	sources  []int
+	commands []string
+	files    []dive.File
+}
+
+// Run applies the plan to the stored per-layer file lists and recomputes the
+// image metrics with the same wasted-space rules Dive uses, so the baseline
+// and simulated figures are directly comparable.
+func Run(result dive.Result, plan Plan) (Outcome, error) {
+	if !result.HasFileData() {
+		return Outcome{}, dive.ErrNoFileData
+	}
+	if err := validatePlan(plan, len(result.Layers)); err != nil {
+		return Outcome{}, err
+	}
+
+	layers := make([]simLayer, 0, len(result.Layers))
+	for position, layer := range result.Layers {
+		layers = append(layers, simLayer{
+			sources:  []int{position},
+			commands: []string{layer.Command},
+			files:    layer.Files,
+		})
+	}
+
+	baseline, _ := measure(layers)
+
+	var warnings []string
+	for _, value := range plan.DropPaths {
+		layers = dropPath(layers, dive.CleanPath(value))
+	}
+	for _, deletedPath := range plan.MoveDeletions {
+		var moved bool
+		layers, moved = moveDeletion(layers, dive.CleanPath(deletedPath))
+		if !moved {
+			warnings = append(warnings, fmt.Sprintf("no deletion of %s found in a later layer", dive.CleanPath(deletedPath)))
+		}
+	}
+
+	ranges := make([]LayerRange, len(plan.MergeLayers))
+	copy(ranges, plan.MergeLayers)
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].From > ranges[j].From
+	})
+	for _, layerRange := range ranges {
+		layers = mergeRange(layers, layerRange)
+	}
+
+	simulated, layerMetrics := measure(layers)
+
+	return Outcome{
+		Baseline:  baseline,
+		Simulated: simulated,
+		Savings: Savings{
+			SizeBytes:        baseline.SizeBytes - simulated.SizeBytes,
+			InefficientBytes: baseline.InefficientBytes - simulated.InefficientBytes,
+			EfficiencyScore:  simulated.EfficiencyScore - baseline.EfficiencyScore,
+			LayerCount:       baseline.LayerCount - simulated.LayerCount,
+		},
+		Layers:   layerMetrics,
+		Warnings: warnings,
+	}, nil
+}
+
+func validatePlan(plan Plan, layerCount int) error {
+	if len(plan.MergeLayers) == 0 && len(plan.DropPaths) == 0 && len(plan.MoveDeletions) == 0 {
+		return fmt.Errorf("plan must include at least one operation")
+	}
+
+	ranges := make([]LayerRange, len(plan.MergeLayers))
+	copy(ranges, plan.MergeLayers)
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].From < ranges[j].From
+	})
+	for i, layerRange := range ranges {
+		if layerRange.From < 0 || layerRange.To >= layerCount || layerRange.From >= layerRange.To {
+			return fmt.Errorf("invalid merge range %d-%d for %d layers", layerRange.From, layerRange.To, layerCount)
+		}
+		if i > 0 && layerRange.From <= ranges[i-1].To {
+			return fmt.Errorf("merge ranges %d-%d and %d-%d overlap", ranges[i-1].From, ranges[i-1].To, layerRange.From, layerRange.To)
+		}
+	}
+	for _, value := range append(append([]string{}, plan.DropPaths...), plan.MoveDeletions...) {
+		if strings.TrimSpace(value) == "" || dive.CleanPath(value) == "/" {
+			return fmt.Errorf("plan paths must name a file or directory below /")
+		}
+	}
+	return nil
+}
+
+func dropPath(layers []simLayer, target string) []simLayer {
+	updated := make([]simLayer, len(layers))
+	for i, layer := range layers {
+		files := make([]dive.File, 0, len(layer.files))
+		for _, file := range layer.files {
+			if dive.IsUnder(file.Path, target) {
+				continue
+			}
+			if file.IsWhiteout() && dive.IsUnder(file.WhiteoutTarget(), target) {
+				continue
+			}
+			files = append(files, file)
+		}
+		updated[i] = simLayer{sources: layer.sources, commands: layer.commands, files: files}
+	}
+	return updated
+}
+
+// moveDeletion removes a path from the layers that produced it and drops the
+// later whiteout, as if the path had been deleted in the same RUN step.
+func moveDeletion(layers []simLayer, target string) ([]simLayer, bool) {
+	deletedAt := -1
+	for i, layer := range layers {
+		for _, file := range layer.files {
+			if file.IsWhiteout() && !file.IsOpaqueWhiteout() && file.WhiteoutTarget() == target {
+				deletedAt = i
+				break
+			}
+		}
+		if deletedAt >= 0 {
+			break
+		}
+	}
+	if deletedAt < 0 {
+		return layers, false
+	}
+
+	updated := make([]simLayer, len(layers))
+	copy(updated, layers)
+	for i := 0; i <= deletedAt; i++ {
+		files := make([]dive.File, 0, len(layers[i].files))
+		for _, file := range layers[i].files {
+			if i < deletedAt && dive.IsUnder(file.Path, target) {
+				continue
+			}
+			if i == deletedAt && file.IsWhiteout() && file.WhiteoutTarget() == target {
+				continue
+			}
+			files = append(files, file)
+		}
+		updated[i] = simLayer{sources: layers[i].sources, commands: layers[i].commands, files: files}
+	}
+	return updated, true
+}
+
+// mergeRange squashes layers From..To into one, so files overwritten or
+// deleted inside the range no longer occupy space in an earlier layer.
+func mergeRange(layers []simLayer, layerRange LayerRange) []simLayer {
+	merged := simLayer{}
+	byPath := make(map[string]dive.File)
+	for _, layer := range layers[layerRange.From : layerRange.To+1] {
+		merged.sources = append(merged.sources, layer.sources...)
+		merged.commands = append(merged.commands, layer.commands...)
+		for _, file := range layer.files {
+			if file.IsWhiteout() {
+				target := file.WhiteoutTarget()
+				for existing := range byPath {
+					if existing != target && !dive.IsUnder(existing, target) {
+						continue
+					}
+					if file.IsOpaqueWhiteout() && existing == target {
+						continue
+					}
+					delete(byPath, existing)
+				}
+				// The whiteout is only still needed when it hides content
+				// from below the merged range.
+				if existsIn(layers[:layerRange.From], target, file.IsOpaqueWhiteout()) {
+					byPath[file.Path] = file
+				}
+				continue
+			}
+			byPath[file.Path] = file
+		}
+	}
+
+	merged.files = make([]dive.File, 0, len(byPath))
+	for _, file := range byPath {
+		merged.files = append(merged.files, file)
+	}
+	sort.Slice(merged.files, func(i, j int) bool {
+		return merged.files[i].Path < merged.files[j].Path
+	})
+
+	updated := make([]simLayer, 0, len(layers)-(layerRange.To-layerRange.From))
+	updated = append(updated, layers[:layerRange.From]...)
+	updated = append(updated, merged)
+	updated = append(updated, layers[layerRange.To+1:]...)
+	return updated
+}
+
+func existsIn(layers []simLayer, target string, childrenOnly bool) bool {
+	for _, layer := range layers {
+		for _, file := range layer.files {
+			if file.IsWhiteout() {
+				continue
+			}
+			if childrenOnly && file.Path == target {
+				continue
+			}
+			if dive.IsUnder(file.Path, target) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type pathEfficiency struct {
+	count          int
+	cumulativeSize int64
+	minimumSize    int64
+}
+
+func measure(layers []simLayer) (Metrics, []LayerMetrics) {
+	stacked := make(map[string]int64)
+	efficiency := make(map[string]*pathEfficiency)
+	layerMetrics := make([]LayerMetrics, 0, len(layers))
+	var totalSize int64
+
+	for _, layer := range layers {
+		var layerSize int64
+		for _, file := range layer.files {
+			if file.IsDir {
+				continue
+			}
+
+			key := file.Path
+			size := file.SizeBytes
+			if file.IsWhiteout() {
+				key = file.WhiteoutTarget()
+				size = 0
+				for existing, existingSize := range stacked {
+					if dive.IsUnder(existing, key) {
+						size += existingSize
+					}
+				}
+			} else {
+				layerSize += file.SizeBytes
+			}
+
+			data, ok := efficiency[key]
+			if !ok {
+				data = &pathEfficiency{minimumSize: -1}
+				efficiency[key] = data
+			}
+			data.count++
+			data.cumulativeSize += size
+			if data.minimumSize < 0 || size < data.minimumSize {
+				data.minimumSize = size
+			}
+		}
+
+		for _, file := range layer.files {
+			if file.IsDir {
+				continue
+			}
+			if file.IsWhiteout() {
+				target := file.WhiteoutTarget()
+				for existing := range stacked {
+					if existing != target && dive.IsUnder(existing, target) {
+						delete(stacked, existing)
+					} else if existing == target && !file.IsOpaqueWhiteout() {
+						delete(stacked, existing)
+					}
+				}
+				continue
+			}
+			stacked[file.Path] = file.SizeBytes
+		}
+
+		totalSize += layerSize
+		layerMetrics = append(layerMetrics, LayerMetrics{
+			SourceIndexes: layer.sources,
+			Commands:      layer.commands,
+			SizeBytes:     layerSize,
+		})
+	}
+
+	var minimumSizes int64
+	var discoveredSizes int64
+	var inefficientBytes int64
+	for _, data := range efficiency {
+		minimumSizes += data.minimumSize
+		discoveredSizes += data.cumulativeSize
+		if data.count > 1 {
+			inefficientBytes += data.cumulativeSize
+		}
+	}
+	score := 1.0
+	if discoveredSizes > 0 {
+		score = float64(minimumSizes) / float64(discoveredSizes)
+	}
+
+	return Metrics{
+		SizeBytes:        totalSize,
+		InefficientBytes: inefficientBytes,
+		EfficiencyScore:  score,
+		LayerCount:       len(layers),
+	}, layerMetrics
+}
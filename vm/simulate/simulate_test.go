@@ -0,0 +1,135 @@
+package simulate
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"deep-dive/dive"
+)
+
+// fixture is a small image that downloads a file in one layer, deletes it
+// in the next and overwrites another file in the last:
+//
+//	0  /bin/sh (100)
+//	1  /tmp/big (1000), /app/a (10)
+//	2  whiteout of /tmp/big
+//	3  /app/a (20)
+func fixture() dive.Result {
+	return dive.Result{Layers: []dive.Layer{
+		{Command: "FROM base", Files: []dive.File{{Path: "/bin/sh", SizeBytes: 100}}},
+		{Command: "RUN download", Files: []dive.File{{Path: "/tmp/big", SizeBytes: 1000}, {Path: "/app/a", SizeBytes: 10}}},
+		{Command: "RUN cleanup", Files: []dive.File{{Path: "/tmp/.wh.big"}}},
+		{Command: "COPY a /app/a", Files: []dive.File{{Path: "/app/a", SizeBytes: 20}}},
+	}}
+}
+
+func TestRunValidatesPlan(t *testing.T) {
+	tests := []struct {
+		name string
+		plan Plan
+		want string
+	}{
+		{name: "empty plan", plan: Plan{}, want: "at least one operation"},
+		{name: "single layer range", plan: Plan{MergeLayers: []LayerRange{{From: 1, To: 1}}}, want: "invalid merge range 1-1"},
+		{name: "reversed range", plan: Plan{MergeLayers: []LayerRange{{From: 2, To: 1}}}, want: "invalid merge range 2-1"},
+		{name: "negative start", plan: Plan{MergeLayers: []LayerRange{{From: -1, To: 1}}}, want: "invalid merge range -1-1"},
+		{name: "past the last layer", plan: Plan{MergeLayers: []LayerRange{{From: 2, To: 4}}}, want: "invalid merge range 2-4 for 4 layers"},
+		{name: "overlapping ranges", plan: Plan{MergeLayers: []LayerRange{{From: 2, To: 3}, {From: 0, To: 2}}}, want: "merge ranges 0-2 and 2-3 overlap"},
+		{name: "drop root", plan: Plan{DropPaths: []string{"/"}}, want: "below /"},
+		{name: "blank deletion", plan: Plan{MoveDeletions: []string{"  "}}, want: "below /"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Run(fixture(), test.plan)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("Run() error = %v, want it to contain %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestRunWithoutFileData(t *testing.T) {
+	result := dive.Result{Layers: []dive.Layer{{Command: "FROM base"}, {Command: "RUN true"}}}
+	_, err := Run(result, Plan{MergeLayers: []LayerRange{{From: 0, To: 1}}})
+	if !errors.Is(err, dive.ErrNoFileData) {
+		t.Fatalf("Run() error = %v, want %v", err, dive.ErrNoFileData)
+	}
+}
+
+func TestRun(t *testing.T) {
+	baseline := Metrics{SizeBytes: 1130, InefficientBytes: 2030, EfficiencyScore: 1110.0 / 2130.0, LayerCount: 4}
+	tests := []struct {
+		name         string
+		plan         Plan
+		want         Metrics
+		wantSources  [][]int
+		wantWarnings []string
+	}{
+		{
+			name:        "whiteout inside the merged range drops the file",
+			plan:        Plan{MergeLayers: []LayerRange{{From: 1, To: 2}}},
+			want:        Metrics{SizeBytes: 130, InefficientBytes: 30, EfficiencyScore: 110.0 / 130.0, LayerCount: 3},
+			wantSources: [][]int{{0}, {1, 2}, {3}},
+		},
+		{
+			name:        "whiteout hiding a lower layer is kept",
+			plan:        Plan{MergeLayers: []LayerRange{{From: 2, To: 3}}},
+			want:        Metrics{SizeBytes: 1130, InefficientBytes: 2030, EfficiencyScore: 1110.0 / 2130.0, LayerCount: 3},
+			wantSources: [][]int{{0}, {1}, {2, 3}},
+		},
+		{
+			name:        "ranges given out of order",
+			plan:        Plan{MergeLayers: []LayerRange{{From: 2, To: 3}, {From: 0, To: 1}}},
+			want:        Metrics{SizeBytes: 1130, InefficientBytes: 2030, EfficiencyScore: 1110.0 / 2130.0, LayerCount: 2},
+			wantSources: [][]int{{0, 1}, {2, 3}},
+		},
+		{
+			name:        "deletion moved into the creating layer",
+			plan:        Plan{MoveDeletions: []string{"/tmp/big"}},
+			want:        Metrics{SizeBytes: 130, InefficientBytes: 30, EfficiencyScore: 110.0 / 130.0, LayerCount: 4},
+			wantSources: [][]int{{0}, {1}, {2}, {3}},
+		},
+		{
+			name:         "deletion without a later whiteout",
+			plan:         Plan{MoveDeletions: []string{"app/a"}},
+			want:         baseline,
+			wantSources:  [][]int{{0}, {1}, {2}, {3}},
+			wantWarnings: []string{"no deletion of /app/a found in a later layer"},
+		},
+		{
+			name:        "dropped directory takes its whiteouts",
+			plan:        Plan{DropPaths: []string{"/tmp"}},
+			want:        Metrics{SizeBytes: 130, InefficientBytes: 30, EfficiencyScore: 110.0 / 130.0, LayerCount: 4},
+			wantSources: [][]int{{0}, {1}, {2}, {3}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			outcome, err := Run(fixture(), test.plan)
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if outcome.Baseline != baseline {
+				t.Errorf("Baseline = %+v, want %+v", outcome.Baseline, baseline)
+			}
+			if outcome.Simulated != test.want {
+				t.Errorf("Simulated = %+v, want %+v", outcome.Simulated, test.want)
+			}
+			if outcome.Savings.SizeBytes != baseline.SizeBytes-test.want.SizeBytes {
+				t.Errorf("Savings.SizeBytes = %d, want %d", outcome.Savings.SizeBytes, baseline.SizeBytes-test.want.SizeBytes)
+			}
+			var sources [][]int
+			for _, layer := range outcome.Layers {
+				sources = append(sources, layer.SourceIndexes)
+			}
+			if !reflect.DeepEqual(sources, test.wantSources) {
+				t.Errorf("layer sources = %v, want %v", sources, test.wantSources)
+			}
+			if !reflect.DeepEqual(outcome.Warnings, test.wantWarnings) {
+				t.Errorf("Warnings = %v, want %v", outcome.Warnings, test.wantWarnings)
+			}
+		})
+	}
+}